@@ -0,0 +1,79 @@
+package bitfog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// Chunk size boundaries.  Chunks average around ChunkAvg bytes, but
+// are never smaller than ChunkMin (except at the end of a stream) or
+// larger than ChunkMax.
+const (
+	ChunkMin = 64 * 1024
+	ChunkAvg = 256 * 1024
+	ChunkMax = 1024 * 1024
+
+	// The high bits of the gear hash depend on the most bytes.
+	chunkMask = (ChunkAvg - 1) << (64 - 18)
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64, so everyone agrees on the table.
+	x := uint64(0x62697466_6f672121)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// A Chunker splits a stream into content-defined chunks such that
+// identical runs of data in different streams (or different places
+// in the same stream) tend to produce identical chunks.
+type Chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// NewChunker returns a Chunker reading from r.
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: bufio.NewReaderSize(r, ChunkMax), buf: make([]byte, ChunkMax)}
+}
+
+// Next returns the next chunk from the stream, or io.EOF when there
+// are no more.  The returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	var h uint64
+	n := 0
+	for n < ChunkMax {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if n == 0 {
+				return nil, io.EOF
+			}
+			return c.buf[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf[n] = b
+		n++
+		h = (h << 1) + gear[b]
+		if n >= ChunkMin && h&chunkMask == 0 {
+			break
+		}
+	}
+	return c.buf[:n], nil
+}
+
+// ChunkID returns the content address of a chunk.
+func ChunkID(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
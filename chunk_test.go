@@ -0,0 +1,66 @@
+package bitfog
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte) []string {
+	var rv []string
+	c := NewChunker(bytes.NewReader(data))
+	total := 0
+	for {
+		b, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error chunking: %v", err)
+		}
+		if len(b) > ChunkMax {
+			t.Errorf("Chunk too large: %v", len(b))
+		}
+		total += len(b)
+		rv = append(rv, ChunkID(b))
+	}
+	if total != len(data) {
+		t.Errorf("Expected %v bytes of chunks, got %v", len(data), total)
+	}
+	return rv
+}
+
+func TestChunking(t *testing.T) {
+	data := make([]byte, 8*ChunkMax)
+	rand.New(rand.NewSource(8675309)).Read(data)
+
+	a := chunkAll(t, data)
+	if len(a) < 2 {
+		t.Fatalf("Expected several chunks, got %v", len(a))
+	}
+	if b := chunkAll(t, data); len(a) != len(b) || a[0] != b[0] {
+		t.Errorf("Chunking isn't deterministic: %v vs %v", a, b)
+	}
+
+	// Shifting everything over by a bit should still find most of
+	// the same chunks.
+	shifted := chunkAll(t, append([]byte("hello"), data...))
+	seen := map[string]bool{}
+	for _, id := range a {
+		seen[id] = true
+	}
+	common := 0
+	for _, id := range shifted {
+		if seen[id] {
+			common++
+		}
+	}
+	if common < len(a)-2 {
+		t.Errorf("Only found %v of %v chunks after shifting", common, len(a))
+	}
+
+	if got := chunkAll(t, nil); len(got) != 0 {
+		t.Errorf("Expected no chunks from nothing, got %v", got)
+	}
+}
@@ -1,36 +1,174 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
 	"sort"
 
 	"github.com/dustin/bitfog"
 )
 
+var comparePolicy = flag.String("compare", "size+hash",
+	"fetch, store, db diff: how to tell files apart (size+hash, size+mtime or full)")
+
+// A comparison decides whether a file's content needs carrying, and
+// whether its metadata needs updating.
+type comparison struct {
+	// Whether a different mtime means different content.
+	mtime bool
+	// Whether to look for metadata that's changed.
+	meta bool
+}
+
+var comparisons = map[string]comparison{
+	// Content is compared by size and hash.  Files with no hash on
+	// either side (from areas without checksums) are taken to be
+	// unchanged if they're the same size, so use size+mtime or -hash
+	// with those.
+	"size+hash": {},
+	// For areas without hashes: a file's changed if its size or
+	// mtime has.
+	"size+mtime": {mtime: true},
+	// As size+mtime and size+hash together, and changes to mode,
+	// ownership and extended attributes are updated in place.  An
+	// mtime alone can't be updated, as where there's no hash it's all
+	// that says the content changed.
+	"full": {mtime: true, meta: true},
+}
+
+func cliComparison() (comparison, error) {
+	c, ok := comparisons[*comparePolicy]
+	if !ok {
+		return c, fmt.Errorf("unknown comparison %q", *comparePolicy)
+	}
+	return c, nil
+}
+
+// sameContent reports whether a and b have the same content.
+func (c comparison) sameContent(a, b bitfog.FileData) bool {
+	if !a.Equals(b) {
+		return false
+	}
+	return !c.mtime || !os.FileMode(a.Mode).IsRegular() || a.Mtime == b.Mtime
+}
+
+// sameMeta reports whether a and b have the same metadata, if that's
+// being checked.  Symlinks have no mode or mtime of their own, and
+// ownership is only compared when both sides know it.
+func (c comparison) sameMeta(a, b bitfog.FileData) bool {
+	if !c.meta {
+		return true
+	}
+	if a.Meta != nil && b.Meta != nil && !reflect.DeepEqual(a.Meta, b.Meta) {
+		return false
+	}
+	if os.FileMode(a.Mode)&os.ModeSymlink != 0 {
+		return true
+	}
+	return a.Mode == b.Mode && a.Mtime == b.Mtime
+}
+
+// updatesMtimes reports whether stored files should be given their
+// source's mode and mtime, as they'll be compared.
+func (c comparison) updatesMtimes() bool {
+	return c.mtime || c.meta
+}
+
+// changes is what it takes to make one listing look like another.
+type changes struct {
+	// Files whose content needs carrying (or links making).
+	add []bitfog.FileData
+	// Names that need removing.
+	remove []string
+	// Files whose content is fine, but whose metadata isn't.
+	update []bitfog.FileData
+}
+
 // List of files that need to be added, removed.
 func computeChanged(src, dest map[string]bitfog.FileData) ([]string, []string) {
-	var toadd, toremove []string
+	var toadd []string
+	c, _ := changedFiles(mapIter(src), mapIter(dest), comparison{})
+	for _, fd := range c.add {
+		toadd = append(toadd, fd.Name)
+	}
 
-	for k := range dest {
-		if _, ok := src[k]; !ok {
-			toremove = append(toremove, k)
-		}
+	fns := filenames{names: toadd, data: src}
+	sort.Sort(&fns)
+
+	return toadd, c.remove
+}
+
+// linkGroups remembers the first name seen for each file with more
+// than one.  Listings are in name order, so that's the one the others
+// are linked to.
+type linkGroups map[[2]uint64]string
+
+// leader returns the name fd should be a hard link to, or "" if it's
+// the first (or only) name of its file.
+func (g linkGroups) leader(fd bitfog.FileData) string {
+	if fd.Nlink < 2 || fd.Ino == 0 || !os.FileMode(fd.Mode).IsRegular() {
+		return ""
+	}
+	k := [2]uint64{fd.Dev, fd.Ino}
+	if l, ok := g[k]; ok {
+		return l
 	}
+	g[k] = fd.Name
+	return ""
+}
 
-	for srckey, srcval := range src {
-		destval, found := dest[srckey]
-		if found {
-			if !srcval.Equals(destval) {
-				toadd = append(toadd, srckey)
+// changedFiles walks two listings together in name order, returning
+// the files in src that are missing or different in dest, the names
+// in dest that aren't in src, and the files whose metadata alone is
+// different.  Only the differences are kept in memory.
+//
+// Files that are hard links to an earlier file in src come back with
+// LinkTo set, and are different if they aren't linked the same way in
+// dest (when dest says).
+func changedFiles(src, dest fileIter, cmp comparison) (changes, error) {
+	var toadd, toupdate []bitfog.FileData
+	var toremove []string
+	srcLinks, destLinks := linkGroups{}, linkGroups{}
+
+	s, d := src.next(), dest.next()
+	for s || d {
+		switch {
+		case !s || (d && dest.file().Name < src.file().Name):
+			destLinks.leader(dest.file())
+			toremove = append(toremove, dest.file().Name)
+			d = dest.next()
+		case !d || src.file().Name < dest.file().Name:
+			fd := src.file()
+			fd.LinkTo = srcLinks.leader(fd)
+			toadd = append(toadd, fd)
+			s = src.next()
+		default:
+			fd, dfd := src.file(), dest.file()
+			fd.LinkTo = srcLinks.leader(fd)
+			destTo := destLinks.leader(dfd)
+			switch {
+			case !cmp.sameContent(fd, dfd) ||
+				(fd.Nlink != 0 && dfd.Nlink != 0 && fd.LinkTo != destTo):
+				toadd = append(toadd, fd)
+			case !cmp.sameMeta(fd, dfd) && fd.LinkTo == "":
+				// Links share their metadata with what they link to.
+				toupdate = append(toupdate, fd)
 			}
-		} else {
-			toadd = append(toadd, srckey)
+			s, d = src.next(), dest.next()
 		}
 	}
+	c := changes{add: toadd, remove: toremove, update: toupdate}
+	if err := src.err(); err != nil {
+		return c, err
+	}
+	return c, dest.err()
+}
 
-	fns := filenames{names: toadd, data: src}
-	sort.Sort(&fns)
-
-	return toadd, toremove
+// largestFirst orders files so the biggest are transferred first.
+func largestFirst(fds []bitfog.FileData) {
+	sort.SliceStable(fds, func(i, j int) bool { return fds[i].Size > fds[j].Size })
 }
 
 type filenames struct {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"reflect"
 	"testing"
 
 	"github.com/dustin/bitfog"
@@ -142,3 +144,152 @@ func TestFilenamesSorting(t *testing.T) {
 		t.Errorf("Expected 0 to be a, got %v", fns.names[1])
 	}
 }
+
+func TestChangedFiles(t *testing.T) {
+	src := map[string]bitfog.FileData{
+		"a": {Size: 1},
+		"b": {Size: 3},
+		"c": {Size: 2},
+		"d": {Size: 5},
+	}
+	dest := map[string]bitfog.FileData{
+		"0": {Size: 1},
+		"b": {Size: 3},
+		"c": {Size: 4},
+		"e": {Size: 1},
+	}
+	c, err := changedFiles(mapIter(src), mapIter(dest), comparison{})
+	if err != nil {
+		t.Fatalf("Error comparing: %v", err)
+	}
+	toadd, toremove := c.add, c.remove
+	largestFirst(toadd)
+	var got []string
+	for _, fd := range toadd {
+		got = append(got, fd.Name)
+	}
+	if exp := []string{"d", "c", "a"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to add %v, got %v", exp, got)
+	}
+	if exp := []string{"0", "e"}; !reflect.DeepEqual(toremove, exp) {
+		t.Errorf("Expected to remove %v, got %v", exp, toremove)
+	}
+}
+
+func TestParentDir(t *testing.T) {
+	tests := map[string]string{
+		"a":       "",
+		"a/":      "",
+		"a/b":     "a/",
+		"a/b/":    "a/",
+		"a/b/c.d": "a/b/",
+	}
+	for in, exp := range tests {
+		if got := parentDir(in); got != exp {
+			t.Errorf("parentDir(%q) = %q, expected %q", in, got, exp)
+		}
+	}
+}
+
+func TestChangedFilesLinks(t *testing.T) {
+	linked := func(size int64, dev, ino uint64) bitfog.FileData {
+		return bitfog.FileData{Size: size, Nlink: 2, Dev: dev, Ino: ino}
+	}
+	single := bitfog.FileData{Size: 1, Nlink: 1}
+	src := map[string]bitfog.FileData{
+		"a":  linked(5, 1, 10),
+		"b":  linked(5, 1, 10),
+		"c":  linked(7, 1, 11),
+		"d":  linked(7, 1, 11),
+		"e":  single,
+		"f1": linked(9, 1, 12),
+		"f2": linked(9, 2, 12),
+	}
+	tests := []struct {
+		dest map[string]bitfog.FileData
+		exp  []string
+		to   []string
+	}{
+		// Nothing there yet.
+		{map[string]bitfog.FileData{},
+			[]string{"a", "b", "c", "d", "e", "f1", "f2"},
+			[]string{"", "a", "", "c", "", "", ""}},
+		// Linked the same way (if with different inodes).
+		{map[string]bitfog.FileData{
+			"a": linked(5, 7, 20), "b": linked(5, 7, 20),
+			"c": linked(7, 7, 21), "d": linked(7, 7, 21),
+			"e": single, "f1": {Size: 9, Nlink: 1}, "f2": {Size: 9, Nlink: 1}},
+			nil, nil},
+		// Copies rather than links, and linked where they shouldn't be.
+		{map[string]bitfog.FileData{
+			"a": {Size: 5, Nlink: 1}, "b": {Size: 5, Nlink: 1},
+			"c": linked(7, 7, 21), "d": linked(7, 7, 21),
+			"e": single, "f1": linked(9, 7, 22), "f2": linked(9, 7, 22)},
+			[]string{"b", "f2"},
+			[]string{"a", ""}},
+		// The destination doesn't know about links.
+		{map[string]bitfog.FileData{
+			"a": {Size: 5}, "b": {Size: 5}, "c": {Size: 7}, "d": {Size: 7},
+			"e": {Size: 1}, "f1": {Size: 9}, "f2": {Size: 9}},
+			nil, nil},
+	}
+	for i, test := range tests {
+		c, err := changedFiles(mapIter(src), mapIter(test.dest), comparison{})
+		if err != nil {
+			t.Fatalf("Error comparing: %v", err)
+		}
+		toadd := c.add
+		var to []string
+		for _, fd := range toadd {
+			to = append(to, fd.LinkTo)
+		}
+		if got := names(toadd); !reflect.DeepEqual(got, test.exp) || !reflect.DeepEqual(to, test.to) {
+			t.Errorf("%v: expected to add %v linked to %q, got %v linked to %q",
+				i, test.exp, test.to, got, to)
+		}
+	}
+}
+
+func TestChangedFilesCompare(t *testing.T) {
+	const reg, link = 0644, int32(os.ModeSymlink | 0777)
+	dir := os.ModeDir | 0755
+	owned := func(uid int) *bitfog.Meta { return &bitfog.Meta{Uid: uid, Gid: 1} }
+	src := map[string]bitfog.FileData{
+		"same":    {Size: 1, Hash: 1, Mode: reg, Mtime: 10},
+		"touched": {Size: 1, Hash: 1, Mode: reg, Mtime: 20},
+		"chmod":   {Size: 1, Hash: 1, Mode: 0600, Mtime: 10},
+		"chown":   {Size: 1, Hash: 1, Mode: reg, Mtime: 10, Meta: owned(2)},
+		"nohash":  {Size: 1, Mode: reg, Mtime: 20},
+		"sym":     {Dest: "same", Mode: link, Mtime: 20},
+		"dir/":    {Mode: int32(dir), Mtime: 20},
+	}
+	dest := map[string]bitfog.FileData{
+		"same":    {Size: 1, Hash: 1, Mode: reg, Mtime: 10},
+		"touched": {Size: 1, Hash: 1, Mode: reg, Mtime: 10},
+		"chmod":   {Size: 1, Hash: 1, Mode: reg, Mtime: 10},
+		"chown":   {Size: 1, Hash: 1, Mode: reg, Mtime: 10, Meta: owned(3)},
+		"nohash":  {Size: 1, Mode: reg, Mtime: 10},
+		"sym":     {Dest: "same", Mode: link, Mtime: 10},
+		"dir/":    {Mode: int32(dir), Mtime: 10},
+	}
+	tests := []struct {
+		policy      string
+		add, update []string
+	}{
+		{"size+hash", []string{"dir/"}, nil},
+		{"size+mtime", []string{"dir/", "nohash", "touched"}, nil},
+		{"full", []string{"dir/", "nohash", "touched"}, []string{"chmod", "chown"}},
+	}
+	for _, test := range tests {
+		c, err := changedFiles(mapIter(src), mapIter(dest), comparisons[test.policy])
+		if err != nil {
+			t.Fatalf("Error comparing: %v", err)
+		}
+		if got := names(c.add); !reflect.DeepEqual(got, test.add) {
+			t.Errorf("%v: expected to add %v, got %v", test.policy, test.add, got)
+		}
+		if got := names(c.update); !reflect.DeepEqual(got, test.update) {
+			t.Errorf("%v: expected to update %v, got %v", test.policy, test.update, got)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/bitfog"
+)
+
+// Everything bitfog itself keeps in a carry directory lives under here.
+const carryMeta = ".bitfog"
+
+// carryEntry describes how a single file is held in the carry
+// directory.  Files that aren't chunked are stored as-is under their
+// own name.
+type carryEntry struct {
+	Name    string   `json:"name"`
+	Chunked bool     `json:"chunked,omitempty"`
+	Chunks  []string `json:"chunks,omitempty"`
+	// How the content (or each of the chunks) is compressed, if at all.
+	Compression string `json:"compression,omitempty"`
+	// Ownership and extended attributes, if the source recorded them.
+	Meta *bitfog.Meta `json:"meta,omitempty"`
+	// End is only set in the last record of a manifest that fetch
+	// finished writing, and counts the records, including itself.
+	End int `json:"end,omitempty"`
+}
+
+// carryOpts controls how fetch fills a carry directory.
+type carryOpts struct {
+	chunked  bool
+	compress bool
+	keys     keySource
+	// Parity shards per parityDataShards data shards (0 for none).
+	parity int
+}
+
+// carryDir is the temporary holding area data travels in between
+// fetch and store.  Every file put into it is recorded in an
+// append-only manifest, so an interrupted fetch still leaves behind
+// everything it completed.
+//
+// When keys are present, the manifest and all file content are
+// encrypted, and files are stored under obscured names.  Content is
+// tied to the file or chunk it belongs to, and each manifest record to
+// its place in the manifest, so nothing can be swapped, reordered or
+// dropped without it being noticed.
+type carryDir struct {
+	path string
+	fs   fsOps
+	opts carryOpts
+	keys *carryKeys
+
+	entries  map[string]carryEntry
+	chunks   map[string]bool
+	manifest io.WriteCloser
+	// Whether there's a manifest to go by.  Without one, anything
+	// found in the directory is assumed to be complete.
+	tracked bool
+	// How many records the manifest has, and whether it ends with
+	// the record fetch writes when it's done.
+	records  int
+	finished bool
+}
+
+func (c *carryDir) manifestPath() string {
+	return filepath.Join(c.path, carryMeta, "manifest")
+}
+
+func (c *carryDir) keyPath() string {
+	return filepath.Join(c.path, carryMeta, "key")
+}
+
+func (c *carryDir) chunkPath(id string) string {
+	if c.keys != nil {
+		id = c.keys.obscure("chunk:" + id)
+	}
+	return filepath.Join(c.path, carryMeta, "chunks", id[:2], id)
+}
+
+// filePath is where the content of an unchunked file lives.  Without
+// encryption, that's under its own name, unless that would put it
+// among the carry directory's own files (on a filesystem that may not
+// care about case).
+func (c *carryDir) filePath(name string) string {
+	if c.keys != nil {
+		h := c.keys.obscure("file:" + name)
+		return filepath.Join(c.path, carryMeta, "data", h[:2], h)
+	}
+	if first := strings.SplitN(name, "/", 2)[0]; strings.EqualFold(first, carryMeta) {
+		return filepath.Join(c.path, carryMeta, "files", name)
+	}
+	return filepath.Join(c.path, name)
+}
+
+// createCarry starts a new manifest in an empty carry directory.
+func createCarry(path string, fs fsOps, opts carryOpts) (*carryDir, error) {
+	ks := opts.keys
+	c := &carryDir{path: path, fs: fs, opts: opts,
+		entries: map[string]carryEntry{},
+		chunks:  map[string]bool{},
+		tracked: true,
+	}
+	if err := fs.MkdirAll(filepath.Join(path, carryMeta), 0777); err != nil {
+		return nil, err
+	}
+	if !ks.empty() {
+		kp, err := newKeyParams(ks)
+		if err != nil {
+			return nil, err
+		}
+		if c.keys, err = deriveKeys(ks, &kp); err != nil {
+			return nil, err
+		}
+		f, err := fs.Create(c.keyPath())
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewEncoder(f).Encode(kp)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = c.protect(c.keyPath())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	c.manifest, err = fs.Create(c.manifestPath())
+	return c, err
+}
+
+// openCarry reads the manifest of a carry directory.  A directory
+// without a manifest is treated as holding plain files.
+func openCarry(path string, fs fsOps, ks keySource) (*carryDir, error) {
+	c := &carryDir{path: path, fs: fs,
+		entries: map[string]carryEntry{},
+		chunks:  map[string]bool{},
+	}
+
+	// Without these, nothing else can be read, so they're checked
+	// (and fixed) first.
+	c.repairMeta(c.keyPath())
+	c.repairMeta(c.manifestPath())
+
+	kf, err := fs.Open(c.keyPath())
+	if err == nil {
+		var kp keyParams
+		err = json.NewDecoder(kf).Decode(&kp)
+		kf.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ks.empty() {
+			return nil, errors.New("carry directory is encrypted, but no key was given")
+		}
+		if c.keys, err = deriveKeys(ks, &kp); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := fs.Open(c.manifestPath())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c.tracked = true
+
+	r := bufio.NewReader(f)
+	for {
+		// A torn final record is expected if fetch was stopped mid-write.
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		if c.keys != nil {
+			if line, err = c.keys.open(string(line[:len(line)-1]), recordAD(c.records)); err != nil {
+				return nil, fmt.Errorf("manifest record %d: %v", c.records, err)
+			}
+		}
+		var e carryEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, err
+		}
+		c.records++
+		switch {
+		case c.finished:
+			return nil, errors.New("manifest continues past its end")
+		case e.End != 0 && e.End != c.records:
+			return nil, fmt.Errorf("manifest ends after %d records, but has %d", e.End, c.records)
+		case e.End != 0:
+			c.finished = true
+			continue
+		}
+		c.entries[e.Name] = e
+		for _, id := range e.Chunks {
+			c.chunks[id] = true
+		}
+	}
+	return c, nil
+}
+
+// recordAD ties the manifest record at seq to its place.
+func recordAD(seq int) []byte {
+	return []byte("manifest:" + strconv.Itoa(seq))
+}
+
+func (c *carryDir) writeRecord(e carryEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if c.keys != nil {
+		b = []byte(c.keys.seal(b, recordAD(c.records)))
+	}
+	if _, err := c.manifest.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	c.records++
+	return nil
+}
+
+func (c *carryDir) record(e carryEntry) error {
+	if err := c.writeRecord(e); err != nil {
+		return err
+	}
+	c.entries[e.Name] = e
+	return nil
+}
+
+// create makes a file to hold carried content, compressing and
+// encrypting it on the way in as appropriate.  what says whose
+// content it is (as given to obscure).
+func (c *carryDir) create(p, what, compression string) (io.WriteCloser, error) {
+	f, err := c.fs.Create(p)
+	if err != nil {
+		c.fs.MkdirAll(filepath.Dir(p), 0777)
+		f, err = c.fs.Create(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.keys != nil {
+		if f, err = c.keys.encrypt(f, []byte(what)); err != nil {
+			return nil, err
+		}
+	}
+	if compression == "zstd" {
+		return newZstdWriter(f)
+	}
+	return sparse(f), nil
+}
+
+// openContent reads carried content written by create.
+func (c *carryDir) openContent(p, what, compression string) (io.ReadCloser, error) {
+	f, err := c.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if c.keys != nil {
+		if f, err = c.keys.decrypt(f, []byte(what)); err != nil {
+			return nil, err
+		}
+	}
+	if compression == "zstd" {
+		return newZstdReader(f)
+	}
+	return f, nil
+}
+
+func (c *carryDir) write(p, what, compression string, r io.Reader) error {
+	f, err := c.create(p, what, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return c.protect(p)
+}
+
+// protect writes parity for the carried file at p, if fetch was asked
+// to.
+func (c *carryDir) protect(p string) error {
+	if c.opts.parity == 0 {
+		return nil
+	}
+	pp := c.parityPath(p)
+	if err := c.fs.MkdirAll(filepath.Dir(pp), 0777); err != nil {
+		return err
+	}
+	return writeParity(p, pp, c.opts.parity)
+}
+
+// repairMeta fixes any damage to one of bitfog's own files in the
+// carry directory, if it has parity.  Anything that can't be fixed is
+// left for reading it to trip over.
+func (c *carryDir) repairMeta(p string) {
+	damaged, err := checkParity(p, c.parityPath(p), true)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Printf("Can't repair %v: %v", p, err)
+	case damaged > 0:
+		log.Printf("Repaired %d damaged shards of %v", damaged, p)
+	}
+}
+
+// parityPath is where parity for the carried file at p lives.
+func (c *carryDir) parityPath(p string) string {
+	rel, _ := filepath.Rel(c.path, p)
+	return filepath.Join(c.path, carryMeta, "parity", rel+".par")
+}
+
+// contentPaths lists the files holding the content of name.
+func (c *carryDir) contentPaths(name string) []string {
+	e := c.entries[name]
+	if !e.Chunked {
+		return []string{c.filePath(name)}
+	}
+	var rv []string
+	for _, id := range e.Chunks {
+		rv = append(rv, c.chunkPath(id))
+	}
+	return rv
+}
+
+// check verifies the content of name against its parity (if it has
+// any), repairing it if asked.  It returns the number of damaged
+// shards found.
+func (c *carryDir) check(name string, repair bool) (int, error) {
+	damaged := 0
+	for _, p := range c.contentPaths(name) {
+		n, err := checkParity(p, c.parityPath(p), repair)
+		damaged += n
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return damaged, err
+		}
+	}
+	return damaged, nil
+}
+
+func (c *carryDir) putChunk(b []byte, compression string) (string, error) {
+	id := bitfog.ChunkID(b)
+	if c.chunks[id] {
+		return id, nil
+	}
+	if err := c.write(c.chunkPath(id), "chunk:"+id, compression, bytes.NewReader(b)); err != nil {
+		return "", err
+	}
+	c.chunks[id] = true
+	return id, nil
+}
+
+// fetch downloads the file at u into the carry directory as name,
+// along with its metadata (if any).
+func (c *carryDir) fetch(ctx context.Context, client *bitfogClient, u, name string, meta *bitfog.Meta) error {
+	body, err := client.openURL(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if !c.opts.chunked {
+		e := carryEntry{Name: name, Meta: meta}
+		br := bufio.NewReaderSize(body, bitfog.CompressSample)
+		if c.opts.compress {
+			sample, _ := br.Peek(bitfog.CompressSample)
+			if bitfog.Compressible(sample) {
+				e.Compression = "zstd"
+			}
+		}
+		if err := c.write(c.filePath(name), "file:"+name, e.Compression, br); err != nil {
+			return err
+		}
+		return c.record(e)
+	}
+
+	// Chunks are shared between files, so they're either all
+	// compressed or none are.
+	e := carryEntry{Name: name, Chunked: true, Meta: meta}
+	if c.opts.compress {
+		e.Compression = "zstd"
+	}
+	ch := bitfog.NewChunker(body)
+	for {
+		b, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id, err := c.putChunk(b, e.Compression)
+		if err != nil {
+			return err
+		}
+		e.Chunks = append(e.Chunks, id)
+	}
+	return c.record(e)
+}
+
+// chunkReader reads a sequence of chunk files one after another.
+type chunkReader struct {
+	c           *carryDir
+	ids         []string
+	compression string
+	cur         io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.ids) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.c.openContent(r.c.chunkPath(r.ids[0]), "chunk:"+r.ids[0], r.compression)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.ids = f, r.ids[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// names lists the files in the carry directory: those in the
+// manifest, or without one, whatever's there.
+func (c *carryDir) names() ([]string, error) {
+	var rv []string
+	if c.tracked {
+		for name := range c.entries {
+			rv = append(rv, name)
+		}
+		return rv, nil
+	}
+	if c.keys != nil {
+		return nil, errors.New("encrypted carry directory has no manifest")
+	}
+	err := filepath.Walk(c.path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.path, p)
+		switch {
+		case err != nil:
+			return err
+		case rel == carryMeta && info.IsDir():
+			return filepath.SkipDir
+		case info.Mode().IsRegular():
+			rv = append(rv, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return rv, err
+}
+
+// open returns the content of the named file from the carry
+// directory.  Files that were never completely fetched don't exist.
+func (c *carryDir) open(name string) (io.ReadCloser, error) {
+	e, ok := c.entries[name]
+	switch {
+	case !ok && c.tracked:
+		return nil, os.ErrNotExist
+	case e.Chunked:
+		return &chunkReader{c: c, ids: e.Chunks, compression: e.Compression}, nil
+	}
+	return c.openContent(c.filePath(name), "file:"+name, e.Compression)
+}
+
+// upload sends the named file from the carry directory to u.  The
+// metadata recorded when it was fetched is sent with it, or else
+// meta.
+func (c *carryDir) upload(ctx context.Context, client *bitfogClient, name, u string, meta *bitfog.Meta) error {
+	if e, ok := c.entries[name]; ok && e.Meta != nil {
+		meta = e.Meta
+	}
+	r, err := c.open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return client.upload(ctx, r, u, meta)
+}
+
+// Close finishes the manifest, marking it as complete.
+func (c *carryDir) Close() error {
+	if c.manifest == nil {
+		return nil
+	}
+	err := c.writeRecord(carryEntry{End: c.records + 1})
+	if cerr := c.manifest.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = c.protect(c.manifestPath())
+	}
+	return err
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/dustin/bitfog"
+)
+
+func readCarried(t *testing.T, c *carryDir, name string) string {
+	r, err := c.open(name)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", name, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", name, err)
+	}
+	return string(b)
+}
+
+func TestCarryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 3*bitfog.ChunkMax)
+	rand.New(rand.NewSource(8675309)).Read(data)
+
+	ks, _ := testKeys(t)
+
+	for _, test := range []carryOpts{
+		{false, false, keySource{}, 0},
+		{true, false, keySource{}, 0},
+		{false, false, ks, 0},
+		{true, false, ks, 0},
+		{false, true, keySource{}, 0},
+		{true, true, ks, 2},
+		{false, true, ks, 2},
+	} {
+		chunked := test.chunked
+		dir := t.TempDir()
+		c, err := createCarry(dir, posixFsOps, test)
+		if err != nil {
+			t.Fatalf("Error creating carry: %v", err)
+		}
+		fc := fakeClient(200, string(data))
+		for _, name := range []string{"a", "sub/b"} {
+			if err := c.fetch(ctx, fc, "http://whatever/"+name, name, nil); err != nil {
+				t.Fatalf("Error fetching %v: %v", name, err)
+			}
+		}
+		if err := c.fetch(ctx, fakeClient(200, ""), "http://whatever/empty", "empty", nil); err != nil {
+			t.Fatalf("Error fetching empty: %v", err)
+		}
+		text := strings.Repeat("hello ", 100000)
+		meta := &bitfog.Meta{Uid: 1000, Gid: 100,
+			Xattrs: map[string][]byte{"user.label": []byte("secret")}}
+		if err := c.fetch(ctx, fakeClient(200, text), "http://whatever/text", "text", meta); err != nil {
+			t.Fatalf("Error fetching text: %v", err)
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("Error closing carry: %v", err)
+		}
+
+		if !test.keys.empty() {
+			if _, err := openCarry(dir, posixFsOps, keySource{}); err == nil {
+				t.Errorf("Expected error opening encrypted carry without a key")
+			}
+			if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+				t.Errorf("Expected names to be hidden, got %v", err)
+			}
+		}
+
+		c, err = openCarry(dir, posixFsOps, test.keys)
+		if err != nil {
+			t.Fatalf("Error opening carry: %v", err)
+		}
+		for _, name := range []string{"a", "sub/b"} {
+			if got := readCarried(t, c, name); got != string(data) {
+				t.Errorf("%+v: wrong content for %v", test, name)
+			}
+		}
+		if got := readCarried(t, c, "text"); got != text {
+			t.Errorf("%+v: wrong content for text", test)
+		}
+		if got := c.entries["text"].Meta; !reflect.DeepEqual(got, meta) {
+			t.Errorf("%+v: expected metadata %+v, got %+v", test, meta, got)
+		}
+		if test.compress && c.entries["text"].Compression != "zstd" {
+			t.Errorf("%+v: expected text to be compressed", test)
+		}
+		if test.compress && !chunked && c.entries["a"].Compression != "" {
+			t.Errorf("%+v: expected random data not to be compressed", test)
+		}
+		for _, name := range []string{"a", "text"} {
+			damaged, err := c.check(name, false)
+			if err != nil || damaged != 0 {
+				t.Errorf("%+v: expected %v to be intact, got %v/%v", test, name, damaged, err)
+			}
+		}
+		if got := readCarried(t, c, "empty"); got != "" {
+			t.Errorf("%+v: expected empty file, got %q", test, got)
+		}
+		if _, err := c.open("missing"); !os.IsNotExist(err) {
+			t.Errorf("%+v: expected missing file, got %v", test, err)
+		}
+
+		if chunked && len(c.chunks) >= 2*len(c.entries["a"].Chunks) {
+			t.Errorf("Expected duplicate chunks to be shared, got %v", len(c.chunks))
+		}
+	}
+}
+
+func TestCarryTornManifest(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, carryMeta), 0777)
+	err := ioutil.WriteFile(filepath.Join(dir, carryMeta, "manifest"),
+		[]byte(`{"name": "a"}`+"\n"+`{"name": "b", "chu`), 0666)
+	if err != nil {
+		t.Fatalf("Error writing manifest: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aye"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("be"), 0666)
+
+	c, err := openCarry(dir, posixFsOps, keySource{})
+	if err != nil {
+		t.Fatalf("Error opening carry: %v", err)
+	}
+	if got := readCarried(t, c, "a"); got != "aye" {
+		t.Errorf("Expected aye, got %q", got)
+	}
+	if _, err := c.open("b"); !os.IsNotExist(err) {
+		t.Errorf("Expected incomplete b to be missing, got %v", err)
+	}
+	if c.finished {
+		t.Errorf("Expected a torn manifest to be unfinished")
+	}
+}
+
+func TestCarryTampering(t *testing.T) {
+	ctx := context.Background()
+	ks, _ := testKeys(t)
+	dir := t.TempDir()
+	c, err := createCarry(dir, posixFsOps, carryOpts{keys: ks})
+	if err != nil {
+		t.Fatalf("Error creating carry: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := c.fetch(ctx, fakeClient(200, name+name), "http://whatever/"+name, name, nil); err != nil {
+			t.Fatalf("Error fetching %v: %v", name, err)
+		}
+	}
+	pa, pb := c.filePath("a"), c.filePath("b")
+	if err := c.Close(); err != nil {
+		t.Fatalf("Error closing carry: %v", err)
+	}
+	manifest, err := ioutil.ReadFile(c.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(manifest), "\n")
+	lines = lines[:len(lines)-1] // after the final newline
+
+	c, err = openCarry(dir, posixFsOps, ks)
+	if err != nil || !c.finished || len(c.entries) != 3 {
+		t.Fatalf("Expected a finished carry of three files, got %v, %v", c, err)
+	}
+
+	// Content can't be swapped between files.
+	a, _ := ioutil.ReadFile(pa)
+	b, _ := ioutil.ReadFile(pb)
+	ioutil.WriteFile(pa, b, 0666)
+	if r, err := c.open("a"); err == nil {
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("Expected b's content under a's name to be refused")
+		}
+		r.Close()
+	}
+	ioutil.WriteFile(pa, a, 0666)
+
+	tests := []struct {
+		what     string
+		lines    []string
+		ok       bool
+		finished bool
+	}{
+		{"reordered", []string{lines[1], lines[0], lines[2], lines[3]}, false, false},
+		{"missing a record", []string{lines[0], lines[2], lines[3]}, false, false},
+		{"repeated", []string{lines[0], lines[0], lines[1], lines[2], lines[3]}, false, false},
+		{"missing its end", lines[:3], true, false},
+		{"cut short", lines[:2], true, false},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(c.manifestPath(), []byte(strings.Join(test.lines, "")), 0666); err != nil {
+			t.Fatal(err)
+		}
+		c, err := openCarry(dir, posixFsOps, ks)
+		if (err == nil) != test.ok {
+			t.Errorf("Opening a manifest %v: expected ok=%v, got %v", test.what, test.ok, err)
+		}
+		if err == nil && c.finished != test.finished {
+			t.Errorf("Opening a manifest %v: expected finished=%v", test.what, test.finished)
+		}
+	}
+}
+
+func TestCarryMetaNames(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := createCarry(dir, posixFsOps, carryOpts{parity: 2})
+	if err != nil {
+		t.Fatalf("Error creating carry: %v", err)
+	}
+	names := []string{"a", carryMeta + "/manifest", strings.ToUpper(carryMeta) + "/key"}
+	for _, name := range names {
+		if err := c.fetch(ctx, fakeClient(200, "not "+name), "http://whatever/"+name, name, nil); err != nil {
+			t.Fatalf("Error fetching %v: %v", name, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Error closing carry: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "a")); err != nil || string(b) != "not a" {
+		t.Errorf("Expected a under its own name, got %q, %v", b, err)
+	}
+
+	c, err = openCarry(dir, posixFsOps, keySource{})
+	if err != nil {
+		t.Fatalf("Error opening carry: %v", err)
+	}
+	for _, name := range names {
+		if got := readCarried(t, c, name); got != "not "+name {
+			t.Errorf("Expected %v to hold %q, got %q", name, "not "+name, got)
+		}
+		if damaged, err := c.check(name, false); err != nil || damaged != 0 {
+			t.Errorf("Expected %v to be intact, got %v/%v", name, damaged, err)
+		}
+	}
+}
+
+func TestCarryUntracked(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aye"), 0666)
+
+	c, err := openCarry(dir, posixFsOps, keySource{})
+	if err != nil {
+		t.Fatalf("Error opening carry: %v", err)
+	}
+	if got := readCarried(t, c, "a"); got != "aye" {
+		t.Errorf("Expected aye, got %q", got)
+	}
+}
+
+func TestCarryMetaParity(t *testing.T) {
+	ctx := context.Background()
+	ks, _ := testKeys(t)
+	dir := t.TempDir()
+	c, err := createCarry(dir, posixFsOps, carryOpts{keys: ks, parity: 2})
+	if err != nil {
+		t.Fatalf("Error creating carry: %v", err)
+	}
+	if err := c.fetch(ctx, fakeClient(200, "aye"), "http://whatever/a", "a", nil); err != nil {
+		t.Fatalf("Error fetching a: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Error closing carry: %v", err)
+	}
+
+	want := map[string][]byte{}
+	for _, p := range []string{c.keyPath(), c.manifestPath()} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[p] = b
+		damaged := append([]byte{}, b...)
+		damaged[len(damaged)/2] ^= 0x10
+		if err := ioutil.WriteFile(p, damaged, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err = openCarry(dir, posixFsOps, ks)
+	if err != nil {
+		t.Fatalf("Error opening damaged carry: %v", err)
+	}
+	if got := readCarried(t, c, "a"); got != "aye" {
+		t.Errorf("Expected aye, got %q", got)
+	}
+	for p, b := range want {
+		if got, _ := ioutil.ReadFile(p); !reflect.DeepEqual(got, b) {
+			t.Errorf("Expected %v to be repaired", p)
+		}
+	}
+}
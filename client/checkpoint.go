@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+var listRetries = flag.Int("retries", 5,
+	"builddb: times to resume an interrupted listing")
+
+// How often a checkpoint is flushed to disk, and how long to wait
+// (times the number of attempts) before resuming a listing.
+var (
+	checkpointInterval = 10 * time.Second
+	retryDelay         = time.Second
+)
+
+// A checkpoint records the progress of a listing, so an interrupted
+// builddb can pick up where it left off rather than starting over.
+// It's the listing itself, as JSON lines, after a line describing
+// where it came from.
+type checkpoint struct {
+	path   string
+	header checkpointHeader
+	f      *os.File
+	w      *bufio.Writer
+	last   string
+	count  int
+	synced time.Time
+}
+
+type checkpointHeader struct {
+	Source string `json:"source"`
+	// Only a sorted listing can be resumed.
+	Sorted bool `json:"sorted"`
+}
+
+// openCheckpoint continues the checkpoint at path if it's a resumable
+// listing of source, or starts a new one.
+func openCheckpoint(path, source string) (*checkpoint, error) {
+	cp := &checkpoint{path: path}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	cp.f = f
+
+	r := bufio.NewReader(f)
+	good := int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// Anything without a newline was torn off mid-write.
+			break
+		}
+		if good == 0 {
+			if json.Unmarshal(line, &cp.header) != nil {
+				break
+			}
+		} else {
+			var fd bitfog.FileData
+			if json.Unmarshal(line, &fd) != nil {
+				break
+			}
+			cp.last = fd.Name
+			cp.count++
+		}
+		good += int64(len(line))
+	}
+
+	if good > 0 && (cp.header.Source != source || !cp.header.Sorted) {
+		log.Printf("Discarding checkpoint of %v", cp.header.Source)
+		good, cp.last, cp.count = 0, "", 0
+	}
+	if good > 0 {
+		log.Printf("Resuming listing of %v after %d files", source, cp.count)
+	} else {
+		cp.header = checkpointHeader{Source: source}
+	}
+	if err := cp.truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *checkpoint) truncate(size int64) error {
+	if err := cp.f.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := cp.f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	cp.w = bufio.NewWriter(cp.f)
+	return nil
+}
+
+// reset throws away everything received so far.
+func (cp *checkpoint) reset() error {
+	cp.last, cp.count = "", 0
+	return cp.truncate(0)
+}
+
+func (cp *checkpoint) sync() error {
+	cp.synced = time.Now()
+	if err := cp.w.Flush(); err != nil {
+		return err
+	}
+	return cp.f.Sync()
+}
+
+// withAfter adds an after= parameter to a listing URL.
+func withAfter(u, after string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	q := pu.Query()
+	q.Set("after", after)
+	pu.RawQuery = q.Encode()
+	return pu.String(), nil
+}
+
+// fetch receives as much of the listing as it can, continuing from
+// wherever the checkpoint left off.
+func (cp *checkpoint) fetch(ctx context.Context, c *bitfogClient) error {
+	u := cp.header.Source
+	if cp.count > 0 {
+		var err error
+		if u, err = withAfter(u, cp.last); err != nil {
+			return err
+		}
+	}
+	l, err := c.openListing(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if cp.count > 0 && !l.sorted {
+		return fmt.Errorf("%v can no longer resume listings", cp.header.Source)
+	}
+	if cp.count == 0 {
+		if err := cp.reset(); err != nil {
+			return err
+		}
+		cp.header.Sorted = l.sorted
+		h, err := json.Marshal(cp.header)
+		if err != nil {
+			return err
+		}
+		cp.w.Write(append(h, '\n'))
+	}
+
+	for l.next() {
+		fd := l.file()
+		b, err := json.Marshal(fd)
+		if err != nil {
+			return err
+		}
+		if _, err := cp.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		cp.last = fd.Name
+		cp.count++
+		if time.Since(cp.synced) > checkpointInterval {
+			if err := cp.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cp.sync(); err != nil {
+		return err
+	}
+	return l.err()
+}
+
+// iter walks everything received.
+func (cp *checkpoint) iter() (fileIter, error) {
+	if err := cp.w.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := cp.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(cp.f)
+	if _, err := r.ReadBytes('\n'); err != nil {
+		return nil, err
+	}
+	return &checkpointIter{d: json.NewDecoder(r)}, nil
+}
+
+func (cp *checkpoint) Close() error {
+	return cp.f.Close()
+}
+
+// remove closes and removes a checkpoint that's no longer needed.
+func (cp *checkpoint) remove() error {
+	cp.f.Close()
+	return os.Remove(cp.path)
+}
+
+type checkpointIter struct {
+	d    *json.Decoder
+	fd   bitfog.FileData
+	fail error
+}
+
+func (ci *checkpointIter) next() bool {
+	ci.fd = bitfog.FileData{}
+	err := ci.d.Decode(&ci.fd)
+	if err != nil && err != io.EOF {
+		ci.fail = err
+	}
+	return err == nil
+}
+
+func (ci *checkpointIter) file() bitfog.FileData { return ci.fd }
+func (ci *checkpointIter) err() error            { return ci.fail }
+
+// listWithCheckpoint fetches a complete listing of u into the
+// checkpoint at path, resuming after interruptions where the server
+// allows it.
+func listWithCheckpoint(ctx context.Context, c *bitfogClient, u, path string) (*checkpoint, error) {
+	cp, err := openCheckpoint(path, u)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		err = cp.fetch(ctx, c)
+		if err == nil {
+			return cp, nil
+		}
+		if attempt > *listRetries || ctx.Err() != nil {
+			break
+		}
+		if cp.header.Sorted {
+			log.Printf("Listing of %v interrupted after %d files: %v; resuming",
+				u, cp.count, err)
+		} else {
+			log.Printf("Listing of %v failed: %v; starting over", u, err)
+			if err := cp.reset(); err != nil {
+				cp.remove()
+				return nil, err
+			}
+		}
+		time.Sleep(time.Duration(attempt) * retryDelay)
+	}
+	if cp.header.Sorted && cp.count > 0 {
+		log.Printf("Progress saved in %v; run again to resume", path)
+		cp.Close()
+	} else {
+		cp.remove()
+	}
+	return nil, err
+}
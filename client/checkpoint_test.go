@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dustin/bitfog"
+)
+
+// flakyTransport serves a sorted listing, honoring after=, but drops
+// the connection after failAfter files the first few times.
+type flakyTransport struct {
+	files     []bitfog.FileData
+	failAfter int
+	failures  int
+	afters    []string
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	after := req.URL.Query().Get("after")
+	f.afters = append(f.afters, after)
+	buf := &bytes.Buffer{}
+	e := json.NewEncoder(buf)
+	sent := 0
+	for _, fd := range f.files {
+		if fd.Name <= after {
+			continue
+		}
+		if f.failures > 0 && sent == f.failAfter {
+			// Leave half a record behind, like a dropped connection.
+			buf.WriteString(`{"name": "tor`)
+			break
+		}
+		e.Encode(fd)
+		sent++
+	}
+	var body io.Reader = buf
+	if f.failures > 0 {
+		f.failures--
+		body = io.MultiReader(buf, errReader{})
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{listingOrderHeader: {"bytewise"}},
+		Body:       ioutil.NopCloser(body),
+	}, nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func testListing(n int) []bitfog.FileData {
+	var rv []bitfog.FileData
+	for i := 0; i < n; i++ {
+		rv = append(rv, bitfog.FileData{Name: fmt.Sprintf("f%03d", i), Size: int64(i)})
+	}
+	return rv
+}
+
+func checkpointFiles(t *testing.T, cp *checkpoint) []bitfog.FileData {
+	it, err := cp.iter()
+	if err != nil {
+		t.Fatalf("Error reading checkpoint: %v", err)
+	}
+	var rv []bitfog.FileData
+	for it.next() {
+		rv = append(rv, it.file())
+	}
+	if err := it.err(); err != nil {
+		t.Fatalf("Error reading checkpoint: %v", err)
+	}
+	return rv
+}
+
+func TestListingResumes(t *testing.T) {
+	defer func(d int) { *listRetries = d }(*listRetries)
+	*listRetries = 5
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = 0
+
+	ctx := context.Background()
+	ft := &flakyTransport{files: testListing(100), failAfter: 30, failures: 2}
+	c := &bitfogClient{client: &http.Client{Transport: ft}, fs: posixFsOps}
+	path := filepath.Join(t.TempDir(), "test.db.partial")
+
+	cp, err := listWithCheckpoint(ctx, c, "http://whatever/", path)
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	defer cp.remove()
+	if exp := []string{"", "f029", "f059"}; !reflect.DeepEqual(ft.afters, exp) {
+		t.Errorf("Expected requests after %v, got %v", exp, ft.afters)
+	}
+	if got := checkpointFiles(t, cp); !reflect.DeepEqual(got, ft.files) {
+		t.Errorf("Expected complete listing, got %v", got)
+	}
+}
+
+func TestListingResumesLater(t *testing.T) {
+	defer func(d int) { *listRetries = d }(*listRetries)
+	*listRetries = 0
+
+	ctx := context.Background()
+	ft := &flakyTransport{files: testListing(100), failAfter: 40, failures: 1}
+	c := &bitfogClient{client: &http.Client{Transport: ft}, fs: posixFsOps}
+	path := filepath.Join(t.TempDir(), "test.db.partial")
+
+	if _, err := listWithCheckpoint(ctx, c, "http://whatever/", path); err == nil {
+		t.Fatalf("Expected listing to fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected progress to be saved: %v", err)
+	}
+
+	ft.afters = nil
+	cp, err := listWithCheckpoint(ctx, c, "http://whatever/", path)
+	if err != nil {
+		t.Fatalf("Error resuming listing: %v", err)
+	}
+	if exp := []string{"f039"}; !reflect.DeepEqual(ft.afters, exp) {
+		t.Errorf("Expected requests after %v, got %v", exp, ft.afters)
+	}
+	if got := checkpointFiles(t, cp); !reflect.DeepEqual(got, ft.files) {
+		t.Errorf("Expected complete listing, got %v", got)
+	}
+	cp.Close()
+
+	// A different source starts over.
+	cp, err = openCheckpoint(path, "http://elsewhere/")
+	if err != nil {
+		t.Fatalf("Error opening checkpoint: %v", err)
+	}
+	defer cp.remove()
+	if cp.count != 0 {
+		t.Errorf("Expected to start over for another source, got %v", cp.count)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type zstdWriteCloser struct {
+	*zstd.Encoder
+	w io.WriteCloser
+}
+
+func newZstdWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return zstdWriteCloser{enc, w}, nil
+}
+
+func (z zstdWriteCloser) Close() error {
+	if err := z.Encoder.Close(); err != nil {
+		z.w.Close()
+		return err
+	}
+	return z.w.Close()
+}
+
+type zstdReadCloser struct {
+	d *zstd.Decoder
+	r io.Closer
+}
+
+func newZstdReader(r io.ReadCloser) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return zstdReadCloser{d, r}, nil
+}
+
+func (z zstdReadCloser) Read(b []byte) (int, error) {
+	return z.d.Read(b)
+}
+
+func (z zstdReadCloser) Close() error {
+	z.d.Close()
+	return z.r.Close()
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	r io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.r.Close()
+}
+
+// decodeResponse undoes any Content-Encoding the server applied.
+func decodeResponse(resp *http.Response) error {
+	var err error
+	switch resp.Header.Get("Content-Encoding") {
+	case "zstd":
+		resp.Body, err = newZstdReader(resp.Body)
+	case "gzip":
+		var g *gzip.Reader
+		if g, err = gzip.NewReader(resp.Body); err == nil {
+			resp.Body = gzipReadCloser{g, resp.Body}
+		}
+	}
+	if err == nil {
+		resp.Header.Del("Content-Encoding")
+	}
+	return err
+}
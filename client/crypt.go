@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	cryptSegment = 64 * 1024
+	cryptNonce   = 8 // random per-file part of each segment's nonce
+	kdfIter      = 600000
+)
+
+var errWrongKey = errors.New("wrong key for this carry directory")
+
+// keyParams is stored (in the clear) alongside encrypted carry data
+// so the key can be rederived from the same passphrase or key file.
+type keyParams struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	Iter  int    `json:"iter,omitempty"`
+	Check string `json:"check"`
+}
+
+// keySource is whatever the user gave us to derive keys from.
+type keySource struct {
+	passphrase string
+	keyfile    string
+}
+
+func (ks keySource) empty() bool {
+	return ks.passphrase == "" && ks.keyfile == ""
+}
+
+// carryKeys are the keys protecting a carry directory.
+type carryKeys struct {
+	aead    cipher.AEAD
+	nameKey []byte
+}
+
+func newKeyParams(ks keySource) (keyParams, error) {
+	kp := keyParams{KDF: "pbkdf2-sha256", Iter: kdfIter, Salt: make([]byte, 16)}
+	if ks.passphrase == "" {
+		kp.KDF, kp.Iter = "keyfile-hkdf-sha256", 0
+	}
+	_, err := rand.Read(kp.Salt)
+	return kp, err
+}
+
+func deriveKeys(ks keySource, kp *keyParams) (*carryKeys, error) {
+	var master []byte
+	var err error
+	switch kp.KDF {
+	case "pbkdf2-sha256":
+		master, err = pbkdf2.Key(sha256.New, ks.passphrase, kp.Salt, kp.Iter, 32)
+	case "keyfile-hkdf-sha256":
+		var secret []byte
+		secret, err = ioutil.ReadFile(ks.keyfile)
+		if err == nil {
+			master, err = hkdf.Key(sha256.New, secret, kp.Salt, "bitfog master", 32)
+		}
+	default:
+		err = errors.New("unknown kdf: " + kp.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, err := hkdf.Key(sha256.New, master, nil, "bitfog content", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, master, nil, "bitfog names", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &carryKeys{aead: aead, nameKey: nameKey}
+
+	check := k.obscure("check")
+	if kp.Check == "" {
+		kp.Check = check
+	} else if !hmac.Equal([]byte(kp.Check), []byte(check)) {
+		return nil, errWrongKey
+	}
+	return k, nil
+}
+
+// obscure maps a name to one that reveals nothing about it.
+func (k *carryKeys) obscure(name string) string {
+	m := hmac.New(sha256.New, k.nameKey)
+	m.Write([]byte(name))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// seal encrypts a single small record (e.g. a manifest line), tied
+// to ad so it can't be passed off as some other record.
+func (k *carryKeys) seal(b, ad []byte) string {
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(k.aead.Seal(nonce, nonce, b, ad))
+}
+
+func (k *carryKeys) open(s string, ad []byte) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < k.aead.NonceSize() {
+		return nil, errWrongKey
+	}
+	n := k.aead.NonceSize()
+	return k.aead.Open(nil, b[:n], b[n:], ad)
+}
+
+// segmentNonce builds the nonce for a segment of a stream.  The final
+// segment is marked so a stream can't be silently truncated.
+func segmentNonce(prefix []byte, seq uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[cryptNonce:], seq)
+	if last {
+		nonce[cryptNonce-1] ^= 0x80
+	}
+	return nonce
+}
+
+// encWriter encrypts a stream as a sequence of independently
+// authenticated segments.  Every segment is tied to ad (what the
+// stream is), so one stream can't be swapped for another.
+type encWriter struct {
+	k      *carryKeys
+	w      io.WriteCloser
+	ad     []byte
+	prefix []byte
+	seq    uint32
+	buf    []byte
+}
+
+func (k *carryKeys) encrypt(w io.WriteCloser, ad []byte) (io.WriteCloser, error) {
+	prefix := make([]byte, cryptNonce)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	prefix[cryptNonce-1] &^= 0x80
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encWriter{k: k, w: w, ad: ad, prefix: prefix, buf: make([]byte, 0, cryptSegment)}, nil
+}
+
+func (e *encWriter) flush(last bool) error {
+	sealed := e.k.aead.Seal(nil, segmentNonce(e.prefix, e.seq, last), e.buf, e.ad)
+	e.seq++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cryptSegment {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cryptSegment], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encWriter) Close() error {
+	if err := e.flush(true); err != nil {
+		e.w.Close()
+		return err
+	}
+	return e.w.Close()
+}
+
+// decReader reverses encWriter.
+type decReader struct {
+	k      *carryKeys
+	r      io.ReadCloser
+	ad     []byte
+	br     *bufio.Reader
+	prefix []byte
+	seq    uint32
+	seg    []byte
+	out    []byte
+	done   bool
+}
+
+func (k *carryKeys) decrypt(r io.ReadCloser, ad []byte) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, cryptNonce)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decReader{k: k, r: r, ad: ad, br: br, prefix: prefix,
+		seg: make([]byte, cryptSegment+k.aead.Overhead())}, nil
+}
+
+func (d *decReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.br, d.seg)
+		switch err {
+		case nil:
+			// A full segment is the last one if nothing follows it.
+			if _, err := d.br.Peek(1); err == io.EOF {
+				d.done = true
+			} else if err != nil {
+				return 0, err
+			}
+		case io.ErrUnexpectedEOF, io.EOF:
+			d.done = true
+		default:
+			return 0, err
+		}
+		plain, err := d.k.aead.Open(nil, segmentNonce(d.prefix, d.seq, d.done), d.seg[:n], d.ad)
+		if err != nil {
+			return 0, err
+		}
+		d.seq++
+		d.out = plain
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decReader) Close() error {
+	return d.r.Close()
+}
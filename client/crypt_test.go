@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(t *testing.T) (keySource, *carryKeys) {
+	kf := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(kf, []byte("sekrit"), 0600); err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+	ks := keySource{keyfile: kf}
+	kp, err := newKeyParams(ks)
+	if err != nil {
+		t.Fatalf("Error making key params: %v", err)
+	}
+	k, err := deriveKeys(ks, &kp)
+	if err != nil {
+		t.Fatalf("Error deriving keys: %v", err)
+	}
+	if _, err := deriveKeys(ks, &kp); err != nil {
+		t.Errorf("Error rederiving keys: %v", err)
+	}
+	if _, err := deriveKeys(keySource{passphrase: "nope"},
+		&keyParams{KDF: "pbkdf2-sha256", Iter: 1, Salt: kp.Salt, Check: kp.Check}); err != errWrongKey {
+		t.Errorf("Expected wrong key error, got %v", err)
+	}
+	return ks, k
+}
+
+type closeBuffer struct {
+	bytes.Buffer
+}
+
+func (*closeBuffer) Close() error { return nil }
+
+func encryptBytes(t *testing.T, k *carryKeys, b, ad []byte) []byte {
+	buf := &closeBuffer{}
+	w, err := k.encrypt(buf, ad)
+	if err != nil {
+		t.Fatalf("Error starting encryption: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error finishing encryption: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(k *carryKeys, b, ad []byte) ([]byte, error) {
+	r, err := k.decrypt(ioutil.NopCloser(bytes.NewReader(b)), ad)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// checkSegments opens each segment of enc where encWriter should have
+// put it, and checks it holds the right part of plain.  Only sealed
+// segments open, so this also shows nothing was written in the clear.
+func checkSegments(t *testing.T, k *carryKeys, enc, plain, ad []byte) {
+	if len(enc) < cryptNonce {
+		t.Fatalf("size=%v: output too short: %v bytes", len(plain), len(enc))
+	}
+	size := len(plain)
+	prefix, rest := enc[:cryptNonce], enc[cryptNonce:]
+	seg := cryptSegment + k.aead.Overhead()
+	for seq := uint32(0); ; seq++ {
+		n := len(rest)
+		if n > seg {
+			n = seg
+		}
+		last := n == len(rest)
+		want := plain
+		if len(want) > cryptSegment {
+			want = want[:cryptSegment]
+		}
+		got, err := k.aead.Open(nil, segmentNonce(prefix, seq, last), rest[:n], ad)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("size=%v: segment %v at %v doesn't hold the right data: %v",
+				size, seq, len(enc)-len(rest), err)
+			return
+		}
+		// A run as long as a tag can't match by chance.
+		if len(want) >= k.aead.Overhead() && bytes.Equal(rest[:len(want)], want) {
+			t.Errorf("size=%v: segment %v is in the clear", size, seq)
+		}
+		if n != len(want)+k.aead.Overhead() {
+			t.Errorf("size=%v: segment %v is %v bytes, expected %v",
+				size, seq, n, len(want)+k.aead.Overhead())
+		}
+		rest, plain = rest[n:], plain[len(want):]
+		if last {
+			break
+		}
+	}
+	if len(plain) > 0 {
+		t.Errorf("size=%v: %v bytes missing from output", size, len(plain))
+	}
+}
+
+func TestCryptStream(t *testing.T) {
+	_, k := testKeys(t)
+
+	for _, size := range []int{0, 1, cryptSegment - 1, cryptSegment,
+		cryptSegment + 1, 3 * cryptSegment} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		ad := []byte("file:x")
+		enc := encryptBytes(t, k, plain, ad)
+		checkSegments(t, k, enc, plain, ad)
+		got, err := decryptBytes(k, enc, ad)
+		if err != nil {
+			t.Errorf("size=%v: error decrypting: %v", size, err)
+		} else if !bytes.Equal(got, plain) {
+			t.Errorf("size=%v: round trip mangled data", size)
+		}
+
+		// Chopping off whole segments must be noticed.
+		if size > cryptSegment {
+			seg := cryptSegment + k.aead.Overhead()
+			if _, err := decryptBytes(k, enc[:cryptNonce+seg], ad); err == nil {
+				t.Errorf("size=%v: truncation went unnoticed", size)
+			}
+		}
+
+		// Neither can passing it off as something else.
+		if _, err := decryptBytes(k, enc, []byte("file:y")); err == nil {
+			t.Errorf("size=%v: swapped content went unnoticed", size)
+		}
+
+		enc[len(enc)-1] ^= 1
+		if _, err := decryptBytes(k, enc, ad); err == nil {
+			t.Errorf("size=%v: tampering went unnoticed", size)
+		}
+	}
+}
+
+func TestCryptRecords(t *testing.T) {
+	_, k := testKeys(t)
+	sealed := k.seal([]byte("hello"), recordAD(1))
+	got, err := k.open(sealed, recordAD(1))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("Expected hello, got %q/%v", got, err)
+	}
+	if _, err := k.open(sealed, recordAD(2)); err == nil {
+		t.Errorf("Expected error opening a record out of place")
+	}
+	if _, err := k.open("AAAA", nil); err == nil {
+		t.Errorf("Expected error opening garbage")
+	}
+	if k.obscure("a") == k.obscure("b") || k.obscure("a") != k.obscure("a") {
+		t.Errorf("Name obscuring isn't a function")
+	}
+}
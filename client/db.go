@@ -1,58 +1,473 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/dustin/bitfog"
-	"github.com/sethwklein/errutil"
 )
 
+const (
+	dbMagic = "bitfog-db"
+	// Versions 1 through 3 were gob encoded maps.  Version 4 DBs are
+	// tables.
+	dbVersion = 4
+
+	// Version 3 DBs end with dbTrailerMagic and the sha256 of what
+	// precedes it.
+	dbTrailerMagic = "BFDBSUM1"
+	dbTrailerSize  = len(dbTrailerMagic) + sha256.Size
+)
+
+var dbBackup = flag.Bool("dbbackup", false,
+	"keep the previous generation of a DB as dbname.bak")
+
+var errDbChecksum = errors.New("DB checksum mismatch")
+
+// dbHeader describes where a DB came from.  It precedes the files in
+// the DB file.  Fields may be added, but never removed or changed.
+type dbHeader struct {
+	Magic     string
+	Version   int
+	Source    string
+	Created   int64
+	HashAlgo  string
+	Checksums bool
+}
+
+// A db is a table on disk, plus any changes made since it was read.
+// Changes are kept in memory until there are too many, and then
+// spilled to temporary tables.  Reads merge all of these, newest
+// first.
 type db struct {
 	path    string
 	changed bool
+	// A scratch DB is never written out.
+	scratch bool
 
-	files map[string]bitfog.FileData
+	header  dbHeader
+	table   *table
+	runs    []*table
+	pending map[string]*bitfog.FileData
 }
 
+// Changes held in memory before spilling to disk.
+var dbSpill = 100000
+
 func (d *db) AddFile(name string, fd bitfog.FileData) error {
-	d.files[name] = fd
+	d.pending[name] = &fd
 	d.changed = true
-	return nil
+	return d.maybeSpill()
 }
 
 func (d *db) RmFile(name string) error {
-	delete(d.files, name)
+	d.pending[name] = nil
 	d.changed = true
+	return d.maybeSpill()
+}
+
+func (d *db) maybeSpill() error {
+	if len(d.pending) < dbSpill {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(d.path), ".bitfog-run.")
+	if err != nil {
+		return err
+	}
+	// Where possible, the run goes away with the process, even if
+	// it's never closed.  Otherwise, release removes it.
+	os.Remove(f.Name())
+	t, err := d.writeTable(f, newPendingIter(d.pending, ""))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	d.runs = append(d.runs, t)
+	d.pending = map[string]*bitfog.FileData{}
 	return nil
 }
 
-func (d *db) Close() (err error) {
-	if !d.changed {
+// appendSorted adds files from an iterator that's already in order
+// without holding them in memory.
+func (d *db) appendSorted(it fileIter) error {
+	f, err := ioutil.TempFile(filepath.Dir(d.path), ".bitfog-run.")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	tw, err := newTableWriter(f, d.header)
+	if err == nil {
+		for it.next() {
+			if err = tw.addFile(it.file()); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = it.err()
+	}
+	if err == nil {
+		err = tw.finish()
+	}
+	var t *table
+	if err == nil {
+		t, err = openTable(f)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	d.runs = append(d.runs, t)
+	d.changed = true
+	return nil
+}
+
+// writeTable writes everything from it to f as a table, and opens it
+// for reading.
+func (d *db) writeTable(f *os.File, it recIter) (*table, error) {
+	tw, err := newTableWriter(f, d.header)
+	if err != nil {
+		return nil, err
+	}
+	for it.next() {
+		if err := tw.add(it.name(), it.val()); err != nil {
+			return nil, err
+		}
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	if err := tw.finish(); err != nil {
+		return nil, err
+	}
+	return openTable(f)
+}
+
+func (d *db) sources(from string) []recIter {
+	var rv []recIter
+	if d.table != nil {
+		rv = append(rv, d.table.iter(from))
+	}
+	for _, t := range d.runs {
+		rv = append(rv, t.iter(from))
+	}
+	return append(rv, newPendingIter(d.pending, from))
+}
+
+// iter walks the files whose names start with prefix, in order.
+func (d *db) iter(prefix string) fileIter {
+	return &recFileIter{it: newMergeIter(d.sources(prefix)...), prefix: prefix}
+}
+
+// get looks up a single file.
+func (d *db) get(name string) (bitfog.FileData, bool, error) {
+	if fd, ok := d.pending[name]; ok {
+		if fd == nil {
+			return bitfog.FileData{}, false, nil
+		}
+		rv := *fd
+		rv.Name = name
+		return rv, true, nil
+	}
+	tables := append([]*table{d.table}, d.runs...)
+	for i := len(tables) - 1; i >= 0; i-- {
+		if tables[i] == nil {
+			continue
+		}
+		val, ok, err := tables[i].get(name)
+		if err != nil {
+			return bitfog.FileData{}, false, err
+		}
+		if !ok {
+			continue
+		}
+		if len(val) == 0 {
+			return bitfog.FileData{}, false, nil
+		}
+		var fd bitfog.FileData
+		err = json.Unmarshal(val, &fd)
+		fd.Name = name
+		return fd, err == nil, err
+	}
+	return bitfog.FileData{}, false, nil
+}
+
+// count returns the number of files in the DB.
+func (d *db) count() (int, error) {
+	if d.table != nil && len(d.runs) == 0 && len(d.pending) == 0 {
+		return d.table.count, nil
+	}
+	n := 0
+	it := d.iter("")
+	for it.next() {
+		n++
+	}
+	return n, it.err()
+}
+
+// release closes and removes everything but the table itself.
+func (d *db) release() {
+	for _, t := range d.runs {
+		t.Close()
+		os.Remove(t.f.Name())
+	}
+	d.runs = nil
+	if d.table != nil {
+		d.table.Close()
+		d.table = nil
+	}
+}
+
+// Close writes the DB out if it's changed.  The new DB is written
+// beside the old one and renamed over it once it's safely on disk, so
+// a crash leaves one or the other intact.
+func (d *db) Close() error {
+	defer d.release()
+	if !d.changed || d.scratch {
 		return nil
 	}
 
-	f, err := os.Create(d.path)
+	f, err := ioutil.TempFile(filepath.Dir(d.path), "."+filepath.Base(d.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(d.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	d.header.Magic, d.header.Version = dbMagic, dbVersion
+	_, err = d.writeTable(f, newMergeIter(d.sources("")...))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return err
 	}
-	defer errutil.AppendCall(&err, f.Close)
-	return gob.NewEncoder(f).Encode(d.files)
+
+	if *dbBackup {
+		bak := d.path + ".bak"
+		if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(d.path, bak); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.Name(), d.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(d.path))
+	d.changed = false
+	return nil
+}
+
+// syncDir makes a rename within dir durable.  Not every platform can
+// do this, so it's best effort.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
 }
 
-func newDb(path string) (db, error) {
-	return db{path: path,
+func newDb(path string) (*db, error) {
+	return &db{path: path,
 		changed: true,
-		files:   make(map[string]bitfog.FileData),
+		header: dbHeader{
+			Magic:    dbMagic,
+			Version:  dbVersion,
+			Created:  time.Now().Unix(),
+			HashAlgo: bitfog.HashAlgorithm,
+		},
+		pending: map[string]*bitfog.FileData{},
 	}, nil
 }
 
-func openDb(path string) (db, error) {
-	rv := db{path: path, files: make(map[string]bitfog.FileData)}
+func openDb(path string) (*db, error) {
+	rv := &db{path: path, pending: map[string]*bitfog.FileData{}}
 	f, err := os.Open(path)
 	if err != nil {
 		return rv, err
 	}
-	defer f.Close()
-	return rv, gob.NewDecoder(f).Decode(&rv.files)
+
+	rv.table, err = openTable(f)
+	if err == errNotTable {
+		defer f.Close()
+		err = openGobDb(rv, f)
+	} else if err != nil {
+		f.Close()
+	} else {
+		rv.header = rv.table.header
+	}
+	if err != nil {
+		if _, serr := os.Stat(path + ".bak"); serr == nil {
+			err = fmt.Errorf("%v (the previous version is in %v.bak)", err, path)
+		}
+		return rv, err
+	}
+	if rv.header.Version > dbVersion {
+		log.Printf("%v is from a newer version of bitfog (v%d), reading anyway",
+			path, rv.header.Version)
+	}
+	return rv, nil
+}
+
+// openGobDb reads an older DB, which is a gob encoded map, preceded by
+// a header since version 2, and followed by a checksum since version
+// 3.  It's read entirely into memory, and rewritten as a table the
+// next time it's changed.
+func openGobDb(d *db, f *os.File) error {
+	size, trailed, err := checkDbTrailer(f)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]bitfog.FileData{}
+	dec := gob.NewDecoder(bufio.NewReader(io.NewSectionReader(f, 0, size)))
+	if err := dec.Decode(&d.header); err != nil || d.header.Magic != dbMagic {
+		// Version 1 has no header.
+		dec = gob.NewDecoder(bufio.NewReader(io.NewSectionReader(f, 0, size)))
+		d.header = dbHeader{Magic: dbMagic, Version: 1, HashAlgo: bitfog.HashAlgorithm}
+	} else if d.header.Version >= 3 && !trailed {
+		return fmt.Errorf("%v is missing its checksum; it may be truncated", f.Name())
+	}
+	if err := dec.Decode(&files); err != nil {
+		return err
+	}
+	for k, fd := range files {
+		fd := fd
+		d.pending[k] = &fd
+	}
+	if d.header.Version == 1 {
+		d.header.Checksums, _ = checksumState(d.iter(""))
+	}
+	return nil
+}
+
+// checkDbTrailer verifies the checksum at the end of a DB, if there
+// is one, and returns the size of what precedes it.
+func checkDbTrailer(f *os.File) (size int64, trailed bool, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size = fi.Size() - int64(dbTrailerSize)
+	if size < 0 {
+		return fi.Size(), false, nil
+	}
+	trailer := make([]byte, dbTrailerSize)
+	if _, err := f.ReadAt(trailer, size); err != nil {
+		return 0, false, err
+	}
+	if string(trailer[:len(dbTrailerMagic)]) != dbTrailerMagic {
+		return fi.Size(), false, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return 0, false, err
+	}
+	if !bytes.Equal(h.Sum(nil), trailer[len(dbTrailerMagic):]) {
+		return 0, false, fmt.Errorf("%v: %v", f.Name(), errDbChecksum)
+	}
+	return size, true, nil
+}
+
+// checksumState reports whether a listing looks like it was made with
+// checksums turned on, judging by its first non-empty file.  Without
+// any, there's no way to tell, and known is false.
+func checksumState(it fileIter) (checksums, known bool) {
+	for it.next() {
+		if fd := it.file(); fd.Dest == "" && fd.Size > 0 {
+			return fd.Hash != 0, true
+		}
+	}
+	return false, false
+}
+
+// fetchListing reads a server's listing into a scratch DB, so it can
+// be compared with other DBs without holding it in memory.
+func fetchListing(ctx context.Context, c *bitfogClient, u string) (*db, error) {
+	d, err := newDb(filepath.Join(os.TempDir(), "bitfog-listing"))
+	if err != nil {
+		return nil, err
+	}
+	d.scratch = true
+	d.header.Source = u
+
+	l, err := c.openListing(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	if err := d.addListing(l); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// addListing adds everything in a listing to the DB.  A sorted
+// listing is written straight to disk as it arrives.
+func (d *db) addListing(l *listing) error {
+	var err error
+	if l.sorted {
+		err = d.appendSorted(l)
+	} else {
+		for l.next() {
+			if err = d.AddFile(l.file().Name, l.file()); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = l.err()
+	}
+	if err == nil {
+		d.header.Checksums, _ = checksumState(d.iter(""))
+	}
+	return err
+}
+
+// warnHashMismatch complains if two DBs can't be meaningfully
+// compared because they were made with different hash settings.
+// FileData.Equals compares hashes, so every file would appear to
+// have changed.
+func warnHashMismatch(aname string, a *db, bname string, b *db) {
+	if a.header.HashAlgo != b.header.HashAlgo {
+		log.Printf("Warning: %v uses %v hashes, but %v uses %v",
+			aname, a.header.HashAlgo, bname, b.header.HashAlgo)
+	}
+	if *hashOnDemand {
+		// Whatever needs a hash to be compared will get one.
+		return
+	}
+	ac, aknown := checksumState(a.iter(""))
+	bc, bknown := checksumState(b.iter(""))
+	if aknown && bknown && ac != bc {
+		log.Printf("Warning: %v was made with checksums=%v, but %v with checksums=%v; "+
+			"files will compare as changed", aname, ac, bname, bc)
+	}
 }
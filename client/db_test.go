@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/dustin/bitfog"
@@ -9,6 +16,26 @@ import (
 
 const testDbName = ",test.db"
 
+func dbCount(t *testing.T, d *db) int {
+	n, err := d.count()
+	if err != nil {
+		t.Fatalf("Error counting %v: %v", d.path, err)
+	}
+	return n
+}
+
+// memDb makes a DB out of a map of files.
+func memDb(t *testing.T, files map[string]bitfog.FileData) *db {
+	d, err := newDb(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Error creating db: %v", err)
+	}
+	for k, fd := range files {
+		d.AddFile(k, fd)
+	}
+	return d
+}
+
 func TestDBSimple(t *testing.T) {
 	defer os.Remove(testDbName)
 	db, err := newDb(testDbName)
@@ -52,8 +79,266 @@ func TestDBSimple(t *testing.T) {
 	if db.changed {
 		t.Errorf("Newly open DB is marked as changed")
 	}
-	if len(db.files) != 1 {
-		t.Errorf("Expected state to have one file, has %v", db.files)
+	if dbCount(t, db) != 1 {
+		t.Errorf("Expected state to have one file, has %v", dbCount(t, db))
+	}
+	if db.header.Version != dbVersion || db.header.HashAlgo != bitfog.HashAlgorithm {
+		t.Errorf("Expected current header, got %+v", db.header)
+	}
+}
+
+func TestDBHeader(t *testing.T) {
+	defer os.Remove(testDbName)
+	db, err := newDb(testDbName)
+	if err != nil {
+		t.Fatalf("Error getting test db: %v", err)
+	}
+	db.header.Source = "http://server/area/"
+	db.header.Checksums = true
+	db.AddFile("a", bitfog.FileData{Name: "a", Size: 1, Mode: 0644, Hash: 1})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing db: %v", err)
+	}
+
+	got, err := openDb(testDbName)
+	if err != nil {
+		t.Fatalf("Error reopening db: %v", err)
+	}
+	if got.header != db.header {
+		t.Errorf("Expected header %+v, got %+v", db.header, got.header)
+	}
+	if dbCount(t, got) != 1 {
+		t.Errorf("Expected one file, got %v", dbCount(t, got))
+	}
+}
+
+func TestDBLegacy(t *testing.T) {
+	defer os.Remove(testDbName)
+	f, err := os.Create(testDbName)
+	if err != nil {
+		t.Fatalf("Error creating legacy db: %v", err)
+	}
+	err = gob.NewEncoder(f).Encode(map[string]bitfog.FileData{
+		"a": {Name: "a", Size: 10, Mode: 0644},
+		"b": {Name: "b", Size: 0, Mode: 0644},
+	})
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error writing legacy db: %v", err)
+	}
+
+	db, err := openDb(testDbName)
+	if err != nil {
+		t.Fatalf("Error opening legacy db: %v", err)
+	}
+	if dbCount(t, db) != 2 {
+		t.Errorf("Expected two files, got %v", dbCount(t, db))
+	}
+	if db.header.Version != 1 || db.header.Checksums {
+		t.Errorf("Expected v1 without checksums, got %+v", db.header)
+	}
+
+	// Changing it rewrites it in the current format.
+	db.RmFile("b")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing db: %v", err)
+	}
+	db, err = openDb(testDbName)
+	if err != nil {
+		t.Fatalf("Error reopening db: %v", err)
+	}
+	if dbCount(t, db) != 1 || db.header.Magic != dbMagic {
+		t.Errorf("Expected migrated db, got %+v", db)
+	}
+}
+
+func TestChecksumState(t *testing.T) {
+	tests := []struct {
+		files            map[string]bitfog.FileData
+		checksums, known bool
+	}{
+		{nil, false, false},
+		{map[string]bitfog.FileData{"e": {Size: 0}}, false, false},
+		{map[string]bitfog.FileData{"l": {Size: 3, Dest: "foo"}}, false, false},
+		{map[string]bitfog.FileData{"a": {Size: 3}}, false, true},
+		{map[string]bitfog.FileData{"a": {Size: 3, Hash: 7}, "b": {Size: 3}}, true, true},
+	}
+	for _, test := range tests {
+		c, k := checksumState(mapIter(test.files))
+		if c != test.checksums || k != test.known {
+			t.Errorf("%v: expected %v/%v, got %v/%v",
+				test.files, test.checksums, test.known, c, k)
+		}
+	}
+}
+
+func TestDBCorruption(t *testing.T) {
+	defer func(b bool) { *dbBackup = b }(*dbBackup)
+	*dbBackup = true
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	for i := 0; i < 2; i++ {
+		db, err := newDb(path)
+		if err != nil {
+			t.Fatalf("Error getting test db: %v", err)
+		}
+		for _, n := range []string{"a", "b"}[:i+1] {
+			db.AddFile(n, bitfog.FileData{Name: n, Size: 1, Mode: 0644})
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Error closing db: %v", err)
+		}
+	}
+
+	bak, err := openDb(path + ".bak")
+	if err != nil {
+		t.Fatalf("Error opening backup: %v", err)
+	}
+	if dbCount(t, bak) != 1 {
+		t.Errorf("Expected backup to be the previous generation, got %v", dbCount(t, bak))
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading db: %v", err)
+	}
+	// Damage anywhere is noticed, either opening the DB or reading
+	// the damaged part.
+	readAll := func() error {
+		db, err := openDb(path)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		it := db.iter("")
+		for it.next() {
+		}
+		return it.err()
+	}
+	for i := range b {
+		flipped := append([]byte{}, b...)
+		flipped[i] ^= 0x10
+		ioutil.WriteFile(path, flipped, 0666)
+		if err := readAll(); err == nil {
+			t.Errorf("Expected error reading db corrupted at %v", i)
+		}
+	}
+
+	ioutil.WriteFile(path, b[:len(b)-1], 0666)
+	if _, err := openDb(path); err == nil {
+		t.Errorf("Expected error opening truncated db")
+	}
+
+	ioutil.WriteFile(path, b, 0666)
+	db, err := openDb(path)
+	if err != nil {
+		t.Fatalf("Error opening intact db: %v", err)
 	}
+	if dbCount(t, db) != 2 {
+		t.Errorf("Expected two files, got %v", dbCount(t, db))
+	}
+}
+
+func TestDBLarge(t *testing.T) {
+	defer func(n int) { dbSpill = n }(dbSpill)
+	dbSpill = 100
 
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := newDb(path)
+	if err != nil {
+		t.Fatalf("Error creating db: %v", err)
+	}
+	exp := map[string]bitfog.FileData{}
+	rng := rand.New(rand.NewSource(8675309))
+	for i := 0; i < 5000; i++ {
+		name := fmt.Sprintf("d%d/f%d", rng.Intn(10), rng.Intn(2000))
+		if i%7 == 0 {
+			delete(exp, name)
+			db.RmFile(name)
+			continue
+		}
+		fd := bitfog.FileData{Name: name, Size: int64(i), Mode: 0644, Hash: uint64(i)}
+		exp[name] = fd
+		db.AddFile(name, fd)
+	}
+
+	check := func(what string) {
+		got := map[string]bitfog.FileData{}
+		prev := ""
+		it := db.iter("")
+		for it.next() {
+			fd := it.file()
+			if fd.Name <= prev {
+				t.Fatalf("%v: %q came after %q", what, fd.Name, prev)
+			}
+			prev = fd.Name
+			got[fd.Name] = fd
+		}
+		if err := it.err(); err != nil {
+			t.Fatalf("%v: error iterating: %v", what, err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%v: expected %v files, got %v", what, len(exp), len(got))
+		}
+		for _, name := range []string{"d3/f17", "d5/f1999", "nope"} {
+			fd, ok, err := db.get(name)
+			if err != nil || ok != (exp[name] != bitfog.FileData{}) || fd != exp[name] {
+				t.Errorf("%v: get %v = %v/%v/%v, expected %v", what, name, fd, ok, err, exp[name])
+			}
+		}
+		n := 0
+		it = db.iter("d4/")
+		for it.next() {
+			n++
+		}
+		expn := 0
+		for k := range exp {
+			if strings.HasPrefix(k, "d4/") {
+				expn++
+			}
+		}
+		if n != expn {
+			t.Errorf("%v: expected %v files in d4/, got %v", what, expn, n)
+		}
+	}
+
+	check("spilled")
+	if len(db.runs) == 0 {
+		t.Errorf("Expected changes to be spilled to disk")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing db: %v", err)
+	}
+
+	db, err = openDb(path)
+	if err != nil {
+		t.Fatalf("Error reopening db: %v", err)
+	}
+	if len(db.table.index) < 2 {
+		t.Errorf("Expected several blocks, got %v", len(db.table.index))
+	}
+	check("reopened")
+	if dbCount(t, db) != len(exp) {
+		t.Errorf("Expected %v files, got %v", len(exp), dbCount(t, db))
+	}
+
+	for k := range exp {
+		if strings.HasPrefix(k, "d3/") {
+			delete(exp, k)
+			db.RmFile(k)
+		}
+	}
+	fd := bitfog.FileData{Name: "d3/f17", Size: 17}
+	exp[fd.Name] = fd
+	db.AddFile(fd.Name, fd)
+	check("changed")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing db: %v", err)
+	}
+	db, err = openDb(path)
+	if err != nil {
+		t.Fatalf("Error reopening db: %v", err)
+	}
+	check("rewritten")
+	db.Close()
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+var jsonOutput = flag.Bool("json", false, "db: produce JSON output")
+
+// dbList calls fn for every file in a DB whose name starts with
+// prefix, in order.
+func dbList(d *db, prefix string, fn func(bitfog.FileData)) error {
+	it := d.iter(prefix)
+	for it.next() {
+		fn(it.file())
+	}
+	return it.err()
+}
+
+type dbDiff struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// diffDbs describes what it would take to turn a into b.
+func diffDbs(a, b *db, cmp comparison) (dbDiff, error) {
+	c, err := changedFiles(b.iter(""), a.iter(""), cmp)
+	if err != nil {
+		return dbDiff{}, err
+	}
+	rv := dbDiff{Added: []string{}, Changed: []string{}, Updated: []string{},
+		Removed: append([]string{}, c.remove...)}
+	for _, fd := range c.update {
+		rv.Updated = append(rv.Updated, fd.Name)
+	}
+	for _, fd := range c.add {
+		_, ok, err := a.get(fd.Name)
+		if err != nil {
+			return rv, err
+		}
+		if ok {
+			rv.Changed = append(rv.Changed, fd.Name)
+		} else {
+			rv.Added = append(rv.Added, fd.Name)
+		}
+	}
+	return rv, nil
+}
+
+type dirUsage struct {
+	Dir   string `json:"dir"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// diskUsage rolls file sizes up into every directory containing
+// them.  The top level is ".".  Directories themselves aren't files,
+// so only count what's in them.
+func diskUsage(d *db) ([]dirUsage, error) {
+	m := map[string]*dirUsage{}
+	it := d.iter("")
+	for it.next() {
+		fd := it.file()
+		if fd.IsDir() {
+			continue
+		}
+		dir := fd.Name
+		for dir != "." && dir != "/" {
+			dir = path.Dir(dir)
+			du, ok := m[dir]
+			if !ok {
+				du = &dirUsage{Dir: dir}
+				m[dir] = du
+			}
+			du.Files++
+			du.Size += fd.Size
+		}
+	}
+	rv := make([]dirUsage, 0, len(m))
+	for _, du := range m {
+		rv = append(rv, *du)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Dir < rv[j].Dir })
+	return rv, it.err()
+}
+
+func describeFile(fd bitfog.FileData) string {
+	s := fmt.Sprintf("%v %12d %s %s", os.FileMode(fd.Mode), fd.Size,
+		time.Unix(fd.Mtime, 0).UTC().Format(time.RFC3339), fd.Name)
+	if fd.Dest != "" {
+		s += " -> " + fd.Dest
+	}
+	return s
+}
+
+func openDbOrDie(p string) *db {
+	d, err := openDb(p)
+	if err != nil {
+		log.Fatalf("Error reading DB %v:  %v", p, err)
+	}
+	return d
+}
+
+func dbCommand() {
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	e := json.NewEncoder(os.Stdout)
+
+	switch flag.Arg(1) {
+	default:
+		flag.Usage()
+		os.Exit(1)
+	case "info":
+		d := openDbOrDie(flag.Arg(2))
+		if *jsonOutput {
+			e.Encode(d.header)
+			return
+		}
+		fmt.Printf("Version:   %d\n", d.header.Version)
+		fmt.Printf("Source:    %s\n", d.header.Source)
+		if d.header.Created != 0 {
+			fmt.Printf("Created:   %v\n",
+				time.Unix(d.header.Created, 0).UTC().Format(time.RFC3339))
+		}
+		fmt.Printf("Hash:      %s\n", d.header.HashAlgo)
+		fmt.Printf("Checksums: %v\n", d.header.Checksums)
+		n, err := d.count()
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", flag.Arg(2), err)
+		}
+		fmt.Printf("Files:     %d\n", n)
+	case "ls":
+		d := openDbOrDie(flag.Arg(2))
+		err := dbList(d, flag.Arg(3), func(fd bitfog.FileData) {
+			if *jsonOutput {
+				e.Encode(fd)
+			} else {
+				fmt.Println(describeFile(fd))
+			}
+		})
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", flag.Arg(2), err)
+		}
+	case "stat":
+		if flag.NArg() < 4 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		d := openDbOrDie(flag.Arg(2))
+		fd, ok, err := d.get(flag.Arg(3))
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", flag.Arg(2), err)
+		}
+		if !ok {
+			log.Fatalf("%v is not in %v", flag.Arg(3), flag.Arg(2))
+		}
+		if *jsonOutput {
+			e.Encode(fd)
+			return
+		}
+		fmt.Printf("Name:  %s\n", fd.Name)
+		fmt.Printf("Size:  %d\n", fd.Size)
+		fmt.Printf("Mode:  %v\n", os.FileMode(fd.Mode))
+		fmt.Printf("Mtime: %v\n", time.Unix(fd.Mtime, 0).UTC().Format(time.RFC3339))
+		fmt.Printf("Hash:  %x\n", fd.Hash)
+		if fd.Dest != "" {
+			fmt.Printf("Link:  %s\n", fd.Dest)
+		}
+		if fd.Meta != nil {
+			fmt.Printf("Owner: %d:%d\n", fd.Meta.Uid, fd.Meta.Gid)
+			var names []string
+			for name := range fd.Meta.Xattrs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Printf("Xattr: %s=%q\n", name, fd.Meta.Xattrs[name])
+			}
+		}
+	case "diff":
+		if flag.NArg() < 4 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		a, b := openDbOrDie(flag.Arg(2)), openDbOrDie(flag.Arg(3))
+		warnHashMismatch(flag.Arg(2), a, flag.Arg(3), b)
+		cmp, err := cliComparison()
+		if err != nil {
+			log.Fatalf("Error choosing comparison: %v", err)
+		}
+		diff, err := diffDbs(a, b, cmp)
+		if err != nil {
+			log.Fatalf("Error comparing DBs: %v", err)
+		}
+		if *jsonOutput {
+			e.Encode(diff)
+			return
+		}
+		for _, k := range diff.Added {
+			fmt.Printf("+ %s\n", k)
+		}
+		for _, k := range diff.Changed {
+			fmt.Printf("~ %s\n", k)
+		}
+		for _, k := range diff.Updated {
+			fmt.Printf("* %s\n", k)
+		}
+		for _, k := range diff.Removed {
+			fmt.Printf("- %s\n", k)
+		}
+	case "du":
+		d := openDbOrDie(flag.Arg(2))
+		usage, err := diskUsage(d)
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", flag.Arg(2), err)
+		}
+		for _, du := range usage {
+			if *jsonOutput {
+				e.Encode(du)
+			} else {
+				fmt.Printf("%14d %8d %s\n", du.Size, du.Files, du.Dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestDbList(t *testing.T) {
+	files := map[string]bitfog.FileData{
+		"b/x": {Size: 1},
+		"a":   {Size: 2},
+		"b/y": {Size: 3},
+	}
+	list := func(prefix string) []string {
+		var rv []string
+		err := dbList(memDb(t, files), prefix, func(fd bitfog.FileData) {
+			rv = append(rv, fd.Name)
+		})
+		if err != nil {
+			t.Fatalf("Error listing: %v", err)
+		}
+		return rv
+	}
+	if got, exp := list("b/"), []string{"b/x", "b/y"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	if got, exp := list(""), []string{"a", "b/x", "b/y"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected everything sorted, got %v", got)
+	}
+}
+
+func TestDiffDbs(t *testing.T) {
+	a := map[string]bitfog.FileData{
+		"same":    {Size: 1, Hash: 1},
+		"changed": {Size: 1, Hash: 1},
+		"removed": {Size: 1},
+	}
+	b := map[string]bitfog.FileData{
+		"same":    {Size: 1, Hash: 1},
+		"changed": {Size: 2, Hash: 1},
+		"added":   {Size: 1},
+	}
+	exp := dbDiff{
+		Added:   []string{"added"},
+		Changed: []string{"changed"},
+		Updated: []string{},
+		Removed: []string{"removed"},
+	}
+	if got, err := diffDbs(memDb(t, a), memDb(t, b), comparison{}); err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %+v, got %+v", exp, got)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	mode := os.ModeDir | 0755
+	dir := int32(mode)
+	files := map[string]bitfog.FileData{
+		"a":       {Size: 1},
+		"d/":      {Mode: dir},
+		"d/b":     {Size: 2},
+		"d/e/":    {Mode: dir},
+		"d/e/c":   {Size: 4},
+		"empty/":  {Mode: dir},
+		"f/g/h/i": {Size: 8},
+	}
+	exp := []dirUsage{
+		{".", 4, 15},
+		{"d", 2, 6},
+		{"d/e", 1, 4},
+		{"f", 1, 8},
+		{"f/g", 1, 8},
+		{"f/g/h", 1, 8},
+	}
+	if got, err := diskUsage(memDb(t, files)); err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/bitfog"
+)
+
+// A table is a file of records sorted by name, written once and then
+// read in place, so a DB never needs to fit in memory.  It's laid out
+// as:
+//
+//	tableMagic
+//	uvarint length, JSON dbHeader, crc32 of the header
+//	blocks of records, each followed by its crc32
+//	an index of the first name and location of every block
+//	the footer: index offset, index length and record count (uint64
+//	each), the crc32 of the index and all that, and tableEndMagic
+//
+// A record is a uvarint length and name, then a uvarint length and
+// JSON FileData.  An empty FileData marks a deletion.
+const (
+	tableMagic      = "BFDBTBL1"
+	tableEndMagic   = "BFDBEND1"
+	tableBlockSize  = 64 * 1024
+	tableFooterSize = 8 + 8 + 8 + 4 + len(tableEndMagic)
+)
+
+var errNotTable = errors.New("not a DB table")
+
+type tableIndexEntry struct {
+	name   string
+	off    int64
+	length int64
+}
+
+// tableWriter writes a table.  Records must be added in order.
+type tableWriter struct {
+	w     *bufio.Writer
+	off   int64
+	block []byte
+	first string
+	last  string
+	index []tableIndexEntry
+	count uint64
+}
+
+func newTableWriter(w io.Writer, hdr dbHeader) (*tableWriter, error) {
+	h, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+	tw := &tableWriter{w: bufio.NewWriter(w)}
+	buf := append([]byte(tableMagic), uvarint(uint64(len(h)))...)
+	buf = append(buf, h...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(h))
+	tw.write(buf)
+	return tw, nil
+}
+
+func uvarint(x uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, x)]
+}
+
+func (tw *tableWriter) write(b []byte) {
+	tw.w.Write(b)
+	tw.off += int64(len(b))
+}
+
+// add appends a record.  A nil value records a deletion.
+func (tw *tableWriter) add(name string, val []byte) error {
+	if tw.count > 0 && name <= tw.last {
+		return fmt.Errorf("DB records out of order: %q after %q", name, tw.last)
+	}
+	if len(tw.block) >= tableBlockSize {
+		tw.flushBlock()
+	}
+	if len(tw.block) == 0 {
+		tw.first = name
+	}
+	tw.block = append(tw.block, uvarint(uint64(len(name)))...)
+	tw.block = append(tw.block, name...)
+	tw.block = append(tw.block, uvarint(uint64(len(val)))...)
+	tw.block = append(tw.block, val...)
+	tw.last = name
+	tw.count++
+	return nil
+}
+
+func (tw *tableWriter) addFile(fd bitfog.FileData) error {
+	name := fd.Name
+	fd.Name = ""
+	val, err := json.Marshal(fd)
+	if err != nil {
+		return err
+	}
+	return tw.add(name, val)
+}
+
+func (tw *tableWriter) flushBlock() {
+	tw.index = append(tw.index, tableIndexEntry{tw.first, tw.off, int64(len(tw.block))})
+	tw.write(tw.block)
+	tw.write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(tw.block)))
+	tw.block = tw.block[:0]
+}
+
+// finish writes the index and footer.  The caller is responsible for
+// syncing and closing the underlying file.
+func (tw *tableWriter) finish() error {
+	if len(tw.block) > 0 {
+		tw.flushBlock()
+	}
+	var idx []byte
+	for _, e := range tw.index {
+		idx = append(idx, uvarint(uint64(len(e.name)))...)
+		idx = append(idx, e.name...)
+		idx = append(idx, uvarint(uint64(e.off))...)
+		idx = append(idx, uvarint(uint64(e.length))...)
+	}
+	footer := binary.BigEndian.AppendUint64(nil, uint64(tw.off))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(idx)))
+	footer = binary.BigEndian.AppendUint64(footer, tw.count)
+	footer = binary.BigEndian.AppendUint32(footer,
+		crc32.Update(crc32.ChecksumIEEE(idx), crc32.IEEETable, footer))
+	footer = append(footer, tableEndMagic...)
+	tw.write(idx)
+	tw.write(footer)
+	return tw.w.Flush()
+}
+
+// table reads a table written by tableWriter.  Only the index is kept
+// in memory.
+type table struct {
+	f      *os.File
+	header dbHeader
+	index  []tableIndexEntry
+	count  int
+}
+
+// openTable reads the header and index of a table, returning
+// errNotTable if f isn't one at all.
+func openTable(f *os.File) (*table, error) {
+	magic := make([]byte, len(tableMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil || string(magic) != tableMagic {
+		return nil, errNotTable
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	footer := make([]byte, tableFooterSize)
+	if fi.Size() < int64(len(tableMagic)+tableFooterSize) {
+		return nil, fmt.Errorf("%v is truncated", f.Name())
+	}
+	if _, err := f.ReadAt(footer, fi.Size()-int64(tableFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[28:]) != tableEndMagic {
+		return nil, fmt.Errorf("%v is truncated", f.Name())
+	}
+	idxOff := int64(binary.BigEndian.Uint64(footer))
+	idxLen := int64(binary.BigEndian.Uint64(footer[8:]))
+	t := &table{f: f, count: int(binary.BigEndian.Uint64(footer[16:]))}
+	if idxOff < 0 || idxLen < 0 || idxOff+idxLen > fi.Size()-int64(tableFooterSize) {
+		return nil, fmt.Errorf("%v: %v", f.Name(), errDbChecksum)
+	}
+
+	idx := make([]byte, idxLen)
+	if _, err := f.ReadAt(idx, idxOff); err != nil {
+		return nil, err
+	}
+	sum := crc32.Update(crc32.ChecksumIEEE(idx), crc32.IEEETable, footer[:24])
+	if sum != binary.BigEndian.Uint32(footer[24:]) {
+		return nil, fmt.Errorf("%v: %v", f.Name(), errDbChecksum)
+	}
+	for len(idx) > 0 {
+		var e tableIndexEntry
+		var off, length uint64
+		if e.name, idx, err = readField(idx); err == nil {
+			if off, idx, err = readUvarint(idx); err == nil {
+				length, idx, err = readUvarint(idx)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", f.Name(), err)
+		}
+		e.off, e.length = int64(off), int64(length)
+		t.index = append(t.index, e)
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(f, int64(len(tableMagic)), idxOff))
+	hlen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, hlen+4)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(h[:hlen]) != binary.BigEndian.Uint32(h[hlen:]) {
+		return nil, fmt.Errorf("%v: %v", f.Name(), errDbChecksum)
+	}
+	return t, json.Unmarshal(h[:hlen], &t.header)
+}
+
+var errCorruptRecord = errors.New("corrupt DB record")
+
+func readUvarint(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errCorruptRecord
+	}
+	return x, b[n:], nil
+}
+
+func readField(b []byte) (string, []byte, error) {
+	l, b, err := readUvarint(b)
+	if err != nil || uint64(len(b)) < l {
+		return "", nil, errCorruptRecord
+	}
+	return string(b[:l]), b[l:], nil
+}
+
+func (t *table) readBlock(i int) ([]byte, error) {
+	e := t.index[i]
+	b := make([]byte, e.length+4)
+	if _, err := t.f.ReadAt(b, e.off); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(b[:e.length]) != binary.BigEndian.Uint32(b[e.length:]) {
+		return nil, fmt.Errorf("%v: %v", t.f.Name(), errDbChecksum)
+	}
+	return b[:e.length], nil
+}
+
+// findBlock returns the block that would contain name.
+func (t *table) findBlock(name string) int {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].name > name }) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// get returns the raw value of name, which is empty for a deletion.
+func (t *table) get(name string) ([]byte, bool, error) {
+	it := t.iter(name)
+	if it.next() && it.name() == name {
+		return it.val(), true, nil
+	}
+	return nil, false, it.err()
+}
+
+func (t *table) iter(from string) recIter {
+	return &tableIter{t: t, blk: t.findBlock(from), from: from}
+}
+
+func (t *table) Close() error {
+	return t.f.Close()
+}
+
+// recIter walks raw records in name order.
+type recIter interface {
+	next() bool
+	name() string
+	val() []byte
+	err() error
+}
+
+type tableIter struct {
+	t    *table
+	blk  int
+	from string
+	buf  []byte
+	k    string
+	v    []byte
+	fail error
+}
+
+func (ti *tableIter) next() bool {
+	for ti.fail == nil {
+		if len(ti.buf) == 0 {
+			if ti.blk >= len(ti.t.index) {
+				return false
+			}
+			ti.buf, ti.fail = ti.t.readBlock(ti.blk)
+			ti.blk++
+			continue
+		}
+		var v string
+		ti.k, ti.buf, ti.fail = readField(ti.buf)
+		if ti.fail == nil {
+			v, ti.buf, ti.fail = readField(ti.buf)
+		}
+		if ti.fail == nil && ti.k >= ti.from {
+			ti.v = []byte(v)
+			return true
+		}
+	}
+	return false
+}
+
+func (ti *tableIter) name() string { return ti.k }
+func (ti *tableIter) val() []byte  { return ti.v }
+func (ti *tableIter) err() error   { return ti.fail }
+
+// pendingIter walks changes not yet written to a table.
+type pendingIter struct {
+	names []string
+	files map[string]*bitfog.FileData
+	i     int
+	v     []byte
+	e     error
+}
+
+func newPendingIter(files map[string]*bitfog.FileData, from string) *pendingIter {
+	pi := &pendingIter{files: files, i: -1}
+	for k := range files {
+		if k >= from {
+			pi.names = append(pi.names, k)
+		}
+	}
+	sort.Strings(pi.names)
+	return pi
+}
+
+func (pi *pendingIter) next() bool {
+	pi.i++
+	if pi.e != nil || pi.i >= len(pi.names) {
+		return false
+	}
+	pi.v = nil
+	if fd := pi.files[pi.names[pi.i]]; fd != nil {
+		c := *fd
+		c.Name = ""
+		pi.v, pi.e = json.Marshal(c)
+	}
+	return pi.e == nil
+}
+
+func (pi *pendingIter) name() string { return pi.names[pi.i] }
+func (pi *pendingIter) val() []byte  { return pi.v }
+func (pi *pendingIter) err() error   { return pi.e }
+
+// mergeIter merges several recIters, later ones overriding earlier
+// ones, and hides deletions.
+type mergeIter struct {
+	h    mergeHeap
+	k    string
+	v    []byte
+	fail error
+}
+
+type mergeSource struct {
+	it  recIter
+	pri int
+}
+
+type mergeHeap []mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].it.name() != h[j].it.name() {
+		return h[i].it.name() < h[j].it.name()
+	}
+	return h[i].pri > h[j].pri
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newMergeIter(its ...recIter) *mergeIter {
+	m := &mergeIter{}
+	for i, it := range its {
+		m.advance(mergeSource{it, i})
+	}
+	return m
+}
+
+func (m *mergeIter) advance(s mergeSource) {
+	if s.it.next() {
+		heap.Push(&m.h, s)
+	} else if err := s.it.err(); err != nil && m.fail == nil {
+		m.fail = err
+	}
+}
+
+func (m *mergeIter) next() bool {
+	for m.fail == nil && m.h.Len() > 0 {
+		m.k, m.v = m.h[0].it.name(), append([]byte{}, m.h[0].it.val()...)
+		for m.h.Len() > 0 && m.h[0].it.name() == m.k {
+			m.advance(heap.Pop(&m.h).(mergeSource))
+		}
+		if len(m.v) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mergeIter) name() string { return m.k }
+func (m *mergeIter) val() []byte  { return m.v }
+func (m *mergeIter) err() error   { return m.fail }
+
+// fileIter walks files in name order.
+type fileIter interface {
+	next() bool
+	file() bitfog.FileData
+	err() error
+}
+
+// recFileIter decodes the records of a recIter, stopping at the end
+// of prefix.
+type recFileIter struct {
+	it     recIter
+	prefix string
+	fd     bitfog.FileData
+	fail   error
+}
+
+func (r *recFileIter) next() bool {
+	if r.fail != nil || !r.it.next() || !strings.HasPrefix(r.it.name(), r.prefix) {
+		return false
+	}
+	r.fd = bitfog.FileData{}
+	if r.fail = json.Unmarshal(r.it.val(), &r.fd); r.fail != nil {
+		return false
+	}
+	r.fd.Name = r.it.name()
+	return true
+}
+
+func (r *recFileIter) file() bitfog.FileData { return r.fd }
+
+func (r *recFileIter) err() error {
+	if r.fail != nil {
+		return r.fail
+	}
+	return r.it.err()
+}
+
+// sliceIter walks files already in memory, sorted by name.
+type sliceIter struct {
+	files []bitfog.FileData
+	i     int
+}
+
+func (s *sliceIter) next() bool {
+	s.i++
+	return s.i <= len(s.files)
+}
+
+func (s *sliceIter) file() bitfog.FileData { return s.files[s.i-1] }
+func (s *sliceIter) err() error            { return nil }
+
+// mapIter walks a map of files in name order.
+func mapIter(files map[string]bitfog.FileData) fileIter {
+	rv := &sliceIter{}
+	for k, fd := range files {
+		fd.Name = k
+		rv.files = append(rv.files, fd)
+	}
+	sort.Slice(rv.files, func(i, j int) bool { return rv.files[i].Name < rv.files[j].Name })
+	return rv
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/dustin/bitfog"
+)
+
+// patternList is a flag that may be given more than once.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+var includePatterns, excludePatterns patternList
+
+func init() {
+	flag.Var(&includePatterns, "include",
+		"fetch, store, builddb: only consider files matching this pattern (may be repeated)")
+	flag.Var(&excludePatterns, "exclude",
+		"fetch, store, builddb: ignore files matching this pattern (may be repeated)")
+}
+
+// planFilter limits what's considered to files matching any include
+// pattern (if there are any), and not matching an exclude pattern.
+// Patterns are gitignore-style, and match a file if they match any
+// directory containing it.
+type planFilter struct {
+	include, exclude bitfog.Rules
+}
+
+func newPlanFilter(include, exclude []string) (*planFilter, error) {
+	f := &planFilter{}
+	for _, p := range include {
+		if err := f.include.Add("", p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range exclude {
+		if err := f.exclude.Add("", p); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *planFilter) keep(name string) bool {
+	if !f.include.Empty() && !f.include.Matches(name) {
+		return false
+	}
+	return !f.exclude.Matches(name)
+}
+
+// iter filters another iterator.
+func (f *planFilter) iter(it fileIter) fileIter {
+	if f.include.Empty() && f.exclude.Empty() {
+		return it
+	}
+	return &filterIter{it, f}
+}
+
+type filterIter struct {
+	fileIter
+	f *planFilter
+}
+
+func (fi *filterIter) next() bool {
+	for fi.fileIter.next() {
+		if fi.f.keep(fi.file().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cliFilter is the filter given by -include and -exclude.
+func cliFilter() (*planFilter, error) {
+	return newPlanFilter(includePatterns, excludePatterns)
+}
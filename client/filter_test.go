@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestPlanFilter(t *testing.T) {
+	files := map[string]bitfog.FileData{
+		"a.txt":         {},
+		"a.tmp":         {},
+		"img/big.qcow2": {},
+		"img/cache/x":   {},
+		"src/main.go":   {},
+	}
+	tests := []struct {
+		include, exclude []string
+		exp              []string
+	}{
+		{nil, nil, []string{"a.tmp", "a.txt", "img/big.qcow2", "img/cache/x", "src/main.go"}},
+		{nil, []string{"*.tmp", "cache/"}, []string{"a.txt", "img/big.qcow2", "src/main.go"}},
+		{[]string{"img/"}, nil, []string{"img/big.qcow2", "img/cache/x"}},
+		{[]string{"img", "*.txt"}, []string{"cache/"}, []string{"a.txt", "img/big.qcow2"}},
+	}
+	for _, test := range tests {
+		f, err := newPlanFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatalf("Error making filter: %v", err)
+		}
+		var got []string
+		it := f.iter(mapIter(files))
+		for it.next() {
+			got = append(got, it.file().Name)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v/%v: expected %v, got %v", test.include, test.exclude, test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/dustin/bitfog"
+)
+
+var hashOnDemand = flag.Bool("hash", false,
+	"fetch, store, builddb: ask servers that don't keep checksums to hash files whose sizes match")
+
+// hashBatch is how many names go in each request for hashes.
+const hashBatch = 1000
+
+// hashedIter fills in hashes that weren't in a listing.
+type hashedIter struct {
+	fileIter
+	hashes map[string]uint64
+}
+
+func (h *hashedIter) file() bitfog.FileData {
+	fd := h.fileIter.file()
+	if hash, ok := h.hashes[fd.Name]; ok {
+		fd.Hash = hash
+	}
+	return fd
+}
+
+// withHashes returns it with the given hashes filled in.
+func withHashes(it fileIter, hashes map[string]uint64) fileIter {
+	if len(hashes) == 0 {
+		return it
+	}
+	return &hashedIter{it, hashes}
+}
+
+// unhashed returns the regular files in live without hashes whose
+// size matches a hashed file of the same name in known.  Those are the
+// only ones that can't be told apart without hashing them.
+func unhashed(live, known fileIter) ([]string, error) {
+	var rv []string
+	l, k := live.next(), known.next()
+	for l && k {
+		lfd, kfd := live.file(), known.file()
+		switch {
+		case lfd.Name < kfd.Name:
+			l = live.next()
+		case kfd.Name < lfd.Name:
+			k = known.next()
+		default:
+			if lfd.Hash == 0 && kfd.Hash != 0 && lfd.Size == kfd.Size &&
+				os.FileMode(lfd.Mode).IsRegular() {
+				rv = append(rv, lfd.Name)
+			}
+			l, k = live.next(), known.next()
+		}
+	}
+	if err := live.err(); err != nil {
+		return nil, err
+	}
+	return rv, known.err()
+}
+
+// fetchHashes asks the server at u to hash the named files, a batch at
+// a time.  A server that can't gives no hashes, leaving the files to
+// be compared as they were before it could.
+func fetchHashes(ctx context.Context, c *bitfogClient, u string, names []string) (map[string]uint64, error) {
+	rv := make(map[string]uint64, len(names))
+	for len(names) > 0 {
+		n := len(names)
+		if n > hashBatch {
+			n = hashBatch
+		}
+		fds, err := c.hashFiles(ctx, u, names[:n])
+		if err == errNoHashing {
+			log.Printf("%s can't hash files on demand; comparing them without", u)
+			return rv, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fd := range fds {
+			rv[fd.Name] = fd.Hash
+		}
+		names = names[n:]
+	}
+	return rv, nil
+}
+
+// hashLive hashes (with hash) the files in the live listing that need
+// it to be compared with known.
+func hashLive(live, known fileIter, hash func([]string) (map[string]uint64, error)) (map[string]uint64, error) {
+	names, err := unhashed(live, known)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	log.Printf("Hashing %d files", len(names))
+	return hash(names)
+}
+
+// knownHashes works out hashes for the regular files in it that don't
+// have one.  Those the same size and age as in old (if there's an old
+// listing) keep the hash they had, and the rest are returned to be
+// hashed.
+func knownHashes(it fileIter, old *db) (map[string]uint64, []string, error) {
+	hashes := map[string]uint64{}
+	var rest []string
+	for it.next() {
+		fd := it.file()
+		if fd.Hash != 0 || fd.Size == 0 || !os.FileMode(fd.Mode).IsRegular() {
+			continue
+		}
+		if old != nil {
+			ofd, ok, err := old.get(fd.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok && ofd.Hash != 0 && ofd.Size == fd.Size && ofd.Mtime == fd.Mtime {
+				hashes[fd.Name] = ofd.Hash
+				continue
+			}
+		}
+		rest = append(rest, fd.Name)
+	}
+	return hashes, rest, it.err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestUnhashed(t *testing.T) {
+	live := map[string]bitfog.FileData{
+		"same":    {Size: 5},
+		"resized": {Size: 6},
+		"hashed":  {Size: 5, Hash: 1},
+		"unknown": {Size: 5},
+		"new":     {Size: 5},
+		"link":    {Size: 5, Dest: "same", Mode: int32(os.ModeSymlink | 0777)},
+	}
+	known := map[string]bitfog.FileData{
+		"same":    {Size: 5, Hash: 1},
+		"resized": {Size: 5, Hash: 1},
+		"hashed":  {Size: 5, Hash: 2},
+		"unknown": {Size: 5},
+		"gone":    {Size: 5, Hash: 1},
+		"link":    {Size: 5, Hash: 1},
+	}
+	got, err := unhashed(mapIter(live), mapIter(known))
+	if err != nil {
+		t.Fatalf("Error comparing: %v", err)
+	}
+	if exp := []string{"same"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to hash %v, got %v", exp, got)
+	}
+
+	it := withHashes(mapIter(live), map[string]uint64{"same": 1})
+	for it.next() {
+		if fd := it.file(); fd.Name == "same" && fd.Hash != 1 {
+			t.Errorf("Expected a hash for same, got %+v", fd)
+		}
+	}
+}
+
+func TestKnownHashes(t *testing.T) {
+	files := map[string]bitfog.FileData{
+		"kept":    {Size: 5, Mtime: 1},
+		"touched": {Size: 5, Mtime: 2},
+		"hashed":  {Size: 5, Mtime: 1, Hash: 3},
+		"new":     {Size: 5, Mtime: 1},
+		"empty":   {Size: 0, Mtime: 1},
+	}
+	old := memDb(t, map[string]bitfog.FileData{
+		"kept":    {Size: 5, Mtime: 1, Hash: 7},
+		"touched": {Size: 5, Mtime: 1, Hash: 8},
+	})
+	hashes, rest, err := knownHashes(mapIter(files), old)
+	if err != nil {
+		t.Fatalf("Error working out hashes: %v", err)
+	}
+	if exp := map[string]uint64{"kept": 7}; !reflect.DeepEqual(hashes, exp) {
+		t.Errorf("Expected to keep %v, got %v", exp, hashes)
+	}
+	sort.Strings(rest)
+	if exp := []string{"new", "touched"}; !reflect.DeepEqual(rest, exp) {
+		t.Errorf("Expected to hash %v, got %v", exp, rest)
+	}
+
+	if _, rest, _ = knownHashes(mapIter(files), nil); len(rest) != 3 {
+		t.Errorf("Expected to hash everything without an old DB, got %v", rest)
+	}
+}
+
+func TestFetchHashes(t *testing.T) {
+	hashes := `{"name":"a","size":1,"hash":10}` + "\n" + `{"name":"b","size":1,"hash":11}`
+	c := &bitfogClient{client: &http.Client{Transport: &constantTransport{
+		status: 200,
+		body:   []byte(hashes),
+		header: http.Header{hashedHeader: {bitfog.HashAlgorithm}},
+	}}, fs: posixFsOps}
+	got, err := fetchHashes(context.Background(), c, "http://whatever/", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Error fetching hashes: %v", err)
+	}
+	if exp := map[string]uint64{"a": 10, "b": 11}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// Whatever an older server says, it's not hashes.
+	got, err = fetchHashes(context.Background(), fakeClient(200, hashes), "http://whatever/", []string{"a"})
+	if err != nil || len(got) != 0 {
+		t.Errorf("Expected no hashes (and no error) from an older server, got %v, %v", got, err)
+	}
+
+	if _, err := fetchHashes(context.Background(), fakeClient(400, "Unsupported hash"),
+		"http://whatever/", []string{"a"}); err == nil {
+		t.Errorf("Expected an error from a server that can't hash")
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"sethwklein.net/go/errutil"
 
 	"github.com/dustin/bitfog"
@@ -25,6 +30,10 @@ type fsOps struct {
 type bitfogClient struct {
 	client *http.Client
 	fs     fsOps
+
+	// Whether to compress uploads.  The server has to understand
+	// Content-Encoding for this to work.
+	compressUploads bool
 }
 
 var posixFsOps = fsOps{
@@ -38,57 +47,160 @@ var posixFsOps = fsOps{
 }
 
 func newBitfogClient() *bitfogClient {
-	return &bitfogClient{&http.Client{}, posixFsOps}
+	return &bitfogClient{client: &http.Client{}, fs: posixFsOps}
+}
+
+// do sends a request, asking for (and undoing) compression of the
+// response.
+func (c *bitfogClient) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept-Encoding", "zstd, gzip")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
 }
 
+// decodeURL reads a whole listing into memory.
 func (c *bitfogClient) decodeURL(ctx context.Context, u string) (map[string]bitfog.FileData, error) {
 	rv := map[string]bitfog.FileData{}
+	l, err := c.openListing(ctx, u)
+	if err != nil {
+		return rv, err
+	}
+	defer l.Close()
+	for l.next() {
+		rv[l.file().Name] = l.file()
+	}
+	return rv, l.err()
+}
 
+// Servers that promise to list names in byte-wise order say so in
+// this header.
+const listingOrderHeader = "X-Bitfog-Order"
+
+// listing streams the files in a server's listing.
+type listing struct {
+	u      string
+	body   io.ReadCloser
+	d      *json.Decoder
+	sorted bool
+	fd     bitfog.FileData
+	fail   error
+}
+
+func (c *bitfogClient) openListing(ctx context.Context, u string) (*listing, error) {
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	resp, err := c.client.Do(req)
+	// Ask for directories too.  Servers that don't know how ignore this.
+	q := req.URL.Query()
+	q.Set("dirs", "1")
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do(req)
 	if err != nil {
-		return rv, err
+		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return rv, httputil.HTTPErrorf(resp, "Error fetching %v - %S\n%B", u)
+		return nil, httputil.HTTPErrorf(resp, "Error fetching %v - %S\n%B", u)
 	}
-	defer resp.Body.Close()
-
-	d := json.NewDecoder(resp.Body)
+	return &listing{
+		u:      u,
+		body:   resp.Body,
+		d:      json.NewDecoder(resp.Body),
+		sorted: resp.Header.Get(listingOrderHeader) == "bytewise",
+	}, nil
+}
 
-	for {
-		fd := bitfog.FileData{}
-		err = d.Decode(&fd)
-		switch err {
-		default:
-			return rv, fmt.Errorf("error decoding %v: %v", u, err)
-		case nil:
-			rv[fd.Name] = fd
-		case io.EOF:
-			return rv, nil
-		}
+func (l *listing) next() bool {
+	if l.fail != nil {
+		return false
+	}
+	prev := l.fd.Name
+	l.fd = bitfog.FileData{}
+	switch err := l.d.Decode(&l.fd); {
+	case err == io.EOF:
+		return false
+	case err != nil:
+		l.fail = fmt.Errorf("error decoding %v: %v", l.u, err)
+		return false
+	case l.sorted && prev != "" && l.fd.Name <= prev:
+		l.fail = fmt.Errorf("%v is out of order: %q after %q", l.u, l.fd.Name, prev)
+		return false
 	}
+	return true
 }
 
-func (c *bitfogClient) downloadFile(ctx context.Context, src, dest string) (err error) {
-	req, err := http.NewRequest("GET", src, nil)
+func (l *listing) file() bitfog.FileData { return l.fd }
+func (l *listing) err() error            { return l.fail }
+
+func (l *listing) Close() error {
+	return l.body.Close()
+}
+
+// sparseHeader marks a response that holds only the data in a sparse
+// file, after a line describing where it goes.
+const sparseHeader = "X-Bitfog-Sparse"
+
+// openURL returns the body of a successful GET of a file at u.  Holes
+// in sparse files aren't sent (by servers that know how not to), so
+// they're filled in here.
+func (c *bitfogClient) openURL(ctx context.Context, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req = req.WithContext(ctx)
-	resp, err := c.client.Do(req)
+	q := req.URL.Query()
+	q.Set("sparse", "1")
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
 	if resp.StatusCode != 200 {
-		return httputil.HTTPErrorf(resp, "error getting %v - %S\n%B", src)
+		defer resp.Body.Close()
+		return nil, httputil.HTTPErrorf(resp, "error getting %v - %S\n%B", u)
 	}
+	if resp.Header.Get(sparseHeader) == "" {
+		return resp.Body, nil
+	}
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadBytes('\n')
+	var m bitfog.SparseMap
+	if err == nil {
+		err = json.Unmarshal(line, &m)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error reading sparse map of %v: %v", u, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{bitfog.NewHoleReader(br, m), resp.Body}, nil
+}
+
+// sparse makes a file written through w sparse, if it can be.
+func sparse(w io.WriteCloser) io.WriteCloser {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		return bitfog.NewSparseWriter(ws)
+	}
+	return w
+}
+
+func (c *bitfogClient) downloadFile(ctx context.Context, src, dest string) (err error) {
+	body, err := c.openURL(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
 
 	f, err := c.fs.Create(dest)
 	if err != nil {
@@ -98,9 +210,10 @@ func (c *bitfogClient) downloadFile(ctx context.Context, src, dest string) (err
 			return err
 		}
 	}
+	f = sparse(f)
 	defer errutil.AppendCall(&err, f.Close)
 
-	_, err = io.Copy(f, resp.Body)
+	_, err = io.Copy(f, body)
 	return err
 }
 
@@ -110,7 +223,7 @@ func (c *bitfogClient) deleteFile(ctx context.Context, dest string) error {
 		return err
 	}
 	req = req.WithContext(ctx)
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -128,14 +241,56 @@ func (c *bitfogClient) uploadFile(ctx context.Context, src, dest string) error {
 	}
 	defer srcfile.Close()
 
-	req, err := http.NewRequest("PUT", dest, srcfile)
+	return c.upload(ctx, srcfile, dest, nil)
+}
+
+// metaHeader carries the ownership and extended attributes a file
+// should be given.
+const metaHeader = "X-Bitfog-Meta"
+
+func setMeta(req *http.Request, meta *bitfog.Meta) error {
+	if meta == nil {
+		return nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(metaHeader, string(b))
+	return nil
+}
+
+func (c *bitfogClient) upload(ctx context.Context, r io.Reader, dest string, meta *bitfog.Meta) error {
+	if c.compressUploads {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			enc, err := zstd.NewWriter(pw)
+			if err == nil {
+				_, err = io.Copy(enc, r)
+				if cerr := enc.Close(); err == nil {
+					err = cerr
+				}
+			}
+			pw.CloseWithError(err)
+		}(r)
+		r = pr
+	}
+
+	req, err := http.NewRequest("PUT", dest, r)
 	if err != nil {
 		return err
 	}
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/octet-stream")
+	if err := setMeta(req, meta); err != nil {
+		return err
+	}
+	if c.compressUploads {
+		req.Header.Set("Content-Encoding", "zstd")
+	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -146,15 +301,19 @@ func (c *bitfogClient) uploadFile(ctx context.Context, src, dest string) error {
 	return nil
 }
 
-func (c *bitfogClient) createSymlink(ctx context.Context, target, dest string) error {
-	req, err := http.NewRequest("PUT", dest, strings.NewReader(target))
+// put creates something other than a regular file at dest.
+func (c *bitfogClient) put(ctx context.Context, ctype string, body io.Reader, dest string, meta *bitfog.Meta) error {
+	req, err := http.NewRequest("PUT", dest, body)
 	if err != nil {
 		return err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/symlink")
+	req.Header.Set("Content-Type", ctype)
+	if err := setMeta(req, meta); err != nil {
+		return err
+	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -164,3 +323,131 @@ func (c *bitfogClient) createSymlink(ctx context.Context, target, dest string) e
 	}
 	return nil
 }
+
+func (c *bitfogClient) createSymlink(ctx context.Context, target, dest string, meta *bitfog.Meta) error {
+	return c.put(ctx, "application/symlink", strings.NewReader(target), dest, meta)
+}
+
+// createHardlink makes dest another name for target, which is a name
+// in the same area.
+func (c *bitfogClient) createHardlink(ctx context.Context, target, dest string) error {
+	return c.put(ctx, "application/hardlink", strings.NewReader(target), dest, nil)
+}
+
+// createDir creates a directory at dest.  If fd is given, the
+// directory is also given its mode and mtime.
+func (c *bitfogClient) createDir(ctx context.Context, fd *bitfog.FileData, dest string) error {
+	var body []byte
+	if fd != nil {
+		var err error
+		if body, err = json.Marshal(fd); err != nil {
+			return err
+		}
+	}
+	return c.put(ctx, "application/directory", bytes.NewReader(body), dest, nil)
+}
+
+// hashedHeader marks a server's answer to hashFiles.
+const hashedHeader = "X-Bitfog-Hashed"
+
+// errNoHashing is returned by hashFiles when the server doesn't know
+// how to hash files on demand.
+var errNoHashing = errors.New("server can't hash files on demand")
+
+// hashFiles asks the server for the listing entries of the named
+// files in the area at u, with hashes whether or not the area keeps
+// them.
+func (c *bitfogClient) hashFiles(ctx context.Context, u string, names []string) ([]bitfog.FileData, error) {
+	body := strings.Join(names, "\n") + "\n"
+	req, err := http.NewRequest("POST", u+"?hash="+url.QueryEscape(bitfog.HashAlgorithm),
+		strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, httputil.HTTPError(resp)
+	}
+	if resp.Header.Get(hashedHeader) != bitfog.HashAlgorithm {
+		return nil, errNoHashing
+	}
+	var rv []bitfog.FileData
+	d := json.NewDecoder(resp.Body)
+	for {
+		var fd bitfog.FileData
+		switch err := d.Decode(&fd); err {
+		case io.EOF:
+			return rv, nil
+		case nil:
+			rv = append(rv, fd)
+		default:
+			return nil, err
+		}
+	}
+}
+
+// updateMeta gives the file at dest the mode, mtime and (if it has
+// any) ownership and extended attributes in fd, leaving its content
+// alone.
+func (c *bitfogClient) updateMeta(ctx context.Context, fd bitfog.FileData, dest string) error {
+	body, err := json.Marshal(fd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", dest+"?meta=1", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 {
+		return httputil.HTTPError(resp)
+	}
+	return nil
+}
+
+// errNoSnapshots is returned by snapshot for areas that don't keep
+// snapshots, or servers that don't know how to.
+var errNoSnapshots = errors.New("no snapshots here")
+
+// snapshot asks the server to take a snapshot of the area at u,
+// returning the ID of the new snapshot.
+func (c *bitfogClient) snapshot(ctx context.Context, u string) (string, error) {
+	req, err := http.NewRequest("POST", u+"?snapshot=create", nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return "", errNoSnapshots
+	default:
+		return "", httputil.HTTPError(resp)
+	}
+	var info struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.ID == "" {
+		return "", fmt.Errorf("%v didn't say what snapshot it took", u)
+	}
+	return info.ID, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/net/context"
 
 	"github.com/dustin/bitfog"
@@ -18,6 +20,7 @@ import (
 type constantTransport struct {
 	status int
 	body   []byte
+	header http.Header
 }
 
 var errNotInitialized = errors.New("no transport")
@@ -29,16 +32,17 @@ func (c *constantTransport) RoundTrip(*http.Request) (*http.Response, error) {
 	return &http.Response{
 		StatusCode: c.status,
 		Status:     http.StatusText(c.status),
+		Header:     c.header,
 		Body:       ioutil.NopCloser(bytes.NewReader(c.body)),
 	}, nil
 }
 
 func fakeClient(status int, body string) *bitfogClient {
-	return &bitfogClient{&http.Client{Transport: &constantTransport{status, []byte(body)}}, posixFsOps}
+	return &bitfogClient{client: &http.Client{Transport: &constantTransport{status: status, body: []byte(body)}}, fs: posixFsOps}
 }
 
 func brokenClient() *bitfogClient {
-	return &bitfogClient{&http.Client{Transport: (*constantTransport)(nil)}, posixFsOps}
+	return &bitfogClient{client: &http.Client{Transport: (*constantTransport)(nil)}, fs: posixFsOps}
 }
 
 func TestDecodeFail(t *testing.T) {
@@ -138,25 +142,25 @@ func TestDeleteFile(t *testing.T) {
 func TestCreateSymlink(t *testing.T) {
 	ctx := context.Background()
 	c := fakeClient(204, "")
-	err := c.createSymlink(ctx, "y", "http://whatever/x")
+	err := c.createSymlink(ctx, "y", "http://whatever/x", nil)
 	if err != nil {
 		t.Errorf("Error trying to create symlink: %v", err)
 	}
 
 	c = brokenClient()
-	err = c.createSymlink(ctx, "y", "http://whatever/x")
+	err = c.createSymlink(ctx, "y", "http://whatever/x", nil)
 	if err == nil {
 		t.Errorf("Expected error creating symlink, but succeeded")
 	}
 
 	c = brokenClient()
-	err = c.createSymlink(ctx, "y", "://whatever/x")
+	err = c.createSymlink(ctx, "y", "://whatever/x", nil)
 	if err == nil {
 		t.Errorf("Expected error creating symlink, but succeeded")
 	}
 
 	c = fakeClient(500, "")
-	err = c.createSymlink(ctx, "y", "http://whatever/x")
+	err = c.createSymlink(ctx, "y", "http://whatever/x", nil)
 	if err == nil {
 		t.Errorf("expected 500 error, but succeeded")
 	}
@@ -330,3 +334,160 @@ func TestUpload(t *testing.T) {
 		t.Errorf("Unexpected error uploading: %v", err)
 	}
 }
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	c := fakeClient(200, `{"id": "1402853551000000000", "time": 1402853551}`)
+	id, err := c.snapshot(ctx, "http://whatever/")
+	if err != nil {
+		t.Errorf("Error taking snapshot: %v", err)
+	}
+	if id != "1402853551000000000" {
+		t.Errorf("Expected snapshot id, got %q", id)
+	}
+
+	for _, status := range []int{404, 405} {
+		c = fakeClient(status, "No snapshots here.")
+		if _, err = c.snapshot(ctx, "http://whatever/"); err != errNoSnapshots {
+			t.Errorf("Expected no snapshots for %v, got %v", status, err)
+		}
+	}
+
+	c = fakeClient(500, "Broken")
+	if _, err = c.snapshot(ctx, "http://whatever/"); err == nil || err == errNoSnapshots {
+		t.Errorf("Expected error taking snapshot, got %v", err)
+	}
+
+	c = fakeClient(200, `{"id": ""}`)
+	if id, err = c.snapshot(ctx, "http://whatever/"); err == nil {
+		t.Errorf("Expected error for a snapshot without an id, got %q", id)
+	}
+
+	c = brokenClient()
+	_, err = c.snapshot(ctx, "http://whatever/")
+	if err == nil {
+		t.Errorf("Expected error taking snapshot, but succeeded")
+	}
+
+	c = fakeClient(200, "garbage")
+	_, err = c.snapshot(ctx, "http://whatever/")
+	if err == nil {
+		t.Errorf("Expected error decoding snapshot, but succeeded")
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello"))
+	w.Close()
+
+	enc, _ := zstd.NewWriter(nil)
+	zs := enc.EncodeAll([]byte("hello"), nil)
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		ok       bool
+	}{
+		{"", []byte("hello"), true},
+		{"gzip", gz.Bytes(), true},
+		{"zstd", zs, true},
+		{"gzip", []byte("hello"), false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{
+			Header: http.Header{"Content-Encoding": []string{test.encoding}},
+			Body:   ioutil.NopCloser(bytes.NewReader(test.body)),
+		}
+		err := decodeResponse(resp)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: expected ok=%v, got %v", test.encoding, test.ok, err)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		if err != nil || string(got) != "hello" {
+			t.Errorf("%v: expected hello, got %q/%v", test.encoding, got, err)
+		}
+	}
+}
+
+func TestSortedListing(t *testing.T) {
+	ctx := context.Background()
+	sorted := func(body string) *bitfogClient {
+		return &bitfogClient{client: &http.Client{Transport: &constantTransport{
+			status: 200,
+			body:   []byte(body),
+			header: http.Header{listingOrderHeader: {"bytewise"}},
+		}}, fs: posixFsOps}
+	}
+
+	d, err := fetchListing(ctx, sorted(`{"name": "a", "size": 1, "hash": 5}
+{"name": "a.txt", "size": 2}
+{"name": "a/b", "size": 3}`), "http://whatever/")
+	if err != nil {
+		t.Fatalf("Error fetching listing: %v", err)
+	}
+	defer d.Close()
+	if len(d.runs) != 1 || len(d.pending) != 0 {
+		t.Errorf("Expected sorted listing to go straight to disk")
+	}
+	if n := dbCount(t, d); n != 3 {
+		t.Errorf("Expected 3 files, got %v", n)
+	}
+	if !d.header.Checksums {
+		t.Errorf("Expected checksums to be noticed")
+	}
+
+	_, err = fetchListing(ctx, sorted(`{"name": "a/b", "size": 1}
+{"name": "a.txt", "size": 2}`), "http://whatever/")
+	if err == nil {
+		t.Errorf("Expected error for out of order listing")
+	}
+
+	d, err = fetchListing(ctx, fakeClient(200, `{"name": "b", "size": 1}
+{"name": "a", "size": 2}`), "http://whatever/")
+	if err != nil {
+		t.Fatalf("Error fetching unsorted listing: %v", err)
+	}
+	defer d.Close()
+	if n := dbCount(t, d); n != 2 {
+		t.Errorf("Expected 2 files, got %v", n)
+	}
+}
+
+func TestSparseDownload(t *testing.T) {
+	ctx := context.Background()
+	body := `{"size":10,"extents":[{"off":2,"len":3},{"off":7,"len":1}]}` + "\nabcd"
+	c := &bitfogClient{client: &http.Client{Transport: &constantTransport{
+		status: 200,
+		body:   []byte(body),
+		header: http.Header{sparseHeader: []string{"1"}},
+	}}, fs: posixFsOps}
+	r, err := c.openURL(ctx, "http://whatever/x")
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if exp := "\x00\x00abc\x00\x00d\x00\x00"; string(got) != exp {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+
+	// Without the header, it's just the file.
+	r, err = fakeClient(200, body).openURL(ctx, "http://whatever/x")
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	defer r.Close()
+	if got, _ := ioutil.ReadAll(r); string(got) != body {
+		t.Errorf("Expected %q, got %q", body, got)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/dustin/bitfog"
 )
@@ -19,6 +21,16 @@ func init() {
   emptydb dbname         # build an empty database (representing blank dest)
   fetch destdb src path  # fetch the missing items into a temp dir
   store srcdb dest path  # store fetched things into the dest
+  -map m builddb         # build a database for each source in a map
+  -map m fetch destdb path
+  -map m store dest path # as above, for all the sources in a map
+  repair path            # check and repair fetched things using parity
+  verify db url|path     # compare a DB against a server or fetched things
+  db info dbname         # show where a database came from
+  db ls dbname [prefix]  # list the files in a database
+  db stat dbname file    # show everything known about a file
+  db diff dba dbb        # show what changed between two databases
+  db du dbname           # show space used per directory
 
 `)
 		flag.PrintDefaults()
@@ -27,28 +39,120 @@ func init() {
 
 var client = newBitfogClient()
 
+var chunkCarry = flag.Bool("chunk", false,
+	"fetch: carry files as deduplicated chunks")
+var keyFile = flag.String("keyfile", "",
+	"encrypt carried data with a key from this file")
+var compressCarry = flag.Bool("compress", false,
+	"fetch: compress compressible files in the carry directory")
+var compressUploads = flag.Bool("compressuploads", false,
+	"store: compress uploads (server must support it)")
+var parityShards = flag.Int("parity", 0,
+	"fetch: parity shards to carry per 16 data shards")
+var snapshotAfter = flag.Bool("snapshot", false,
+	"store: have the destination take a snapshot when done")
+
+// carryKeySource returns the key carried data should be encrypted
+// with, if any.  A passphrase comes from $BITFOG_PASSPHRASE so it
+// doesn't show up in process listings.
+func carryKeySource() keySource {
+	return keySource{
+		passphrase: os.Getenv("BITFOG_PASSPHRASE"),
+		keyfile:    *keyFile,
+	}
+}
+
 func dbFromURL(ctx context.Context, u, path string) error {
-	data, err := client.decodeURL(ctx, u)
+	cp, err := listWithCheckpoint(ctx, client, u, path+".partial")
 	if err != nil {
 		return err
 	}
+	defer cp.Close()
 
 	storage, err := newDb(path)
 	if err != nil {
 		return err
 	}
-	defer storage.Close()
+	storage.header.Source = u
 
-	for fn, fd := range data {
-		if err := storage.AddFile(fn, fd); err != nil {
+	filter, err := cliFilter()
+	if err != nil {
+		return err
+	}
+	var hashes map[string]uint64
+	if *hashOnDemand {
+		hashes, err = hashListing(ctx, u, path, cp, filter)
+		if err != nil {
 			return err
 		}
 	}
+	it, err := cp.iter()
+	if err == nil {
+		it = withHashes(filter.iter(it), hashes)
+		if cp.header.Sorted {
+			err = storage.appendSorted(it)
+		} else {
+			for it.next() {
+				if err = storage.AddFile(it.file().Name, it.file()); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = it.err()
+			}
+		}
+	}
+	if err != nil {
+		storage.scratch = true
+		storage.Close()
+		return err
+	}
+	storage.header.Checksums, _ = checksumState(storage.iter(""))
 
-	return nil
+	if err := storage.Close(); err != nil {
+		return err
+	}
+	return cp.remove()
+}
+
+// hashListing hashes the files in a listing without hashes, other
+// than those unchanged since the DB at path was built.
+func hashListing(ctx context.Context, u, path string, cp *checkpoint, filter *planFilter) (map[string]uint64, error) {
+	old, err := openDb(path)
+	switch {
+	case os.IsNotExist(err):
+		old = nil
+	case err != nil:
+		return nil, err
+	default:
+		defer old.Close()
+	}
+	it, err := cp.iter()
+	if err != nil {
+		return nil, err
+	}
+	hashes, rest, err := knownHashes(filter.iter(it), old)
+	if err != nil || len(rest) == 0 {
+		return hashes, err
+	}
+	log.Printf("Hashing %d files at %s", len(rest), u)
+	fetched, err := fetchHashes(ctx, client, u, rest)
+	for k, v := range fetched {
+		hashes[k] = v
+	}
+	return hashes, err
 }
 
 func builddb(ctx context.Context) {
+	if *mapPath != "" {
+		for _, s := range cliMapping().Sources {
+			log.Printf("Building %s from %s", s.DB, s.URL)
+			if err := dbFromURL(ctx, s.URL, s.DB); err != nil {
+				log.Fatalf("Error making list: %v", err)
+			}
+		}
+		return
+	}
 	if flag.NArg() < 3 {
 		flag.Usage()
 		os.Exit(1)
@@ -58,6 +162,15 @@ func builddb(ctx context.Context) {
 	}
 }
 
+// cliMapping reads the mapping given with -map.
+func cliMapping() *mapping {
+	m, err := loadMapping(*mapPath)
+	if err != nil {
+		log.Fatalf("Error reading map: %v", err)
+	}
+	return m
+}
+
 func emptydb(ctx context.Context) {
 	if flag.NArg() < 2 {
 		flag.Usage()
@@ -70,14 +183,15 @@ func emptydb(ctx context.Context) {
 	defer storage.Close()
 }
 
-func fetchTmp(ctx context.Context, path, src string, paths []string, fd map[string]bitfog.FileData) error {
-	log.Printf("Fetching %d files", len(paths))
+// fetchTmp fetches files into the carry directory from wherever urlOf
+// says they are.
+func fetchTmp(ctx context.Context, carry *carryDir, urlOf func(string) string, files []bitfog.FileData) error {
+	log.Printf("Fetching %d files", len(files))
 
-	for _, fn := range paths {
-		if fd[fn].Dest == "" {
-			log.Printf("  + %s", fn)
-			dest := filepath.Join(path, fn)
-			if err := client.downloadFile(ctx, src+fn, dest); err != nil {
+	for _, fd := range files {
+		if fd.Dest == "" && fd.LinkTo == "" && !fd.IsDir() {
+			log.Printf("  + %s", fd.Name)
+			if err := carry.fetch(ctx, client, urlOf(fd.Name), fd.Name, fd.Meta); err != nil {
 				return err
 			}
 		}
@@ -86,27 +200,81 @@ func fetchTmp(ctx context.Context, path, src string, paths []string, fd map[stri
 }
 
 func fetch(ctx context.Context) {
-	if flag.NArg() < 4 {
-		flag.Usage()
-		os.Exit(1)
+	var m *mapping
+	var destdb, tmpPath string
+	if *mapPath != "" {
+		if flag.NArg() < 3 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		m, destdb, tmpPath = cliMapping(), flag.Arg(1), flag.Arg(2)
+	} else {
+		if flag.NArg() < 4 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		m, destdb, tmpPath = singleSource(flag.Arg(2), ""), flag.Arg(1), flag.Arg(3)
 	}
 
-	destdb, srcurl, tmpPath := flag.Arg(1), flag.Arg(2), flag.Arg(3)
-
 	destData, err := openDb(destdb)
 	if err != nil {
 		log.Fatalf("Error reading DB:  %v", err)
 	}
 	defer destData.Close()
 
-	log.Printf("Read %d files", len(destData.files))
+	srcData, err := m.openSources(ctx)
+	if err != nil {
+		log.Fatalf("Error reading sources: %v", err)
+	}
+	defer srcData.Close()
 
-	srcData, err := client.decodeURL(ctx, srcurl)
+	for i, d := range srcData.dbs {
+		warnHashMismatch(srcData.name(i), d, destdb, destData)
+	}
+	filter, err := cliFilter()
+	if err != nil {
+		log.Fatalf("Error parsing patterns: %v", err)
+	}
+	cmp, err := cliComparison()
 	if err != nil {
-		log.Fatalf("Error reading from src: %s: %v", srcurl, err)
+		log.Fatalf("Error choosing comparison: %v", err)
 	}
+	var hashes map[string]uint64
+	if *hashOnDemand {
+		hashes, err = hashLive(srcData.iter(), m.iter(destData.iter("")),
+			func(names []string) (map[string]uint64, error) {
+				return m.fetchHashes(ctx, names)
+			})
+		if err != nil {
+			log.Fatalf("Error hashing sources: %v", err)
+		}
+	}
+	changes, err := changedFiles(filter.iter(withHashes(srcData.iter(), hashes)),
+		filter.iter(m.iter(destData.iter(""))), cmp)
+	if err != nil {
+		log.Fatalf("Error comparing listings: %v", err)
+	}
+	toadd, toremove := changes.add, changes.remove
 
-	toadd, toremove := computeChanged(srcData, destData.files)
+	policy, err := cliPriority()
+	if err != nil {
+		log.Fatalf("Error reading priorities: %v", err)
+	}
+	if policy.uses("outstanding") {
+		outstanding := destdb + ".outstanding"
+		if err := policy.loadOutstanding(outstanding); err != nil {
+			log.Fatalf("Error reading %v: %v", outstanding, err)
+		}
+		if err := policy.saveOutstanding(outstanding, toadd, time.Now()); err != nil {
+			log.Fatalf("Error writing %v: %v", outstanding, err)
+		}
+	}
+	policy.sort(toadd)
+	toadd, skipped := policy.limit(toadd)
+	if len(skipped) > 0 {
+		log.Printf("Leaving %d files (%d bytes) for another trip",
+			len(skipped), sumSizes(skipped))
+	}
 
 	if err := os.RemoveAll(tmpPath); err != nil {
 		log.Fatalf("Error cleaning up tmp dir: %v", err)
@@ -114,67 +282,337 @@ func fetch(ctx context.Context) {
 	if err := os.Mkdir(tmpPath, 0777); err != nil {
 		log.Fatalf("Error recreating tmp dir: %v", err)
 	}
+	carry, err := createCarry(tmpPath, client.fs, carryOpts{
+		chunked:  *chunkCarry,
+		compress: *compressCarry,
+		keys:     carryKeySource(),
+		parity:   *parityShards,
+	})
+	if err != nil {
+		log.Fatalf("Error creating carry manifest: %v", err)
+	}
 
 	log.Printf("Need to add %d files, and remove %d", len(toadd), len(toremove))
-	if err := fetchTmp(ctx, tmpPath, srcurl, toadd, srcData); err != nil {
+	if len(changes.update) > 0 {
+		log.Printf("Need to update metadata of %d files", len(changes.update))
+	}
+	if err := fetchTmp(ctx, carry, m.url, toadd); err != nil {
 		log.Fatalf("Error downloading file: %v", err)
 	}
+	if err := carry.Close(); err != nil {
+		log.Fatalf("Error finishing carry manifest: %v", err)
+	}
 	for _, fn := range toremove {
 		log.Printf("  - %s", fn)
 	}
 }
 
 func store(ctx context.Context) {
-	if flag.NArg() < 4 {
-		flag.Usage()
-		os.Exit(1)
+	var m *mapping
+	var desturl, tmpPath string
+	if *mapPath != "" {
+		if flag.NArg() < 3 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		m, desturl, tmpPath = cliMapping(), flag.Arg(1), flag.Arg(2)
+	} else {
+		if flag.NArg() < 4 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		m, desturl, tmpPath = singleSource("", flag.Arg(1)), flag.Arg(2), flag.Arg(3)
 	}
 
-	srcdb, desturl, tmpPath := flag.Arg(1), flag.Arg(2), flag.Arg(3)
-
-	srcData, err := openDb(srcdb)
+	srcData, err := m.openSourceDbs()
 	if err != nil {
 		log.Fatalf("Error reading DB:  %v", err)
 	}
 	defer srcData.Close()
 
-	log.Printf("Read %d files", len(srcData.files))
-
-	destData, err := client.decodeURL(ctx, desturl)
+	destData, err := fetchListing(ctx, client, desturl)
 	if err != nil {
 		log.Fatalf("Error reading from dest: %s: %v", desturl, err)
 	}
+	defer destData.Close()
+
+	carry, err := openCarry(tmpPath, client.fs, carryKeySource())
+	if err != nil {
+		log.Fatalf("Error reading carry manifest: %v", err)
+	}
+	if carry.tracked && !carry.finished {
+		log.Printf("Carry manifest in %v is unfinished (fetch was interrupted, or it's been cut short); storing what's there", tmpPath)
+	}
 
-	toadd, toremove := computeChanged(srcData.files, destData)
+	for i, d := range srcData.dbs {
+		warnHashMismatch(srcData.name(i), d, desturl, destData)
+	}
+	filter, err := cliFilter()
+	if err != nil {
+		log.Fatalf("Error parsing patterns: %v", err)
+	}
+	cmp, err := cliComparison()
+	if err != nil {
+		log.Fatalf("Error choosing comparison: %v", err)
+	}
+	var hashes map[string]uint64
+	if *hashOnDemand {
+		hashes, err = hashLive(m.iter(destData.iter("")), srcData.iter(),
+			func(names []string) (map[string]uint64, error) {
+				return fetchHashes(ctx, client, desturl, names)
+			})
+		if err != nil {
+			log.Fatalf("Error hashing files at %s: %v", desturl, err)
+		}
+	}
+	changes, err := changedFiles(filter.iter(srcData.iter()),
+		filter.iter(withHashes(m.iter(destData.iter("")), hashes)), cmp)
+	if err != nil {
+		log.Fatalf("Error comparing listings: %v", err)
+	}
+	toadd, toremove := changes.add, changes.remove
+	policy, err := cliPriority()
+	if err != nil {
+		log.Fatalf("Error reading priorities: %v", err)
+	}
+	policy.sort(toadd)
 
 	log.Printf("Need to add %d files, and remove %d around %s",
 		len(toadd), len(toremove), tmpPath)
 
+	// Directories are removed once they're empty, deepest first.
+	var rmdirs []string
 	for _, fn := range toremove {
+		if strings.HasSuffix(fn, "/") {
+			rmdirs = append(rmdirs, fn)
+			continue
+		}
 		log.Printf(" - %s", fn)
 		if err := client.deleteFile(ctx, desturl+fn); err != nil {
 			log.Fatalf("Error deleting %s: %v", fn, err)
 		}
 	}
+	for i := len(rmdirs) - 1; i >= 0; i-- {
+		log.Printf(" - %s", rmdirs[i])
+		if err := client.deleteFile(ctx, desturl+rmdirs[i]); err != nil {
+			log.Printf("Error deleting %s: %v", rmdirs[i], err)
+		}
+	}
 
-	for _, fn := range toadd {
+	// Directories are created before anything goes in them, but only
+	// get their modes and mtimes after.
+	var mkdirs []string
+	for _, fd := range toadd {
+		if fd.IsDir() {
+			mkdirs = append(mkdirs, fd.Name)
+		}
+	}
+	sort.Strings(mkdirs)
+	for _, fn := range mkdirs {
 		log.Printf(" + %s", fn)
-		src := filepath.Join(tmpPath, fn)
-		if srcData.files[fn].Dest == "" {
-			err = client.uploadFile(ctx, src, desturl+fn)
+		if err := client.createDir(ctx, nil, desturl+fn); err != nil {
+			log.Printf("Error creating %s: %v", fn, err)
+		}
+	}
+
+	// Hard links are made once what they link to is there.
+	var links []bitfog.FileData
+	missing := map[string]bool{}
+	for _, fd := range toadd {
+		fn := fd.Name
+		if fd.IsDir() {
+			continue
+		}
+		if fd.LinkTo != "" {
+			links = append(links, fd)
+			continue
+		}
+		log.Printf(" + %s", fn)
+		if fd.Dest == "" {
+			if damaged, err := carry.check(fn, true); err != nil {
+				log.Printf("Skipping damaged %s: %v", fn, err)
+				missing[fn] = true
+				continue
+			} else if damaged > 0 {
+				log.Printf("Repaired %d damaged shards of %s", damaged, fn)
+			}
+			err = carry.upload(ctx, client, fn, desturl+fn, fd.Meta)
 		} else {
-			err = client.createSymlink(ctx, srcData.files[fn].Dest, desturl+fn)
+			err = client.createSymlink(ctx, fd.Dest, desturl+fn, fd.Meta)
 		}
 		if err != nil {
 			if !os.IsNotExist(err) {
 				log.Fatalf("Error uploading %s: %#v", fn, err)
 			}
+			missing[fn] = true
+		}
+	}
+	for _, fd := range links {
+		if missing[fd.LinkTo] {
+			continue
+		}
+		log.Printf(" + %s => %s", fd.Name, fd.LinkTo)
+		if err := client.createHardlink(ctx, fd.LinkTo, desturl+fd.Name); err != nil {
+			log.Fatalf("Error linking %s: %v", fd.Name, err)
+		}
+	}
+
+	// When mtimes are compared, new files need the ones they have in
+	// src, or they'd look changed next time.
+	updates := changes.update
+	if cmp.updatesMtimes() {
+		for _, fd := range toadd {
+			if os.FileMode(fd.Mode).IsRegular() && fd.LinkTo == "" && !missing[fd.Name] {
+				updates = append(updates, fd)
+			}
+		}
+	}
+	for _, fd := range updates {
+		if fd.IsDir() {
+			// Done with the rest of the directories below.
+			continue
+		}
+		log.Printf(" * %s", fd.Name)
+		if err := client.updateMeta(ctx, fd, desturl+fd.Name); err != nil {
+			log.Printf("Error updating metadata of %s: %v", fd.Name, err)
+		}
+	}
+
+	if err := setDirMeta(ctx, srcData, desturl, append(toadd, changes.update...), toremove); err != nil {
+		log.Fatalf("Error setting directory metadata: %v", err)
+	}
+
+	if *snapshotAfter {
+		switch id, err := client.snapshot(ctx, desturl); err {
+		case nil:
+			log.Printf("Took snapshot %s", id)
+		case errNoSnapshots:
+			log.Printf("%s doesn't keep snapshots", desturl)
+		default:
+			log.Printf("Error taking snapshot of %s: %v", desturl, err)
+		}
+	}
+}
+
+// parentDir returns the directory containing name, or "" at the top.
+func parentDir(name string) string {
+	name = strings.TrimSuffix(name, "/")
+	return name[:strings.LastIndex(name, "/")+1]
+}
+
+// setDirMeta gives every directory that was created, or had something
+// added to or removed from it, the mode and mtime it has in the sources.
+// Deeper directories go first, as setting a directory's metadata
+// doesn't change its parent's.
+func setDirMeta(ctx context.Context, src *sourceSet, desturl string, toadd []bitfog.FileData, toremove []string) error {
+	touched := map[string]bool{}
+	for _, fd := range toadd {
+		if fd.IsDir() {
+			touched[fd.Name] = true
+		}
+		touched[parentDir(fd.Name)] = true
+	}
+	for _, fn := range toremove {
+		touched[parentDir(fn)] = true
+	}
+	delete(touched, "")
+	var dirs []string
+	for fn := range touched {
+		dirs = append(dirs, fn)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, fn := range dirs {
+		fd, ok, err := src.get(fn)
+		if err != nil {
+			return err
+		}
+		if !ok || !fd.IsDir() {
+			continue
+		}
+		if err := client.createDir(ctx, &fd, desturl+fn); err != nil {
+			log.Printf("Error setting metadata of %s: %v", fn, err)
 		}
 	}
+	return nil
+}
+
+func repair(ctx context.Context) {
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	carry, err := openCarry(flag.Arg(1), client.fs, carryKeySource())
+	if err != nil {
+		log.Fatalf("Error reading carry manifest: %v", err)
+	}
+
+	repaired, failed := 0, 0
+	for fn := range carry.entries {
+		damaged, err := carry.check(fn, true)
+		switch {
+		case err != nil:
+			log.Printf("Can't repair %s: %v", fn, err)
+			failed++
+		case damaged > 0:
+			log.Printf("Repaired %d damaged shards of %s", damaged, fn)
+			repaired++
+		}
+	}
+	log.Printf("Checked %d files: %d repaired, %d unrepairable",
+		len(carry.entries), repaired, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func verify(ctx context.Context) {
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	dbpath, target := flag.Arg(1), flag.Arg(2)
+	want, err := openDb(dbpath)
+	if err != nil {
+		log.Fatalf("Error reading DB:  %v", err)
+	}
+
+	var diffs []difference
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		got, err := fetchListing(ctx, client, target)
+		if err != nil {
+			log.Fatalf("Error reading from %s: %v", target, err)
+		}
+		warnHashMismatch(dbpath, want, target, got)
+		diffs, err = compareFiles(want.iter(""), got.iter(""), true)
+		got.Close()
+		if err != nil {
+			log.Fatalf("Error comparing with %s: %v", target, err)
+		}
+	} else {
+		carry, err := openCarry(target, client.fs, carryKeySource())
+		if err != nil {
+			log.Fatalf("Error reading carry manifest: %v", err)
+		}
+		if diffs, err = verifyCarried(want, carry); err != nil {
+			log.Fatalf("Error verifying %s: %v", target, err)
+		}
+	}
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	log.Printf("Found %d differences", len(diffs))
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
 }
 
 func main() {
 	flag.Parse()
+	client.compressUploads = *compressUploads
 
 	if flag.NArg() < 1 {
 		flag.Usage()
@@ -194,5 +632,11 @@ func main() {
 		fetch(ctx)
 	case "store":
 		store(ctx)
+	case "repair":
+		repair(ctx)
+	case "verify":
+		verify(ctx)
+	case "db":
+		dbCommand()
 	}
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dustin/bitfog"
+)
+
+var mapPath = flag.String("map", "",
+	"fetch, store, builddb: carry the sources described in this JSON file into one destination")
+
+// A mapSource is one area carried into a directory of the destination.
+type mapSource struct {
+	// Where the area is served.
+	URL string `json:"url"`
+	// The directory of the destination it goes in.
+	Dir string `json:"dir"`
+	// The DB describing it, for store.
+	DB string `json:"db"`
+}
+
+// A mapping fans several source areas into one destination.  A
+// single source is a mapping of one area into the top of the
+// destination.
+type mapping struct {
+	Sources []mapSource `json:"sources"`
+}
+
+func singleSource(u, db string) *mapping {
+	return &mapping{Sources: []mapSource{{URL: u, DB: db}}}
+}
+
+func loadMapping(p string) (*mapping, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	m := &mapping{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("error reading map %v: %v", p, err)
+	}
+	return m, m.check()
+}
+
+// check makes sure every source has somewhere of its own to go, and
+// tidies up directory names.
+func (m *mapping) check() error {
+	if len(m.Sources) == 0 {
+		return fmt.Errorf("no sources")
+	}
+	for i := range m.Sources {
+		s := &m.Sources[i]
+		dir := path.Clean(strings.Trim(s.Dir, "/"))
+		if s.URL == "" || s.DB == "" || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			return fmt.Errorf("source %d needs a url, a db and a dir", i)
+		}
+		s.Dir = dir + "/"
+		if !strings.HasSuffix(s.URL, "/") {
+			s.URL += "/"
+		}
+	}
+	for i, a := range m.Sources {
+		for _, b := range m.Sources[i+1:] {
+			if strings.HasPrefix(a.Dir, b.Dir) || strings.HasPrefix(b.Dir, a.Dir) {
+				return fmt.Errorf("%v and %v overlap", a.Dir, b.Dir)
+			}
+		}
+	}
+	return nil
+}
+
+// source finds the source a destination name comes from, and its name
+// there.
+func (m *mapping) source(name string) (int, string, bool) {
+	for i, s := range m.Sources {
+		if strings.HasPrefix(name, s.Dir) && name != s.Dir {
+			return i, name[len(s.Dir):], true
+		}
+	}
+	return 0, "", false
+}
+
+// keep reports whether a destination name is one of the sources'.
+// Anything else in the destination is left alone.
+func (m *mapping) keep(name string) bool {
+	_, _, ok := m.source(name)
+	return ok
+}
+
+// url returns where a destination name can be fetched from.
+func (m *mapping) url(name string) string {
+	i, rel, _ := m.source(name)
+	return m.Sources[i].URL + rel
+}
+
+// iter filters a destination listing down to what the sources cover.
+func (m *mapping) iter(it fileIter) fileIter {
+	if len(m.Sources) == 1 && m.Sources[0].Dir == "" {
+		return it
+	}
+	return &funcIter{it, m.keep}
+}
+
+// fetchHashes asks each source to hash its files among names.
+func (m *mapping) fetchHashes(ctx context.Context, names []string) (map[string]uint64, error) {
+	rels := make([][]string, len(m.Sources))
+	for _, name := range names {
+		if i, rel, ok := m.source(name); ok {
+			rels[i] = append(rels[i], rel)
+		}
+	}
+	rv := map[string]uint64{}
+	for i, s := range m.Sources {
+		if len(rels[i]) == 0 {
+			continue
+		}
+		hashes, err := fetchHashes(ctx, client, s.URL, rels[i])
+		if err != nil {
+			return nil, err
+		}
+		for rel, h := range hashes {
+			rv[s.Dir+rel] = h
+		}
+	}
+	return rv, nil
+}
+
+// A sourceSet is a listing of each source in a mapping, seen as one
+// listing of the destination.
+type sourceSet struct {
+	m   *mapping
+	dbs []*db
+}
+
+// openSources reads each source's listing from its server.
+func (m *mapping) openSources(ctx context.Context) (*sourceSet, error) {
+	ss := &sourceSet{m: m}
+	for _, s := range m.Sources {
+		d, err := fetchListing(ctx, client, s.URL)
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("error reading from %s: %v", s.URL, err)
+		}
+		ss.dbs = append(ss.dbs, d)
+	}
+	return ss, nil
+}
+
+// openSourceDbs reads each source's DB.
+func (m *mapping) openSourceDbs() (*sourceSet, error) {
+	ss := &sourceSet{m: m}
+	for _, s := range m.Sources {
+		d, err := openDb(s.DB)
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("error reading DB %s: %v", s.DB, err)
+		}
+		ss.dbs = append(ss.dbs, d)
+	}
+	return ss, nil
+}
+
+func (ss *sourceSet) Close() error {
+	for _, d := range ss.dbs {
+		d.Close()
+	}
+	return nil
+}
+
+// name describes where source i came from.
+func (ss *sourceSet) name(i int) string {
+	if ss.dbs[i].header.Source != "" {
+		return ss.dbs[i].header.Source
+	}
+	return ss.m.Sources[i].DB
+}
+
+// iter walks every source in destination name order.
+func (ss *sourceSet) iter() fileIter {
+	if len(ss.dbs) == 1 && ss.m.Sources[0].Dir == "" {
+		return ss.dbs[0].iter("")
+	}
+	its := make([]fileIter, len(ss.dbs))
+	for i, d := range ss.dbs {
+		its[i] = &prefixIter{d.iter(""), ss.m.Sources[i].Dir, uint64(i + 1)}
+	}
+	return newJoinIter(its)
+}
+
+// get looks up a file by its destination name.
+func (ss *sourceSet) get(name string) (bitfog.FileData, bool, error) {
+	i, rel, ok := ss.m.source(name)
+	if !ok {
+		return bitfog.FileData{}, false, nil
+	}
+	fd, ok, err := ss.dbs[i].get(rel)
+	fd.Name = name
+	return fd, ok, err
+}
+
+// prefixIter puts a source's files in its directory of the
+// destination.  Different sources may be on different machines, so
+// their device numbers are salted to keep their hard links apart.
+type prefixIter struct {
+	fileIter
+	prefix string
+	salt   uint64
+}
+
+func (p *prefixIter) file() bitfog.FileData {
+	fd := p.fileIter.file()
+	fd.Name = p.prefix + fd.Name
+	if fd.Nlink > 1 {
+		fd.Dev ^= p.salt << 48
+	}
+	return fd
+}
+
+// joinIter walks several listings with distinct names as one, in name
+// order.
+type joinIter struct {
+	its  []fileIter
+	more []bool
+	cur  int
+}
+
+func newJoinIter(its []fileIter) *joinIter {
+	m := &joinIter{its: its, more: make([]bool, len(its)), cur: -1}
+	for i, it := range its {
+		m.more[i] = it.next()
+	}
+	return m
+}
+
+func (m *joinIter) next() bool {
+	if m.cur >= 0 {
+		m.more[m.cur] = m.its[m.cur].next()
+	}
+	m.cur = -1
+	for i, it := range m.its {
+		if m.more[i] && (m.cur < 0 || it.file().Name < m.its[m.cur].file().Name) {
+			m.cur = i
+		}
+	}
+	return m.cur >= 0
+}
+
+func (m *joinIter) file() bitfog.FileData { return m.its[m.cur].file() }
+
+func (m *joinIter) err() error {
+	for _, it := range m.its {
+		if err := it.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// funcIter keeps only the files whose names keep approves of.
+type funcIter struct {
+	fileIter
+	keep func(string) bool
+}
+
+func (fi *funcIter) next() bool {
+	for fi.fileIter.next() {
+		if fi.keep(fi.file().Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestMappingCheck(t *testing.T) {
+	src := func(dir string) mapSource {
+		return mapSource{URL: "http://x/" + dir, Dir: dir, DB: dir + ".db"}
+	}
+	tests := []struct {
+		dirs []string
+		ok   bool
+	}{
+		{[]string{"a", "b"}, true},
+		{[]string{"/a/", "ab"}, true},
+		{[]string{"a/b", "a/c"}, true},
+		{[]string{"a", "a/b"}, false},
+		{[]string{"a/", "a"}, false},
+		{[]string{"a", ""}, false},
+		{[]string{"/"}, false},
+		{[]string{"../a"}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		m := &mapping{}
+		for _, d := range test.dirs {
+			m.Sources = append(m.Sources, src(d))
+		}
+		if err := m.check(); (err == nil) != test.ok {
+			t.Errorf("Checking %q = %v, expected ok=%v", test.dirs, err, test.ok)
+		}
+	}
+
+	m := &mapping{Sources: []mapSource{{URL: "http://x/a", Dir: "/docs/", DB: "a.db"}}}
+	if err := m.check(); err != nil {
+		t.Fatalf("Error checking: %v", err)
+	}
+	if got := m.url("docs/f"); got != "http://x/a/f" {
+		t.Errorf("Expected docs/f to come from http://x/a/f, got %v", got)
+	}
+	for name, exp := range map[string]bool{"docs/f": true, "docs/": false, "docs": false, "docsf": false, "f": false} {
+		if m.keep(name) != exp {
+			t.Errorf("Expected keep(%q) = %v", name, exp)
+		}
+	}
+}
+
+func TestSourceSet(t *testing.T) {
+	m := &mapping{Sources: []mapSource{
+		{URL: "http://x/a/", Dir: "a/", DB: "a.db"},
+		{URL: "http://y/b/", Dir: "b/", DB: "b.db"},
+	}}
+	dir := os.ModeDir | 0755
+	ss := &sourceSet{m: m, dbs: []*db{
+		memDb(t, map[string]bitfog.FileData{
+			"x":      {Size: 1, Dev: 1, Ino: 2, Nlink: 2},
+			"y":      {Size: 1, Dev: 1, Ino: 2, Nlink: 2},
+			"sub/":   {Mode: int32(dir)},
+			"sub/z":  {Size: 3},
+			"zz/top": {Size: 4},
+		}),
+		memDb(t, map[string]bitfog.FileData{
+			"x": {Size: 1, Dev: 1, Ino: 2, Nlink: 2},
+			"y": {Size: 2},
+		}),
+	}}
+	defer ss.Close()
+
+	var got []bitfog.FileData
+	it := ss.iter()
+	for it.next() {
+		got = append(got, it.file())
+	}
+	if err := it.err(); err != nil {
+		t.Fatalf("Error walking sources: %v", err)
+	}
+	exp := []string{"a/sub/", "a/sub/z", "a/x", "a/y", "a/zz/top", "b/x", "b/y"}
+	if !reflect.DeepEqual(names(got), exp) {
+		t.Errorf("Expected %v, got %v", exp, names(got))
+	}
+	// The same inode number on different sources isn't the same file.
+	if got[2].Dev != got[3].Dev || got[2].Dev == got[5].Dev {
+		t.Errorf("Expected a/x to be linked to a/y and not b/x: %+v", got)
+	}
+
+	fd, ok, err := ss.get("b/y")
+	if err != nil || !ok || fd.Name != "b/y" || fd.Size != 2 {
+		t.Errorf("Expected to find b/y, got %+v, %v, %v", fd, ok, err)
+	}
+	if _, ok, _ := ss.get("c/y"); ok {
+		t.Errorf("Expected not to find c/y")
+	}
+
+	// Anything in the destination outside the sources' directories is
+	// left alone.
+	dest := map[string]bitfog.FileData{
+		"a/y":     {Size: 1},
+		"a/stale": {Size: 1},
+		"b/x":     {Size: 1},
+		"c/mine":  {Size: 1},
+		"top":     {Size: 1},
+	}
+	c, err := changedFiles(ss.iter(), m.iter(mapIter(dest)), comparison{})
+	if err != nil {
+		t.Fatalf("Error comparing: %v", err)
+	}
+	if exp := []string{"a/stale"}; !reflect.DeepEqual(c.remove, exp) {
+		t.Errorf("Expected to remove %v, got %v", exp, c.remove)
+	}
+	if exp := []string{"a/sub/", "a/sub/z", "a/x", "a/zz/top", "b/y"}; !reflect.DeepEqual(names(c.add), exp) {
+		t.Errorf("Expected to add %v, got %v", exp, names(c.add))
+	}
+}
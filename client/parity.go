@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Files are protected a stripe at a time, each stripe being
+// parityDataShards shards of (at most) parityShardSize bytes.
+const (
+	parityDataShards = 16
+	parityShardSize  = 64 * 1024
+	parityMagic      = "BFPAR1\n"
+)
+
+var errUnrepairable = errors.New("too much damage to repair")
+
+// parityHeader starts every parity file.
+type parityHeader struct {
+	Size      uint64
+	Data      uint16
+	Parity    uint16
+	ShardSize uint32
+}
+
+func (h parityHeader) stripeSize() int64 {
+	return int64(h.Data) * int64(h.ShardSize)
+}
+
+func (h parityHeader) stripes() int64 {
+	return (int64(h.Size) + h.stripeSize() - 1) / h.stripeSize()
+}
+
+func makeShards(h parityHeader) [][]byte {
+	shards := make([][]byte, int(h.Data)+int(h.Parity))
+	for i := range shards {
+		shards[i] = make([]byte, h.ShardSize)
+	}
+	return shards
+}
+
+// readStripe fills the data shards from r, zero padding past the end
+// of the file, and reports which shards were cut short.
+func readStripe(r io.Reader, h parityHeader, shards [][]byte, remaining int64) ([]bool, error) {
+	short := make([]bool, h.Data)
+	for i := 0; i < int(h.Data); i++ {
+		want := int64(h.ShardSize)
+		if remaining < want {
+			want = remaining
+		}
+		if want < 0 {
+			want = 0
+		}
+		n, err := io.ReadFull(r, shards[i][:want])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		short[i] = int64(n) < want
+		for j := n; j < len(shards[i]); j++ {
+			shards[i][j] = 0
+		}
+		remaining -= want
+	}
+	return short, nil
+}
+
+// writeParity computes parity for the file at path and writes it to
+// parpath.
+func writeParity(path, parpath string, parity int) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Small files get small shards so the parity isn't mostly padding.
+	shardSize := (fi.Size() + parityDataShards - 1) / parityDataShards
+	if shardSize > parityShardSize {
+		shardSize = parityShardSize
+	}
+	if shardSize == 0 {
+		shardSize = 1
+	}
+	h := parityHeader{uint64(fi.Size()), parityDataShards, uint16(parity), uint32(shardSize)}
+	enc, err := reedsolomon.New(int(h.Data), int(h.Parity))
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(parpath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(out)
+	w.WriteString(parityMagic)
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	shards := makeShards(h)
+	for s := int64(0); s < h.stripes(); s++ {
+		if _, err := readStripe(r, h, shards, int64(h.Size)-s*h.stripeSize()); err != nil {
+			return err
+		}
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+		for _, shard := range shards {
+			binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(shard))
+		}
+		for _, shard := range shards[h.Data:] {
+			w.Write(shard)
+		}
+	}
+	return w.Flush()
+}
+
+// checkParity verifies the file at path against its parity, fixing
+// any damage in place if repair is set.  It returns the number of
+// damaged shards found.
+func checkParity(path, parpath string, repair bool) (int, error) {
+	pf, err := os.Open(parpath)
+	if err != nil {
+		return 0, err
+	}
+	defer pf.Close()
+	pr := bufio.NewReader(pf)
+
+	magic := make([]byte, len(parityMagic))
+	if _, err := io.ReadFull(pr, magic); err != nil || string(magic) != parityMagic {
+		return 0, fmt.Errorf("%v is not a parity file", parpath)
+	}
+	var h parityHeader
+	if err := binary.Read(pr, binary.BigEndian, &h); err != nil {
+		return 0, err
+	}
+	enc, err := reedsolomon.New(int(h.Data), int(h.Parity))
+	if err != nil {
+		return 0, err
+	}
+
+	flag := os.O_RDONLY
+	if repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	damaged := 0
+	r := bufio.NewReader(f)
+	shards := makeShards(h)
+	sums := make([]uint32, len(shards))
+	for s := int64(0); s < h.stripes(); s++ {
+		short, err := readStripe(r, h, shards, int64(h.Size)-s*h.stripeSize())
+		if err != nil {
+			return damaged, err
+		}
+		if err := binary.Read(pr, binary.BigEndian, sums); err != nil {
+			return damaged, fmt.Errorf("truncated parity file: %v", err)
+		}
+		for _, shard := range shards[h.Data:] {
+			if _, err := io.ReadFull(pr, shard); err != nil {
+				return damaged, fmt.Errorf("truncated parity file: %v", err)
+			}
+		}
+
+		bad := 0
+		for i, shard := range shards {
+			if (i < int(h.Data) && short[i]) || crc32.ChecksumIEEE(shard) != sums[i] {
+				shards[i] = nil
+				bad++
+			}
+		}
+		if bad > 0 {
+			damaged += bad
+			if repair {
+				if err := repairStripe(f, h, enc, shards, s, bad); err != nil {
+					return damaged, err
+				}
+			}
+		}
+		for i := range shards {
+			if shards[i] == nil {
+				shards[i] = make([]byte, h.ShardSize)
+			}
+		}
+	}
+
+	if fi.Size() > int64(h.Size) {
+		damaged++
+		if repair {
+			if err := f.Truncate(int64(h.Size)); err != nil {
+				return damaged, err
+			}
+		}
+	}
+	return damaged, nil
+}
+
+// repairStripe reconstructs the missing data shards of stripe s and
+// writes them back into f.
+func repairStripe(f *os.File, h parityHeader, enc reedsolomon.Encoder, shards [][]byte, s int64, bad int) error {
+	if bad > int(h.Parity) {
+		return errUnrepairable
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return err
+	}
+	off := s * h.stripeSize()
+	for i, shard := range shards[:h.Data] {
+		start := off + int64(i)*int64(h.ShardSize)
+		if start >= int64(h.Size) {
+			break
+		}
+		end := start + int64(len(shard))
+		if end > int64(h.Size) {
+			end = int64(h.Size)
+		}
+		if _, err := f.WriteAt(shard[:end-start], start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParityRepair(t *testing.T) {
+	dir := t.TempDir()
+	fn, par := filepath.Join(dir, "data"), filepath.Join(dir, "data.par")
+
+	for _, size := range []int{0, 1, parityShardSize, 3*parityDataShards*parityShardSize + 17} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		if err := ioutil.WriteFile(fn, data, 0666); err != nil {
+			t.Fatalf("Error writing data: %v", err)
+		}
+		if err := writeParity(fn, par, 2); err != nil {
+			t.Fatalf("size=%v: error writing parity: %v", size, err)
+		}
+		if n, err := checkParity(fn, par, false); err != nil || n != 0 {
+			t.Errorf("size=%v: expected undamaged, got %v/%v", size, n, err)
+		}
+		if size == 0 {
+			continue
+		}
+
+		damaged := append([]byte{}, data...)
+		damaged[0] ^= 0xff
+		if size > 1 {
+			damaged[len(damaged)-1] ^= 0xff
+		}
+		ioutil.WriteFile(fn, damaged, 0666)
+		if n, err := checkParity(fn, par, false); err != nil || n == 0 {
+			t.Errorf("size=%v: expected damage, got %v/%v", size, n, err)
+		}
+		if _, err := checkParity(fn, par, true); err != nil {
+			t.Errorf("size=%v: error repairing: %v", size, err)
+		}
+		if got, _ := ioutil.ReadFile(fn); !bytes.Equal(got, data) {
+			t.Errorf("size=%v: repair didn't restore data", size)
+		}
+
+		// Truncated files can be recovered, too.
+		os.Truncate(fn, int64(size-1))
+		if _, err := checkParity(fn, par, true); err != nil {
+			t.Errorf("size=%v: error repairing truncation: %v", size, err)
+		}
+		if got, _ := ioutil.ReadFile(fn); !bytes.Equal(got, data) {
+			t.Errorf("size=%v: repair didn't restore truncated data", size)
+		}
+	}
+}
+
+func TestParityUnrepairable(t *testing.T) {
+	dir := t.TempDir()
+	fn, par := filepath.Join(dir, "data"), filepath.Join(dir, "data.par")
+
+	data := make([]byte, parityDataShards*parityShardSize)
+	rand.New(rand.NewSource(42)).Read(data)
+	ioutil.WriteFile(fn, data, 0666)
+	if err := writeParity(fn, par, 1); err != nil {
+		t.Fatalf("Error writing parity: %v", err)
+	}
+
+	data[0] ^= 0xff
+	data[parityShardSize] ^= 0xff
+	ioutil.WriteFile(fn, data, 0666)
+	if _, err := checkParity(fn, par, true); err != errUnrepairable {
+		t.Errorf("Expected unrepairable damage, got %v", err)
+	}
+
+	ioutil.WriteFile(par, []byte("garbage"), 0666)
+	if _, err := checkParity(fn, par, false); err == nil {
+		t.Errorf("Expected error reading bad parity file")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+var priorityOrder = flag.String("priority", "largest",
+	"fetch, store: comma separated order to carry files in (largest, smallest, newest, outstanding)")
+var carryBudget = flag.String("budget", "",
+	"fetch: carry at most this much (e.g. 500M, 16G)")
+var profilePath = flag.String("profile", "",
+	"read -priority, -class and -budget settings from this JSON file")
+
+var priorityClasses patternList
+
+func init() {
+	flag.Var(&priorityClasses, "class",
+		"fetch, store: comma separated patterns of files to carry before others (may be repeated)")
+}
+
+// A profile holds carry settings so they needn't be given every
+// time.  Each class is a list of patterns, and earlier classes are
+// carried first.
+type profile struct {
+	Priority []string   `json:"priority,omitempty"`
+	Classes  [][]string `json:"classes,omitempty"`
+	Budget   string     `json:"budget,omitempty"`
+}
+
+// priorityPolicy decides the order files are carried in, and how many
+// of them fit.
+type priorityPolicy struct {
+	classes []*bitfog.Rules
+	order   []string
+	budget  int64
+
+	// When each outstanding file was first found missing, for the
+	// "outstanding" order.
+	firstSeen map[string]int64
+}
+
+var priorityOrders = map[string]func(p *priorityPolicy, a, b bitfog.FileData) int{
+	"largest": func(p *priorityPolicy, a, b bitfog.FileData) int {
+		return cmpInt64(b.Size, a.Size)
+	},
+	"smallest": func(p *priorityPolicy, a, b bitfog.FileData) int {
+		return cmpInt64(a.Size, b.Size)
+	},
+	"newest": func(p *priorityPolicy, a, b bitfog.FileData) int {
+		return cmpInt64(b.Mtime, a.Mtime)
+	},
+	"outstanding": func(p *priorityPolicy, a, b bitfog.FileData) int {
+		return cmpInt64(p.seen(a.Name), p.seen(b.Name))
+	},
+}
+
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func newPriorityPolicy(prof profile) (*priorityPolicy, error) {
+	p := &priorityPolicy{}
+	for _, o := range prof.Priority {
+		o = strings.TrimSpace(o)
+		if _, ok := priorityOrders[o]; !ok {
+			return nil, fmt.Errorf("unknown priority %q", o)
+		}
+		p.order = append(p.order, o)
+	}
+	for _, patterns := range prof.Classes {
+		r := &bitfog.Rules{}
+		for _, pat := range patterns {
+			if err := r.Add("", pat); err != nil {
+				return nil, err
+			}
+		}
+		p.classes = append(p.classes, r)
+	}
+	if prof.Budget != "" {
+		var err error
+		if p.budget, err = parseSize(prof.Budget); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// cliPriority combines the profile (if any) with whatever was given
+// on the command line.
+func cliPriority() (*priorityPolicy, error) {
+	var prof profile
+	if *profilePath != "" {
+		b, err := ioutil.ReadFile(*profilePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &prof); err != nil {
+			return nil, fmt.Errorf("error reading profile %v: %v", *profilePath, err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "priority":
+			prof.Priority = strings.Split(*priorityOrder, ",")
+		case "class":
+			prof.Classes = nil
+			for _, c := range priorityClasses {
+				prof.Classes = append(prof.Classes, strings.Split(c, ","))
+			}
+		case "budget":
+			prof.Budget = *carryBudget
+		}
+	})
+	if len(prof.Priority) == 0 {
+		prof.Priority = []string{"largest"}
+	}
+	return newPriorityPolicy(prof)
+}
+
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T
+// suffix.
+func parseSize(s string) (int64, error) {
+	num, mult := s, int64(1)
+	if s != "" {
+		if m, ok := sizeSuffixes[strings.ToUpper(s[len(s)-1:])[0]]; ok {
+			num, mult = s[:len(s)-1], m
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func (p *priorityPolicy) uses(order string) bool {
+	for _, o := range p.order {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *priorityPolicy) class(name string) int {
+	for i, r := range p.classes {
+		if r.Matches(name) {
+			return i
+		}
+	}
+	return len(p.classes)
+}
+
+// seen returns when a file was first found missing.  Those we don't
+// know about are treated as just found.
+func (p *priorityPolicy) seen(name string) int64 {
+	if t, ok := p.firstSeen[name]; ok {
+		return t
+	}
+	return math.MaxInt64
+}
+
+func sumSizes(fds []bitfog.FileData) int64 {
+	var total int64
+	for _, fd := range fds {
+		if fd.LinkTo == "" {
+			total += fd.Size
+		}
+	}
+	return total
+}
+
+// sort orders files by class, then by each order in turn, then by
+// name.
+func (p *priorityPolicy) sort(fds []bitfog.FileData) {
+	sort.SliceStable(fds, func(i, j int) bool {
+		a, b := fds[i], fds[j]
+		if c := cmpInt64(int64(p.class(a.Name)), int64(p.class(b.Name))); c != 0 {
+			return c < 0
+		}
+		for _, o := range p.order {
+			if c := priorityOrders[o](p, a, b); c != 0 {
+				return c < 0
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// limit returns as many files (in order) as fit in the budget.  Files
+// too big to fit are passed over so smaller ones behind them can
+// still go.  Hard links cost nothing, but only go with what they link
+// to.
+func (p *priorityPolicy) limit(fds []bitfog.FileData) (keep, skipped []bitfog.FileData) {
+	if p.budget <= 0 {
+		return fds, nil
+	}
+	remaining := p.budget
+	left := map[string]bool{}
+	for _, fd := range fds {
+		switch {
+		case fd.LinkTo != "":
+		case fd.Size <= remaining:
+			keep = append(keep, fd)
+			remaining -= fd.Size
+		default:
+			skipped = append(skipped, fd)
+			left[fd.Name] = true
+		}
+	}
+	for _, fd := range fds {
+		switch {
+		case fd.LinkTo == "":
+		case left[fd.LinkTo]:
+			skipped = append(skipped, fd)
+		default:
+			keep = append(keep, fd)
+		}
+	}
+	return keep, skipped
+}
+
+// loadOutstanding reads when each file was first found missing.
+func (p *priorityPolicy) loadOutstanding(path string) error {
+	p.firstSeen = map[string]int64{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &p.firstSeen)
+}
+
+// saveOutstanding records when each file still missing was first
+// found missing, forgetting those that aren't anymore.
+func (p *priorityPolicy) saveOutstanding(path string, fds []bitfog.FileData, now time.Time) error {
+	seen := make(map[string]int64, len(fds))
+	for _, fd := range fds {
+		if t, ok := p.firstSeen[fd.Name]; ok {
+			seen[fd.Name] = t
+		} else {
+			seen[fd.Name] = now.Unix()
+		}
+	}
+	p.firstSeen = seen
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(seen); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
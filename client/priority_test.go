@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+func names(fds []bitfog.FileData) []string {
+	var rv []string
+	for _, fd := range fds {
+		rv = append(rv, fd.Name)
+	}
+	return rv
+}
+
+func TestPrioritySort(t *testing.T) {
+	files := []bitfog.FileData{
+		{Name: "big.img", Size: 1000, Mtime: 1},
+		{Name: "docs/a.txt", Size: 10, Mtime: 3},
+		{Name: "docs/b.txt", Size: 20, Mtime: 2},
+		{Name: "old.db", Size: 100, Mtime: 5},
+		{Name: "tiny", Size: 1, Mtime: 4},
+	}
+	tests := []struct {
+		prof profile
+		exp  []string
+	}{
+		{profile{Priority: []string{"largest"}},
+			[]string{"big.img", "old.db", "docs/b.txt", "docs/a.txt", "tiny"}},
+		{profile{Priority: []string{"smallest"}},
+			[]string{"tiny", "docs/a.txt", "docs/b.txt", "old.db", "big.img"}},
+		{profile{Priority: []string{"newest"}},
+			[]string{"old.db", "tiny", "docs/a.txt", "docs/b.txt", "big.img"}},
+		{profile{Priority: []string{"largest"}, Classes: [][]string{{"docs/"}, {"*.db", "tiny"}}},
+			[]string{"docs/b.txt", "docs/a.txt", "old.db", "tiny", "big.img"}},
+		{profile{Priority: []string{"outstanding", "smallest"}},
+			[]string{"old.db", "docs/b.txt", "tiny", "docs/a.txt", "big.img"}},
+	}
+	for _, test := range tests {
+		p, err := newPriorityPolicy(test.prof)
+		if err != nil {
+			t.Fatalf("Error with %+v: %v", test.prof, err)
+		}
+		p.firstSeen = map[string]int64{"old.db": 1, "docs/b.txt": 2}
+		fds := append([]bitfog.FileData(nil), files...)
+		p.sort(fds)
+		if got := names(fds); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%+v: expected %v, got %v", test.prof, test.exp, got)
+		}
+	}
+
+	if _, err := newPriorityPolicy(profile{Priority: []string{"random"}}); err == nil {
+		t.Errorf("Expected an error for an unknown priority")
+	}
+}
+
+func TestPriorityBudget(t *testing.T) {
+	p, err := newPriorityPolicy(profile{Priority: []string{"largest"}, Budget: "1K"})
+	if err != nil {
+		t.Fatalf("Error making policy: %v", err)
+	}
+	fds := []bitfog.FileData{
+		{Name: "a", Size: 800},
+		{Name: "b", Size: 500},
+		{Name: "c", Size: 200},
+		{Name: "d", Size: 100},
+	}
+	keep, skipped := p.limit(fds)
+	if got, exp := names(keep), []string{"a", "c"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to keep %v, got %v", exp, got)
+	}
+	if got, exp := names(skipped), []string{"b", "d"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to skip %v, got %v", exp, got)
+	}
+
+	// Links are free, but stay with what they link to.
+	fds = append(fds,
+		bitfog.FileData{Name: "a2", Size: 800, LinkTo: "a"},
+		bitfog.FileData{Name: "b2", Size: 500, LinkTo: "b"},
+		bitfog.FileData{Name: "x2", Size: 500, LinkTo: "x"})
+	keep, skipped = p.limit(fds)
+	if got, exp := names(keep), []string{"a", "c", "a2", "x2"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to keep %v, got %v", exp, got)
+	}
+	if got, exp := names(skipped), []string{"b", "d", "b2"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected to skip %v, got %v", exp, got)
+	}
+	if got := sumSizes(skipped); got != 600 {
+		t.Errorf("Expected 600 bytes skipped, got %v", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp int64
+	}{
+		{"0", 0},
+		{"1234", 1234},
+		{"2k", 2048},
+		{"500M", 500 << 20},
+		{"16G", 16 << 30},
+		{"1T", 1 << 40},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.in)
+		if err != nil || got != test.exp {
+			t.Errorf("parseSize(%q) = %v, %v; expected %v", test.in, got, err, test.exp)
+		}
+	}
+	for _, in := range []string{"", "G", "-1", "1.5G", "12Q"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("Expected an error parsing %q", in)
+		}
+	}
+}
+
+func TestOutstanding(t *testing.T) {
+	d, err := ioutil.TempDir("", "outstanding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "dest.db.outstanding")
+
+	p := &priorityPolicy{}
+	if err := p.loadOutstanding(path); err != nil {
+		t.Fatalf("Error loading missing state: %v", err)
+	}
+	first := []bitfog.FileData{{Name: "a"}, {Name: "b"}}
+	if err := p.saveOutstanding(path, first, time.Unix(100, 0)); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+
+	p = &priorityPolicy{}
+	if err := p.loadOutstanding(path); err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	second := []bitfog.FileData{{Name: "b"}, {Name: "c"}}
+	if err := p.saveOutstanding(path, second, time.Unix(200, 0)); err != nil {
+		t.Fatalf("Error saving: %v", err)
+	}
+
+	p = &priorityPolicy{}
+	if err := p.loadOutstanding(path); err != nil {
+		t.Fatalf("Error loading: %v", err)
+	}
+	exp := map[string]int64{"b": 100, "c": 200}
+	if !reflect.DeepEqual(p.firstSeen, exp) {
+		t.Errorf("Expected %v, got %v", exp, p.firstSeen)
+	}
+}
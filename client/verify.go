@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dustin/bitfog"
+)
+
+// A difference between what a DB says should be somewhere and what's
+// actually there.
+type difference struct {
+	Name   string
+	Kind   string // missing, extra, mismatch or damaged
+	Detail string
+}
+
+func (d difference) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Name)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Kind, d.Name, d.Detail)
+}
+
+// mismatch describes how got differs from want, if at all.  Hashes
+// are only compared when both sides have one.
+func mismatch(want, got bitfog.FileData, modes bool) string {
+	switch {
+	case want.Size != got.Size:
+		return fmt.Sprintf("size %d != %d", want.Size, got.Size)
+	case want.Dest != got.Dest:
+		return fmt.Sprintf("link %q != %q", want.Dest, got.Dest)
+	case modes && want.Mode != got.Mode:
+		return fmt.Sprintf("mode %v != %v", os.FileMode(want.Mode), os.FileMode(got.Mode))
+	case want.Hash != 0 && got.Hash != 0 && want.Hash != got.Hash:
+		return fmt.Sprintf("hash %x != %x", want.Hash, got.Hash)
+	}
+	return ""
+}
+
+// compareFiles reports everything in got that doesn't agree with
+// want, walking both in name order.
+func compareFiles(want, got fileIter, modes bool) ([]difference, error) {
+	var rv []difference
+	w, g := want.next(), got.next()
+	for w || g {
+		switch {
+		case !w || (g && got.file().Name < want.file().Name):
+			rv = append(rv, difference{got.file().Name, "extra", ""})
+			g = got.next()
+		case !g || want.file().Name < got.file().Name:
+			rv = append(rv, difference{want.file().Name, "missing", ""})
+			w = want.next()
+		default:
+			if d := mismatch(want.file(), got.file(), modes); d != "" {
+				rv = append(rv, difference{want.file().Name, "mismatch", d})
+			}
+			w, g = want.next(), got.next()
+		}
+	}
+	if err := want.err(); err != nil {
+		return rv, err
+	}
+	return rv, got.err()
+}
+
+// describeCarried recomputes the size and hash of everything in a
+// carry directory.  Anything that can't be read is left out.
+func describeCarried(c *carryDir) (map[string]bitfog.FileData, map[string]error, error) {
+	names, err := c.names()
+	if err != nil {
+		return nil, nil, err
+	}
+	rv := map[string]bitfog.FileData{}
+	errs := map[string]error{}
+	for _, name := range names {
+		r, err := c.open(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		h := bitfog.NewHash()
+		n, err := io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		rv[name] = bitfog.FileData{Name: name, Size: n, Hash: h.Sum64()}
+	}
+	return rv, errs, nil
+}
+
+// verifyCarried compares a carry directory against a DB.  Only things
+// that were carried are expected to be there.
+func verifyCarried(want *db, c *carryDir) ([]difference, error) {
+	got, errs, err := describeCarried(c)
+	if err != nil {
+		return nil, err
+	}
+	var rv []difference
+	for name, g := range got {
+		w, ok, err := want.get(name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rv = append(rv, difference{name, "extra", ""})
+			continue
+		}
+		// Carried files have no mode, and the DB may not have a hash.
+		if w.Hash == 0 {
+			g.Hash = 0
+		}
+		if d := mismatch(w, g, false); d != "" {
+			rv = append(rv, difference{name, "mismatch", d})
+		}
+	}
+	for name, err := range errs {
+		rv = append(rv, difference{name, "missing", err.Error()})
+	}
+	for name := range got {
+		if damaged, err := c.check(name, false); err != nil || damaged > 0 {
+			rv = append(rv, difference{name, "damaged",
+				fmt.Sprintf("%d damaged shards %v", damaged, err)})
+		}
+	}
+	if c.tracked && !c.finished {
+		rv = append(rv, difference{filepath.Join(carryMeta, "manifest"), "damaged",
+			"unfinished: fetch was interrupted, or it's been cut short"})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestCompareFiles(t *testing.T) {
+	want := map[string]bitfog.FileData{
+		"same":   {Size: 1, Mode: 0644, Hash: 5},
+		"size":   {Size: 1, Mode: 0644},
+		"mode":   {Size: 1, Mode: 0644},
+		"link":   {Size: 1, Dest: "a"},
+		"hash":   {Size: 1, Hash: 5},
+		"nohash": {Size: 1, Hash: 5},
+		"gone":   {Size: 1},
+	}
+	got := map[string]bitfog.FileData{
+		"same":   {Size: 1, Mode: 0644, Hash: 5},
+		"size":   {Size: 2, Mode: 0644},
+		"mode":   {Size: 1, Mode: 0600},
+		"link":   {Size: 1, Dest: "b"},
+		"hash":   {Size: 1, Hash: 6},
+		"nohash": {Size: 1},
+		"new":    {Size: 1},
+	}
+
+	diffs, err := compareFiles(mapIter(want), mapIter(got), true)
+	if err != nil {
+		t.Fatalf("Error comparing: %v", err)
+	}
+
+	exp := []string{"missing: gone", "extra: new"}
+	var gotKinds []string
+	for _, d := range diffs {
+		if d.Kind != "mismatch" {
+			gotKinds = append(gotKinds, d.String())
+		}
+	}
+	if !reflect.DeepEqual(gotKinds, exp) {
+		t.Errorf("Expected %v, got %v", exp, gotKinds)
+	}
+
+	var mismatched []string
+	for _, d := range diffs {
+		if d.Kind == "mismatch" {
+			mismatched = append(mismatched, d.Name)
+		}
+	}
+	exp = []string{"hash", "link", "mode", "size"}
+	if !reflect.DeepEqual(mismatched, exp) {
+		t.Errorf("Expected mismatches %v, got %v", exp, mismatched)
+	}
+}
+
+func TestVerifyCarried(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a": "aye", "b": "be", "c": "sea"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+	}
+	c, err := openCarry(dir, posixFsOps, keySource{})
+	if err != nil {
+		t.Fatalf("Error opening carry: %v", err)
+	}
+	c.tracked, c.finished = true, true
+	c.entries = map[string]carryEntry{"a": {Name: "a"}, "b": {Name: "b"},
+		"c": {Name: "c"}, "d": {Name: "d"}}
+
+	h := bitfog.NewHash()
+	h.Write([]byte("aye"))
+	want := map[string]bitfog.FileData{
+		"a": {Size: 3, Hash: h.Sum64()},
+		"b": {Size: 3},
+		"d": {Size: 3},
+	}
+
+	diffs, err := verifyCarried(memDb(t, want), c)
+	if err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Kind+" "+d.Name)
+	}
+	exp := []string{"mismatch b", "extra c", "missing d"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestVerifyUntracked(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a": "aye", "b": "be", "sub/c": "sea", carryMeta + "/junk": "junk",
+	} {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0777)
+		ioutil.WriteFile(p, []byte(content), 0666)
+	}
+	c, err := openCarry(dir, posixFsOps, keySource{})
+	if err != nil {
+		t.Fatalf("Error opening carry: %v", err)
+	}
+
+	h := bitfog.NewHash()
+	h.Write([]byte("aye"))
+	want := map[string]bitfog.FileData{
+		"a":    {Size: 3, Hash: h.Sum64()},
+		"b":    {Size: 3},
+		"gone": {Size: 3},
+	}
+	diffs, err := verifyCarried(memDb(t, want), c)
+	if err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Kind+" "+d.Name)
+	}
+	exp := []string{"mismatch b", "extra sub/c"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	// Without a manifest, there's no telling what's in an encrypted
+	// carry directory.
+	c.keys = &carryKeys{}
+	if _, err := verifyCarried(memDb(t, want), c); err == nil {
+		t.Errorf("Expected an encrypted carry without a manifest to be refused")
+	}
+}
@@ -1,5 +1,21 @@
 package bitfog
 
+import (
+	"hash"
+	"hash/crc64"
+	"os"
+)
+
+// HashAlgorithm names the hash in FileData.Hash.
+const HashAlgorithm = "crc64-iso"
+
+var crcTable = crc64.MakeTable(crc64.ISO)
+
+// NewHash returns the hash used to compute FileData.Hash.
+func NewHash() hash.Hash64 {
+	return crc64.New(crcTable)
+}
+
 // FileData represents all the common metadata for a file.
 type FileData struct {
 	Name  string `json:"name,omitempty"`
@@ -8,10 +24,42 @@ type FileData struct {
 	Mtime int64  `json:"mtime"`
 	Hash  uint64 `json:"hash,omitempty"`
 	Dest  string `json:"linkdest,omitempty"`
+
+	// How many names a regular file has, and (if more than one) the
+	// device and inode that identify it, so hard links can be kept
+	// together.  Zero if unknown.
+	Nlink uint64 `json:"nlink,omitempty"`
+	Dev   uint64 `json:"dev,omitempty"`
+	Ino   uint64 `json:"ino,omitempty"`
+
+	// Ownership and extended attributes, if the area records them.
+	Meta *Meta `json:"meta,omitempty"`
+
+	// LinkTo names another file this one should be a hard link to.
+	// It's worked out when planning a transfer, not listed.
+	LinkTo string `json:"linkto,omitempty"`
+}
+
+// Meta is the ownership and extended attributes (which include ACLs)
+// of a file.
+type Meta struct {
+	Uid    int               `json:"uid"`
+	Gid    int               `json:"gid"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// IsDir reports whether fd describes a directory.  Directory names
+// end in a slash.
+func (fd FileData) IsDir() bool {
+	return os.FileMode(fd.Mode).IsDir()
 }
 
 // Equals reports whether a FileData object references the same file as another.
+// Directories have no content, so they're the same if their metadata is.
 func (fd FileData) Equals(other FileData) bool {
+	if fd.IsDir() || other.IsDir() {
+		return fd.Mode == other.Mode && fd.Mtime == other.Mtime
+	}
 	return fd.Size == other.Size &&
 		fd.Hash == other.Hash &&
 		fd.Dest == other.Dest
@@ -0,0 +1,20 @@
+package bitfog
+
+import "github.com/klauspost/compress/zstd"
+
+// CompressSample is how much of something to look at when deciding
+// whether it's worth compressing.
+const CompressSample = 64 * 1024
+
+// sampler compresses samples for Compressible.  EncodeAll is safe to
+// use concurrently, and the encoder is never closed.
+var sampler, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+
+// Compressible reports whether data that starts like sample is worth
+// compressing.
+func Compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	return len(sampler.EncodeAll(sample, nil)) < len(sample)*9/10
+}
@@ -0,0 +1,42 @@
+package bitfog
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestCompressible(t *testing.T) {
+	random := make([]byte, CompressSample)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name   string
+		sample []byte
+		exp    bool
+	}{
+		{"empty", nil, false},
+		{"text", bytes.Repeat([]byte("hello, world\n"), 1000), true},
+		{"random", random, false},
+	}
+	for _, test := range tests {
+		if got := Compressible(test.sample); got != test.exp {
+			t.Errorf("%v: expected %v, got %v", test.name, test.exp, got)
+		}
+	}
+
+	// The encoder's shared.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, test := range tests {
+				if got := Compressible(test.sample); got != test.exp {
+					t.Errorf("%v, concurrently: expected %v, got %v", test.name, test.exp, got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,168 @@
+package bitfog
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of files listing patterns to ignore in (and
+// below) the directory containing them.
+const IgnoreFile = ".bitfogignore"
+
+// Rules is a list of gitignore-style patterns.  When more than one
+// pattern matches a name, the last one wins.
+//
+// A pattern matches a name relative to the directory it was found in.
+// Patterns containing a slash (other than a trailing one) are anchored
+// to that directory, and others match at any depth.  A trailing slash
+// matches only directories, "*" and "?" match anything but a slash,
+// "**" matches across directories, and a leading "!" re-includes
+// something an earlier pattern matched.
+type Rules struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Add appends a pattern that applies to names under base, which is
+// either empty or ends in a slash.  Blank lines and comments are
+// ignored.
+func (r *Rules) Add(base, line string) error {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	p := pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return err
+	}
+	p.re = re
+	r.patterns = append(r.patterns, p)
+	return nil
+}
+
+// Read adds every pattern in r.
+func (r *Rules) Read(base string, rd io.Reader) error {
+	s := bufio.NewScanner(rd)
+	for s.Scan() {
+		if err := r.Add(base, s.Text()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				i++
+				if strings.HasPrefix(glob[i+1:], "/") {
+					// "**/" matches zero or more directories.
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 1 {
+				class := glob[i+1 : i+j]
+				if class[0] == '!' {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += j
+			} else {
+				b.WriteString(`\[`)
+			}
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// Clone returns a copy of r that can be added to without changing r.
+func (r *Rules) Clone() *Rules {
+	if r == nil {
+		return &Rules{}
+	}
+	return &Rules{append([]pattern(nil), r.patterns...)}
+}
+
+// Match reports whether the last pattern matching name (and isDir)
+// ignores it, and whether any pattern matched at all.
+func (r *Rules) Match(name string, isDir bool) (ignored, matched bool) {
+	if r == nil {
+		return false, false
+	}
+	for i := len(r.patterns) - 1; i >= 0; i-- {
+		p := r.patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if !strings.HasPrefix(name, p.base) {
+			continue
+		}
+		if p.re.MatchString(name[len(p.base):]) {
+			return !p.negate, true
+		}
+	}
+	return false, false
+}
+
+// Matches reports whether a file is ignored, either itself or because
+// a directory containing it is.
+func (r *Rules) Matches(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' {
+			if ignored, _ := r.Match(name[:i], true); ignored {
+				return true
+			}
+		}
+	}
+	ignored, _ := r.Match(name, false)
+	return ignored
+}
+
+// Empty reports whether there are no patterns at all.
+func (r *Rules) Empty() bool {
+	return r == nil || len(r.patterns) == 0
+}
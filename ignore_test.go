@@ -0,0 +1,66 @@
+package bitfog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	var r Rules
+	err := r.Read("", strings.NewReader(`
+# scratch files
+*.tmp
+!keep.tmp
+cache/
+/lock
+docs/**/*.bak
+\#literal
+`))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+	if err := r.Add("sub/", "local"); err != nil {
+		t.Fatalf("Error adding rule: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		ignored bool
+	}{
+		{"a.tmp", true},
+		{"x/y/a.tmp", true},
+		{"a.tmpl", false},
+		{"keep.tmp", false},
+		{"x/keep.tmp", false},
+		{"cache/thing", true},
+		{"x/cache/thing", true},
+		{"cache", false}, // only directories named cache
+		{"lock", true},
+		{"x/lock", false},
+		{"docs/a.bak", true},
+		{"docs/x/y/a.bak", true},
+		{"other/a.bak", false},
+		{"#literal", true},
+		{"local", false},
+		{"sub/local", true},
+		{"sub/x/local", true},
+		{"subx/local", false},
+	}
+	for _, test := range tests {
+		if got := r.Matches(test.name); got != test.ignored {
+			t.Errorf("%v: expected ignored=%v, got %v", test.name, test.ignored, got)
+		}
+	}
+}
+
+func TestRulesEmpty(t *testing.T) {
+	var r *Rules
+	if !r.Empty() || r.Matches("anything") {
+		t.Errorf("Expected nil rules to match nothing")
+	}
+	c := r.Clone()
+	c.Add("", "*")
+	if !c.Matches("anything") || !r.Empty() {
+		t.Errorf("Expected clone to be independent")
+	}
+}
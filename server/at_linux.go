@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// renameAt moves from, in the directory open as fromDir, to to, in
+// toDir.  Neither directory can be swapped for a symlink once it's
+// open, so this is how things move between an area and its trash.
+func renameAt(fromDir *os.File, from string, toDir *os.File, to string) error {
+	err := syscall.Renameat(int(fromDir.Fd()), from, int(toDir.Fd()), to)
+	if err != nil {
+		return &os.LinkError{Op: "renameat", Old: from, New: to, Err: err}
+	}
+	return nil
+}
+
+// linkAt is renameAt for making hard links.
+func linkAt(fromDir *os.File, from string, toDir *os.File, to string) error {
+	oldp, err := syscall.BytePtrFromString(from)
+	if err != nil {
+		return err
+	}
+	newp, err := syscall.BytePtrFromString(to)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT,
+		fromDir.Fd(), uintptr(unsafe.Pointer(oldp)),
+		toDir.Fd(), uintptr(unsafe.Pointer(newp)), 0, 0)
+	if errno != 0 {
+		return &os.LinkError{Op: "linkat", Old: from, New: to, Err: errno}
+	}
+	return nil
+}
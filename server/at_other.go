@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// renameAt moves from, in fromDir, to to, in toDir.  There's no way
+// to do that relative to the open directories here, so it's done by
+// name.
+func renameAt(fromDir *os.File, from string, toDir *os.File, to string) error {
+	return os.Rename(filepath.Join(fromDir.Name(), from), filepath.Join(toDir.Name(), to))
+}
+
+// linkAt is renameAt for making hard links.
+func linkAt(fromDir *os.File, from string, toDir *os.File, to string) error {
+	return os.Link(filepath.Join(fromDir.Name(), from), filepath.Join(toDir.Name(), to))
+}
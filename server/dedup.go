@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+// dedupConf describes an area whose content is kept as
+// content-addressed chunks rather than as a tree of files.
+type dedupConf struct {
+	Path string `json:"path"`
+
+	store *dedupStore
+}
+
+type dedupEntry struct {
+	bitfog.FileData
+	Chunks []string
+}
+
+// dedupStore is a chunk directory plus an index mapping names to the
+// chunks that make them up.
+//
+// The index is kept in two parts: a snapshot of the whole thing, and a
+// journal of changes made since, one JSON record per line.  Each change
+// is synced to the journal before it's acknowledged, and once the
+// journal's grown as big as the index, the index is written out again
+// and the journal emptied.
+type dedupStore struct {
+	path string
+
+	// Anything writing chunks holds gcLock for reading so garbage
+	// collection doesn't sweep chunks not yet in the index.
+	gcLock sync.RWMutex
+
+	mu      sync.Mutex
+	index   map[string]dedupEntry
+	journal *os.File
+	// How many records, and how many bytes, are in the journal.
+	journaled   int
+	journalSize int64
+}
+
+// A journalRecord is a change to the index: the new entry for a name,
+// or no entry if it was removed.
+type journalRecord struct {
+	Name  string      `json:"name"`
+	Entry *dedupEntry `json:"entry,omitempty"`
+}
+
+// The journal isn't compacted until it has at least this many records,
+// however small the index.
+var minCompaction = 1000
+
+func openDedup(path string) (*dedupStore, error) {
+	ds := &dedupStore{path: path, index: map[string]dedupEntry{}}
+	if err := os.MkdirAll(filepath.Join(path, "chunks"), 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(ds.indexPath())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		err = gob.NewDecoder(f).Decode(&ds.index)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %v: %v", ds.indexPath(), err)
+		}
+	}
+	return ds, ds.replay()
+}
+
+func (ds *dedupStore) indexPath() string {
+	return filepath.Join(ds.path, "index")
+}
+
+func (ds *dedupStore) journalPath() string {
+	return filepath.Join(ds.path, "journal")
+}
+
+// replay applies the journal to the index, and opens it for more.  A
+// record cut short by a crash was never acknowledged, so it's dropped.
+func (ds *dedupStore) replay() error {
+	f, err := os.OpenFile(ds.journalPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			err = nil
+			if len(line) > 0 {
+				log.Printf("Dropping an unfinished change at the end of %v", ds.journalPath())
+				err = f.Truncate(ds.journalSize)
+			}
+			if err == nil {
+				ds.journal = f
+				// The journal may have only just been created.
+				return syncDir(ds.path)
+			}
+		}
+		if err == nil {
+			var rec journalRecord
+			if err = json.Unmarshal(line, &rec); err == nil {
+				ds.apply(rec)
+				ds.journaled++
+				ds.journalSize += int64(len(line))
+				continue
+			}
+			err = fmt.Errorf("error reading %v at %v: %v", ds.journalPath(), ds.journalSize, err)
+		}
+		f.Close()
+		return err
+	}
+}
+
+func (ds *dedupStore) apply(rec journalRecord) {
+	if rec.Entry == nil {
+		delete(ds.index, rec.Name)
+	} else {
+		ds.index[rec.Name] = *rec.Entry
+	}
+}
+
+// record makes a change to the index once it's safely in the journal.
+// Must be called with mu held.
+func (ds *dedupStore) record(rec journalRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := ds.journal.Write(b); err == nil {
+		err = ds.journal.Sync()
+	}
+	if err != nil {
+		// Don't leave half a record for the next one to follow.
+		ds.journal.Truncate(ds.journalSize)
+		return err
+	}
+	ds.apply(rec)
+	ds.journaled++
+	ds.journalSize += int64(len(b))
+	if ds.journaled >= minCompaction && ds.journaled >= len(ds.index) {
+		if err := ds.compact(); err != nil {
+			// The journal still has everything.
+			log.Printf("Error compacting %v: %v", ds.journalPath(), err)
+		}
+	}
+	return nil
+}
+
+// compact writes out the whole index and empties the journal.  Must
+// be called with mu held.
+func (ds *dedupStore) compact() error {
+	f, err := ioutil.TempFile(ds.path, "index.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(ds.index)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), ds.indexPath())
+	}
+	if err == nil {
+		err = syncDir(ds.path)
+	}
+	if err != nil {
+		return err
+	}
+	// Replaying what's already in the index changes nothing, so a
+	// crash before this is harmless.
+	if err := ds.journal.Truncate(0); err != nil {
+		return err
+	}
+	ds.journaled, ds.journalSize = 0, 0
+	return ds.journal.Sync()
+}
+
+// Close closes the journal.
+func (ds *dedupStore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.journal.Close()
+}
+
+// syncDir makes the names in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (ds *dedupStore) chunkPath(id string) string {
+	return filepath.Join(ds.path, "chunks", id[:2], id)
+}
+
+func (ds *dedupStore) lookup(name string) (dedupEntry, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	e, ok := ds.index[name]
+	return e, ok
+}
+
+// hash returns the entry for a file, hashing its chunks if it wasn't
+// stored with a checksum.
+func (ds *dedupStore) hash(name string) (bitfog.FileData, bool) {
+	e, ok := ds.lookup(name)
+	if !ok || e.Dest != "" || e.IsDir() {
+		return e.FileData, false
+	}
+	if e.Hash != 0 || e.Size == 0 {
+		return e.FileData, true
+	}
+	h := bitfog.NewHash()
+	for _, id := range e.Chunks {
+		f, err := os.Open(ds.chunkPath(id))
+		if err != nil {
+			log.Printf("Error opening chunk %s of %s: %v", id, name, err)
+			return e.FileData, false
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			log.Printf("Error reading chunk %s of %s: %v", id, name, err)
+			return e.FileData, false
+		}
+	}
+	e.Hash = h.Sum64()
+	return e.FileData, true
+}
+
+func (ds *dedupStore) set(name string, e dedupEntry) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.record(journalRecord{Name: name, Entry: &e})
+}
+
+// errDirNotEmpty is returned by remove for a directory with something
+// in it.
+var errDirNotEmpty = errors.New("directory not empty")
+
+// remove forgets name.  A directory may be named without its trailing
+// slash, as it would be in a plain area.
+func (ds *dedupStore) remove(name string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	e, ok := ds.index[name]
+	if !ok && !strings.HasSuffix(name, "/") {
+		name += "/"
+		e, ok = ds.index[name]
+	}
+	if !ok {
+		return os.ErrNotExist
+	}
+	if e.IsDir() {
+		for k := range ds.index {
+			if strings.HasPrefix(k, name) && k != name {
+				return errDirNotEmpty
+			}
+		}
+	}
+	return ds.record(journalRecord{Name: name})
+}
+
+// setMeta gives an entry the mode and mtime in fd, and its ownership
+// and extended attributes if withMeta.  Symlinks only get their
+// ownership.
+func (ds *dedupStore) setMeta(name string, fd bitfog.FileData, withMeta bool) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	e, ok := ds.index[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if withMeta && fd.Meta != nil {
+		e.Meta = fd.Meta
+	}
+	if e.Dest == "" && fd.Mode != 0 {
+		mode := os.FileMode(e.Mode)&os.ModeType | os.FileMode(fd.Mode)&^os.ModeType
+		e.Mode, e.Mtime = int32(mode), fd.Mtime
+	}
+	return ds.record(journalRecord{Name: name, Entry: &e})
+}
+
+// mkdir records a directory, with the mode and mtime in fd if it has
+// them.  A file of the same name is replaced.
+func (ds *dedupStore) mkdir(name string, fd bitfog.FileData, withMeta bool) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	mode, mtime := os.FileMode(0755), time.Now().Unix()
+	if fd.Mode != 0 {
+		mode, mtime = os.FileMode(fd.Mode)&^os.ModeType, fd.Mtime
+	}
+	e := dedupEntry{FileData: bitfog.FileData{
+		Name:  name,
+		Mode:  int32(os.ModeDir | mode),
+		Mtime: mtime,
+	}}
+	if withMeta {
+		e.Meta = fd.Meta
+	}
+	file := strings.TrimSuffix(name, "/")
+	if _, ok := ds.index[file]; ok {
+		if err := ds.record(journalRecord{Name: file}); err != nil {
+			return err
+		}
+	}
+	return ds.record(journalRecord{Name: name, Entry: &e})
+}
+
+func (ds *dedupStore) putChunk(b []byte) (string, error) {
+	id := bitfog.ChunkID(b)
+	p := ds.chunkPath(id)
+	if _, err := os.Stat(p); err == nil {
+		return id, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+id)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, os.Rename(f.Name(), p)
+}
+
+// store chunks up everything from r and records it under name, with
+// the given ownership and extended attributes.  Its mode and mtime are
+// whatever a new file would get, until they're set with setMeta.
+func (ds *dedupStore) store(name string, r io.Reader, checksum bool, meta *bitfog.Meta) error {
+	ds.gcLock.RLock()
+	defer ds.gcLock.RUnlock()
+
+	e := dedupEntry{FileData: bitfog.FileData{
+		Name:  name,
+		Mode:  0644,
+		Mtime: time.Now().Unix(),
+		Meta:  meta,
+	}}
+	h := bitfog.NewHash()
+	c := bitfog.NewChunker(io.TeeReader(r, h))
+	dirs := map[string]bool{}
+	for {
+		b, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id, err := ds.putChunk(b)
+		if err != nil {
+			return err
+		}
+		e.Chunks = append(e.Chunks, id)
+		e.Size += int64(len(b))
+		dirs[filepath.Dir(ds.chunkPath(id))] = true
+	}
+	if checksum {
+		e.Hash = h.Sum64()
+	}
+	// The chunks have to last as long as the index entry using them.
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return ds.set(name, e)
+}
+
+// gc removes every chunk not referenced by the index, returning the
+// number of chunks removed.
+func (ds *dedupStore) gc() (int, error) {
+	ds.gcLock.Lock()
+	defer ds.gcLock.Unlock()
+
+	live := map[string]bool{}
+	ds.mu.Lock()
+	for _, e := range ds.index {
+		for _, id := range e.Chunks {
+			live[id] = true
+		}
+	}
+	ds.mu.Unlock()
+
+	removed := 0
+	err := filepath.Walk(filepath.Join(ds.path, "chunks"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if !live[info.Name()] {
+			removed++
+			return os.Remove(p)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// dedupName validates a name within a dedup area.
+func dedupName(subpath string) (string, *fileError) {
+	name := filepath.Clean(subpath)
+	if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", &fileError{http.StatusBadRequest, "No"}
+	}
+	return name, nil
+}
+
+func listDedup(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	ds := conf.Dedup.store
+	after := req.FormValue("after")
+	// Older clients don't know what to do with directories.
+	dirs := req.FormValue("dirs") != ""
+	ds.mu.Lock()
+	names := make([]string, 0, len(ds.index))
+	for k, e := range ds.index {
+		if e.IsDir() && !dirs {
+			continue
+		}
+		if k > after && !conf.exclude.Matches(k) {
+			names = append(names, k)
+		}
+	}
+	ds.mu.Unlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(listingOrderHeader, listOrder)
+	e := json.NewEncoder(w)
+	for _, name := range names {
+		if de, ok := ds.lookup(name); ok {
+			e.Encode(de.FileData)
+		}
+	}
+}
+
+func handleDedupPath(conf itemConf, subpath string, w http.ResponseWriter, req *http.Request) {
+	ds := conf.Dedup.store
+	switch {
+	case subpath == "" && req.FormValue("gc") != "" && req.Method == "POST":
+		n, err := ds.gc()
+		if err != nil {
+			log.Printf("Error collecting garbage in %s: %v", ds.path, err)
+			http.Error(w, "error collecting garbage: "+err.Error(), 500)
+			return
+		}
+		log.Printf("Removed %d unreferenced chunks from %s", n, ds.path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"removed": n})
+		return
+	case subpath == "" && req.FormValue("hash") != "" && req.Method == "POST":
+		log.Printf("Hashing files in %s", ds.path)
+		hashFiles(conf, w, req, ds.hash)
+		return
+	case subpath == "" && (req.FormValue("snapshot") != "" || req.FormValue("snapshots") != ""):
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No snapshots here.\n")
+		return
+	case subpath == "":
+		log.Printf("Listing %s", ds.path)
+		listDedup(conf, w, req)
+		return
+	}
+
+	name, ferr := dedupName(subpath)
+	if ferr != nil {
+		w.WriteHeader(ferr.status)
+		fmt.Fprintf(w, "%s\n", ferr.msg)
+		return
+	}
+	// Directory names end in a slash, as they're listed.
+	if strings.HasSuffix(subpath, "/") ||
+		(req.Method == "PUT" && req.Header.Get("Content-Type") == "application/directory") {
+		name += "/"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if req.Method == "PATCH" || req.FormValue("rdiff") != "" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Dedup areas don't support rdiff.\n")
+		return
+	}
+
+	if req.Method != "GET" && !conf.Writable {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Can't %s here.\n", req.Method)
+		return
+	}
+
+	switch req.Method {
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "Can't %s here.\n", req.Method)
+	case "GET":
+		e, ok := ds.lookup(name)
+		if !ok || e.Dest != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error getting file info.\n")
+			return
+		}
+		if e.IsDir() {
+			w.WriteHeader(errNotFile.status)
+			fmt.Fprintf(w, "%s\n", errNotFile.msg)
+			return
+		}
+		log.Printf("Getting %s from chunks", name)
+		for _, id := range e.Chunks {
+			f, err := os.Open(ds.chunkPath(id))
+			if err != nil {
+				log.Printf("Error opening chunk %s of %s: %v", id, name, err)
+				return
+			}
+			_, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				log.Printf("Error streaming file: %v", err)
+				return
+			}
+		}
+	case "POST":
+		if req.FormValue("meta") == "" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "Can't %s here.\n", req.Method)
+			return
+		}
+		var fd bitfog.FileData
+		if err := json.NewDecoder(req.Body).Decode(&fd); err != nil {
+			http.Error(w, "Error reading metadata: "+err.Error(), 400)
+			return
+		}
+		switch err := ds.setMeta(name, fd, conf.Metadata); {
+		case os.IsNotExist(err):
+			http.Error(w, "No such file", 404)
+			return
+		case err != nil:
+			log.Printf("Problem setting metadata of %s: %v", name, err)
+			http.Error(w, "Error setting metadata: "+err.Error(), 500)
+			return
+		}
+		log.Printf("Updated metadata of %s", name)
+		w.WriteHeader(204)
+	case "PUT":
+		meta, ferr := readMeta(req)
+		if ferr != nil {
+			http.Error(w, ferr.msg, ferr.status)
+			return
+		}
+		if !conf.Metadata {
+			meta = nil
+		}
+		switch ctype := req.Header.Get("Content-Type"); ctype {
+		default:
+			http.Error(w, "invalid content type: "+ctype, 400)
+			return
+		case "application/directory":
+			var fd bitfog.FileData
+			if err := json.NewDecoder(req.Body).Decode(&fd); err != nil && err != io.EOF {
+				http.Error(w, "Error reading directory body: "+err.Error(), 400)
+				return
+			}
+			if err := ds.mkdir(name, fd, conf.Metadata); err != nil {
+				log.Printf("Problem creating directory %s: %v", name, err)
+				http.Error(w, "Error creating directory: "+err.Error(), 500)
+				return
+			}
+			log.Printf("Created directory %s", name)
+		case "application/octet-stream":
+			if err := ds.store(name, req.Body, conf.Checksum, meta); err != nil {
+				log.Printf("Problem storing %s: %v", name, err)
+				http.Error(w, "error writing data: "+err.Error(), 500)
+				return
+			}
+			log.Printf("Stored %s as chunks", name)
+		case "application/symlink":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, "Error reading symlink body: "+err.Error(), 400)
+				return
+			}
+			// There's no tree on disk, so pretend there is.
+			if ferr := checkSymlink(conf, "/dedup", "/dedup/"+name, string(body)); ferr != nil {
+				http.Error(w, ferr.msg, ferr.status)
+				return
+			}
+			e := dedupEntry{FileData: bitfog.FileData{
+				Name:  name,
+				Size:  int64(len(body)),
+				Mode:  int32(os.ModeSymlink | 0777),
+				Mtime: time.Now().Unix(),
+				Dest:  string(body),
+				Meta:  meta,
+			}}
+			if err := ds.set(name, e); err != nil {
+				http.Error(w, "Error creating symlink: "+err.Error(), 500)
+				return
+			}
+			log.Printf("Created symlink: %v -> %v", name, e.Dest)
+		case "application/hardlink":
+			// Content is shared anyway, so a link is just another
+			// name for the same chunks.
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, "Error reading hardlink body: "+err.Error(), 400)
+				return
+			}
+			target, ferr := dedupName(string(body))
+			if ferr != nil {
+				http.Error(w, ferr.msg, ferr.status)
+				return
+			}
+			e, ok := ds.lookup(target)
+			if !ok || e.Dest != "" || e.IsDir() {
+				http.Error(w, "Can't link to "+target, 400)
+				return
+			}
+			e.Name = name
+			if err := ds.set(name, e); err != nil {
+				http.Error(w, "Error creating hardlink: "+err.Error(), 500)
+				return
+			}
+			log.Printf("Created hardlink: %v -> %v", name, target)
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		if err := ds.remove(name); err == errDirNotEmpty {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "Directory not empty.\n")
+			return
+		} else if os.IsNotExist(err) {
+			http.Error(w, "No such file: "+name, http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error deleting:  %v", err)
+			http.Error(w, "Error deleting file: "+err.Error(), 500)
+			return
+		}
+		log.Printf("Deleted %s", name)
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func testDedupArea(t *testing.T) itemConf {
+	dir := filepath.Join(t.TempDir(), "dedup")
+	ds, err := openDedup(dir)
+	if err != nil {
+		t.Fatalf("Error opening dedup store: %v", err)
+	}
+	dc := &dedupConf{Path: dir, store: ds}
+	t.Cleanup(func() { dc.store.Close() })
+	return itemConf{Writable: true, Checksum: true, Dedup: dc}
+}
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func putDedup(t *testing.T, conf itemConf, name string, content []byte) {
+	t.Helper()
+	expectStatus(t, "storing "+name, serve(conf, "PUT", name, string(content),
+		"Content-Type", "application/octet-stream"), 204)
+}
+
+func expectDedup(t *testing.T, conf itemConf, name string, content []byte) {
+	t.Helper()
+	w := serve(conf, "GET", name, "")
+	expectStatus(t, "getting "+name, w, 200)
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("Expected %v back as it was stored, got %v bytes", name, w.Body.Len())
+	}
+}
+
+func countChunks(t *testing.T, conf itemConf) int {
+	n := 0
+	filepath.Walk(filepath.Join(conf.Dedup.Path, "chunks"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	return n
+}
+
+func TestDedupRoundTrip(t *testing.T) {
+	conf := testDedupArea(t)
+	big := randomBytes(1, 3<<20)
+	putDedup(t, conf, "a/big", big)
+	putDedup(t, conf, "empty", nil)
+	expectDedup(t, conf, "a/big", big)
+	expectDedup(t, conf, "empty", nil)
+	expectStatus(t, "getting a missing file", serve(conf, "GET", "nope", ""), 400)
+
+	fd, ok := conf.Dedup.store.hash("a/big")
+	if !ok || fd.Size != int64(len(big)) || fd.Hash == 0 {
+		t.Errorf("Expected a/big to be listed with its size and hash, got %+v", fd)
+	}
+}
+
+func TestDedupSharedChunks(t *testing.T) {
+	conf := testDedupArea(t)
+	big := randomBytes(1, 3<<20)
+	putDedup(t, conf, "a", big)
+	n := countChunks(t, conf)
+	if n < 2 {
+		t.Fatalf("Expected several chunks, got %v", n)
+	}
+	// The same content again, and with a little more on the end.
+	putDedup(t, conf, "b", big)
+	putDedup(t, conf, "c", append(append([]byte{}, big...), "more"...))
+	if got := countChunks(t, conf); got != n+1 {
+		t.Errorf("Expected only c's last chunk to be new, got %v chunks after %v", got, n)
+	}
+	expectDedup(t, conf, "b", big)
+}
+
+func TestDedupGC(t *testing.T) {
+	conf := testDedupArea(t)
+	shared, mine := randomBytes(1, 2<<20), randomBytes(2, 2<<20)
+	putDedup(t, conf, "keep", shared)
+	putDedup(t, conf, "gone", append(append([]byte{}, shared...), mine...))
+	before := countChunks(t, conf)
+
+	expectStatus(t, "deleting", serve(conf, "DELETE", "gone", ""), 204)
+	expectStatus(t, "deleting again", serve(conf, "DELETE", "gone", ""), 404)
+	if got := countChunks(t, conf); got != before {
+		t.Errorf("Expected chunks to stay until collected, got %v of %v", got, before)
+	}
+	n, err := conf.Dedup.store.gc()
+	if err != nil || n == 0 || countChunks(t, conf) != before-n {
+		t.Errorf("Expected gone's own chunks to be collected, got %v, %v", n, err)
+	}
+	expectDedup(t, conf, "keep", shared)
+	if n, err := conf.Dedup.store.gc(); err != nil || n != 0 {
+		t.Errorf("Expected nothing more to collect, got %v, %v", n, err)
+	}
+}
+
+func TestDedupReopen(t *testing.T) {
+	defer func(n int) { minCompaction = n }(minCompaction)
+	conf := testDedupArea(t)
+	a, b := randomBytes(1, 100000), randomBytes(2, 100000)
+
+	reopen := func() {
+		t.Helper()
+		conf.Dedup.store.Close()
+		ds, err := openDedup(conf.Dedup.Path)
+		if err != nil {
+			t.Fatalf("Error reopening: %v", err)
+		}
+		conf.Dedup.store = ds
+	}
+
+	// Everything's in the journal.
+	putDedup(t, conf, "a", a)
+	putDedup(t, conf, "b", b)
+	expectStatus(t, "deleting b", serve(conf, "DELETE", "b", ""), 204)
+	reopen()
+	expectDedup(t, conf, "a", a)
+	if _, ok := conf.Dedup.store.lookup("b"); ok {
+		t.Errorf("Expected b to stay deleted")
+	}
+
+	// A change cut short is dropped.
+	f, err := os.OpenFile(conf.Dedup.store.journalPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"name":"half`)
+	f.Close()
+	reopen()
+	expectDedup(t, conf, "a", a)
+	putDedup(t, conf, "b", b)
+	reopen()
+	expectDedup(t, conf, "b", b)
+
+	// Once the journal's compacted, it all comes from the index.
+	minCompaction = 1
+	putDedup(t, conf, "c", a)
+	if fi, err := os.Stat(conf.Dedup.store.journalPath()); err != nil || fi.Size() != 0 {
+		t.Errorf("Expected the journal to be emptied, got %v, %v", fi, err)
+	}
+	reopen()
+	for name, content := range map[string][]byte{"a": a, "b": b, "c": a} {
+		expectDedup(t, conf, name, content)
+	}
+}
+
+func TestDedupMeta(t *testing.T) {
+	conf := testDedupArea(t)
+	conf.Metadata = true
+	ds := conf.Dedup.store
+
+	expectStatus(t, "storing a", serve(conf, "PUT", "a", "hello",
+		"Content-Type", "application/octet-stream", metaHeader, `{"uid": 1, "gid": 2}`), 204)
+	expectStatus(t, "updating a", serve(conf, "POST", "a?meta=1", `{"mode": 384, "mtime": 1000}`), 204)
+	e, _ := ds.lookup("a")
+	if e.Mode != 0600 || e.Mtime != 1000 || e.Meta == nil || e.Meta.Uid != 1 || e.Meta.Gid != 2 {
+		t.Errorf("Expected a to have its metadata, got %+v (%+v)", e.FileData, e.Meta)
+	}
+	expectStatus(t, "updating a missing file", serve(conf, "POST", "nope?meta=1", `{"mode": 384}`), 404)
+
+	dir := os.ModeDir | 0700
+	expectStatus(t, "creating d/", serve(conf, "PUT", "d/",
+		fmt.Sprintf(`{"mode": %d, "mtime": 5}`, int32(dir)),
+		"Content-Type", "application/directory"), 204)
+	if e, ok := ds.lookup("d/"); !ok || e.Mode != int32(dir) || e.Mtime != 5 {
+		t.Errorf("Expected d/ to be recorded, got %+v", e.FileData)
+	}
+	expectStatus(t, "storing d/x", serve(conf, "PUT", "d/x", "x",
+		"Content-Type", "application/octet-stream"), 204)
+	expectStatus(t, "getting d/", serve(conf, "GET", "d/", ""), 400)
+
+	for q, exp := range map[string]string{"": "a d/x", "?dirs=1": "a d/ d/x"} {
+		w := serve(conf, "GET", q, "")
+		expectStatus(t, "listing", w, 200)
+		var names []string
+		for d := json.NewDecoder(w.Body); d.More(); {
+			var fd bitfog.FileData
+			if err := d.Decode(&fd); err != nil {
+				t.Fatalf("Error decoding listing: %v", err)
+			}
+			names = append(names, fd.Name)
+		}
+		if strings.Join(names, " ") != exp {
+			t.Errorf("Expected listing%v to be %v, got %v", q, exp, names)
+		}
+	}
+
+	expectStatus(t, "deleting d/ with something in it", serve(conf, "DELETE", "d/", ""), 409)
+	expectStatus(t, "deleting d/x", serve(conf, "DELETE", "d/x", ""), 204)
+	expectStatus(t, "deleting d/", serve(conf, "DELETE", "d/", ""), 204)
+	expectStatus(t, "making e/", serve(conf, "PUT", "e/", "", "Content-Type", "application/directory"), 204)
+	expectStatus(t, "deleting e without its slash", serve(conf, "DELETE", "e", ""), 204)
+	expectStatus(t, "deleting e again", serve(conf, "DELETE", "e", ""), 404)
+
+	expectStatus(t, "patching", serve(conf, "PATCH", "a?rdiff=patch", "x"), 405)
+	expectStatus(t, "getting a signature", serve(conf, "GET", "a?rdiff=sig", ""), 405)
+}
+
+func TestDedupHash(t *testing.T) {
+	conf := testDedupArea(t)
+	putDedup(t, conf, "a", randomBytes(1, 100000))
+	expectStatus(t, "creating d/", serve(conf, "PUT", "d/", "{}",
+		"Content-Type", "application/directory"), 204)
+
+	w := serve(conf, "POST", "?hash="+bitfog.HashAlgorithm, "a\nd/\nmissing\n")
+	expectStatus(t, "hashing", w, 200)
+	if h := w.Header().Get(hashedHeader); h != bitfog.HashAlgorithm {
+		t.Errorf("Expected %v: %v, got %q", hashedHeader, bitfog.HashAlgorithm, h)
+	}
+	var got []bitfog.FileData
+	for d := json.NewDecoder(w.Body); d.More(); {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding hashes: %v", err)
+		}
+		got = append(got, fd)
+	}
+	e, _ := conf.Dedup.store.lookup("a")
+	if len(got) != 1 || got[0].Name != "a" || got[0].Hash == 0 || got[0].Hash != e.Hash {
+		t.Errorf("Expected just a with hash %x, got %+v", e.Hash, got)
+	}
+	expectStatus(t, "hashing with another algorithm",
+		serve(conf, "POST", "?hash=md5", "a"), 400)
+}
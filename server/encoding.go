@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/dustin/bitfog"
+)
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// encodedWriter compresses a response body with whatever encoding
+// the client prefers.  The first bit of the body is held back to see
+// whether it's worth compressing at all; responses that can't have a
+// body, and bodies that don't compress, are left alone.
+type encodedWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      flushWriteCloser
+	status   int
+	sample   []byte
+	decided  bool
+}
+
+// pickEncoding returns the best encoding the request says it accepts.
+func pickEncoding(req *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		accepted[strings.TrimSpace(fields[0])] = ok
+	}
+	for _, enc := range []string{"zstd", "gzip"} {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
+
+func (e *encodedWriter) WriteHeader(status int) {
+	if e.status != 0 {
+		return
+	}
+	e.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		e.decided = true
+		e.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// decide picks an encoding based on what's been written so far and
+// sends the header along with anything held back.
+func (e *encodedWriter) decide() error {
+	e.decided = true
+	if bitfog.Compressible(e.sample) {
+		h := e.Header()
+		h.Set("Content-Encoding", e.encoding)
+		h.Del("Content-Length")
+		switch e.encoding {
+		case "zstd":
+			e.enc, _ = zstd.NewWriter(e.ResponseWriter)
+		case "gzip":
+			e.enc = gzip.NewWriter(e.ResponseWriter)
+		}
+	}
+	e.ResponseWriter.WriteHeader(e.status)
+	sample := e.sample
+	e.sample = nil
+	_, err := e.write(sample)
+	return err
+}
+
+func (e *encodedWriter) write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if e.enc == nil {
+		return e.ResponseWriter.Write(b)
+	}
+	return e.enc.Write(b)
+}
+
+func (e *encodedWriter) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.decided {
+		return e.write(b)
+	}
+	n := bitfog.CompressSample - len(e.sample)
+	if n > len(b) {
+		n = len(b)
+	}
+	e.sample = append(e.sample, b[:n]...)
+	if len(e.sample) < bitfog.CompressSample {
+		return len(b), nil
+	}
+	if err := e.decide(); err != nil {
+		return 0, err
+	}
+	m, err := e.write(b[n:])
+	return n + m, err
+}
+
+func (e *encodedWriter) Flush() {
+	if e.status != 0 && !e.decided {
+		e.decide()
+	}
+	if e.enc != nil {
+		e.enc.Flush()
+	}
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends anything still held back and finishes the encoding.
+func (e *encodedWriter) Close() error {
+	if e.status != 0 && !e.decided {
+		if err := e.decide(); err != nil {
+			return err
+		}
+	}
+	if e.enc == nil {
+		return nil
+	}
+	return e.enc.Close()
+}
+
+type zstdReadCloser struct {
+	d *zstd.Decoder
+	r io.Closer
+}
+
+func (z zstdReadCloser) Read(b []byte) (int, error) {
+	return z.d.Read(b)
+}
+
+func (z zstdReadCloser) Close() error {
+	z.d.Close()
+	return z.r.Close()
+}
+
+// decodeBody undoes any Content-Encoding on an uploaded body.
+func decodeBody(req *http.Request) *fileError {
+	switch enc := req.Header.Get("Content-Encoding"); enc {
+	default:
+		return &fileError{http.StatusUnsupportedMediaType,
+			"unsupported content encoding: " + enc}
+	case "", "identity":
+	case "gzip":
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return &fileError{http.StatusBadRequest, "invalid gzip body"}
+		}
+		req.Body = r
+	case "zstd":
+		d, err := zstd.NewReader(req.Body)
+		if err != nil {
+			return &fileError{http.StatusBadRequest, "invalid zstd body"}
+		}
+		req.Body = zstdReadCloser{d, req.Body}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// serveEncoded sends a GET for target through handler, so the
+// response is encoded the way a real one would be.
+func serveEncoded(t *testing.T, conf itemConf, target, accept string) *httptest.ResponseRecorder {
+	paths["area"] = conf
+	t.Cleanup(func() { delete(paths, "area") })
+	req := httptest.NewRequest("GET", "/area/"+target, nil)
+	req.Header.Set("Accept-Encoding", accept)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// decoded returns the body of w with its Content-Encoding undone.
+func decoded(t *testing.T, w *httptest.ResponseRecorder) []byte {
+	t.Helper()
+	var r io.Reader = w.Body
+	switch enc := w.Header().Get("Content-Encoding"); enc {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Error reading gzip body: %v", err)
+		}
+		r = gz
+	case "zstd":
+		d, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("Error reading zstd body: %v", err)
+		}
+		defer d.Close()
+		r = d
+	default:
+		t.Fatalf("Unexpected encoding %q", enc)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error decoding %v body: %v", w.Header().Get("Content-Encoding"), err)
+	}
+	return b
+}
+
+func TestPickEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"identity":             "",
+		"gzip":                 "gzip",
+		"gzip, zstd":           "zstd",
+		"zstd;q=0, gzip":       "gzip",
+		"zstd;q=0.5, gzip;q=0": "zstd",
+		"gzip;q=bogus":         "",
+		" br , gzip ; q=1":     "gzip",
+	}
+	for accept, exp := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if got := pickEncoding(req); got != exp {
+			t.Errorf("pickEncoding(%q) = %q, expected %q", accept, got, exp)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	area := t.TempDir() + "/"
+	text := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 5000)
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(random)
+	files := map[string][]byte{"text": text, "random": random, "small": []byte("hi\n")}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(area, name), content, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := itemConf{Path: area}
+
+	tests := []struct {
+		target, accept, exp string
+	}{
+		{"text", "gzip", "gzip"},
+		{"text", "zstd, gzip", "zstd"},
+		{"text", "", ""},
+		{"random", "zstd", ""},
+		{"small", "zstd", ""},
+	}
+	for _, test := range tests {
+		w := serveEncoded(t, conf, test.target, test.accept)
+		expectStatus(t, test.target, w, http.StatusOK)
+		if got := w.Header().Get("Content-Encoding"); got != test.exp {
+			t.Errorf("%v with %q: encoded as %q, expected %q", test.target, test.accept, got, test.exp)
+		}
+		if got := decoded(t, w); !bytes.Equal(got, files[test.target]) {
+			t.Errorf("%v with %q: got %v bytes back, expected %v",
+				test.target, test.accept, len(got), len(files[test.target]))
+		}
+	}
+
+	w := serveEncoded(t, conf, "", "zstd")
+	expectStatus(t, "listing", w, http.StatusOK)
+	if got := w.Header().Get("Content-Encoding"); got != "zstd" {
+		t.Errorf("Expected the listing to be compressed, got %q", got)
+	}
+	if got := string(decoded(t, w)); !strings.Contains(got, `"random"`) {
+		t.Errorf("Expected random in the listing, got %s", got)
+	}
+
+	w = serveEncoded(t, conf, "missing", "zstd")
+	expectStatus(t, "missing", w, http.StatusBadRequest)
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Expected a short error not to be compressed, got %q", got)
+	}
+}
+
+func TestEncodingNoContent(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ew := &encodedWriter{ResponseWriter: rec, encoding: "zstd"}
+	ew.WriteHeader(http.StatusNoContent)
+	if err := ew.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected a bare 204, got %v %q %q",
+			rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"time"
+
+	"github.com/dustin/bitfog"
 )
 
 type fileError struct {
@@ -21,37 +25,271 @@ func (fe *fileError) Error() string {
 	return fe.msg
 }
 
+// absolutize finds subpath within the directory at path, which it
+// mustn't be, or be outside of.  This is only a check of the names;
+// confine and rooted deal with symlinks.
 func absolutize(path, subpath string) (string, *fileError) {
-	abs, err := filepath.Abs(filepath.Join(path, filepath.Clean(subpath)))
+	root, err := filepath.Abs(path)
+	var abs string
+	if err == nil {
+		abs, err = filepath.Abs(filepath.Join(root, subpath))
+	}
 	if err != nil {
 		log.Printf("Error canonicalizing path:  %v", err)
 		return "", &fileError{http.StatusBadRequest,
 			"Something went wrong, I think it was you"}
 	}
-	if !strings.HasPrefix(abs, path) {
+	if !within(abs, root) || abs == root {
 		return "", &fileError{http.StatusBadRequest, "No"}
 	}
+	return abs, nil
+}
+
+var errNotFile = &fileError{http.StatusBadRequest, "That's not a file."}
+
+// isDir reports whether abs, within dir, is a directory.
+func isDir(dir, abs string) bool {
+	r, rel, err := rooted(dir, abs)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	fi, err := r.Lstat(rel)
+	return err == nil && fi.IsDir()
+}
 
-	fi, err := os.Stat(abs)
-	if err == nil && fi.IsDir() {
-		return "", &fileError{http.StatusBadRequest, "That's not a file."}
+// setDirMeta gives a directory the mode and mtime it has elsewhere.
+func setDirMeta(r *os.Root, name string, mode os.FileMode, mtime time.Time) error {
+	if err := r.Chmod(name, mode&(os.ModePerm|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
 	}
-	return abs, nil
+	return r.Chtimes(name, mtime, mtime)
+}
+
+// removeTree is os.RemoveAll for trees that may contain read-only
+// directories.
+func removeTree(path string) error {
+	r, err := os.OpenRoot(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return removeTreeIn(r, filepath.Base(path))
+}
+
+// removeTreeIn is removeTree for name within r.
+func removeTreeIn(r *os.Root, name string) error {
+	fs.WalkDir(r.FS(), filepath.ToSlash(name), func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				r.Chmod(p, info.Mode().Perm()|0700)
+			}
+		}
+		return nil
+	})
+	return r.RemoveAll(name)
+}
+
+// doMkdir creates a directory.  If the body describes it, it's given
+// that mode and mtime, which should happen after anything's been put
+// in it.
+func doMkdir(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	var fd bitfog.FileData
+	if err := json.NewDecoder(req.Body).Decode(&fd); err != nil && err != io.EOF {
+		http.Error(w, "Error reading directory body: "+err.Error(), 400)
+		return
+	}
+	if !isDir(conf.Path, abs) {
+		if err := discard(conf, abs); err != nil {
+			log.Printf("Problem replacing %s: %v", abs, err)
+			http.Error(w, "error replacing file: "+err.Error(), 500)
+			return
+		}
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err == nil {
+		defer r.Close()
+		err = r.MkdirAll(rel, 0777)
+	}
+	if err != nil {
+		log.Printf("Problem creating directory %s: %v", abs, err)
+		http.Error(w, "Error creating directory: "+err.Error(), 500)
+		return
+	}
+	if fd.Mode != 0 {
+		// Ownership first, as changing it can clear setgid.
+		err := applyMeta(conf, r, rel, fd.Meta)
+		if err == nil {
+			err = setDirMeta(r, rel, os.FileMode(fd.Mode), time.Unix(fd.Mtime, 0))
+		}
+		if err != nil {
+			log.Printf("Problem setting metadata of %s: %v", abs, err)
+			http.Error(w, "Error setting directory metadata: "+err.Error(), 500)
+			return
+		}
+	}
+	log.Printf("Created directory %s", abs)
+	w.WriteHeader(204)
+}
+
+// doRmdir removes a directory, as long as there's nothing in it.
+func doRmdir(conf itemConf, abs string, w http.ResponseWriter) {
+	r, rel, err := rooted(conf.Path, abs)
+	if err == nil {
+		defer r.Close()
+		// Remove only removes empty directories.
+		err = r.Remove(rel)
+	}
+	if err != nil && !os.IsNotExist(err) && r != nil {
+		if d, rerr := r.Open(rel); rerr == nil {
+			entries, _ := d.ReadDir(1)
+			d.Close()
+			if len(entries) > 0 {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "Directory not empty.\n")
+				return
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Error deleting:  %v", err)
+		http.Error(w, "Error deleting directory: "+err.Error(), 500)
+		return
+	}
+	log.Printf("Deleted directory %s", abs)
+	w.WriteHeader(204)
+}
+
+// unshare replaces the file called name in r with a copy of itself,
+// so it can be changed without changing snapshots linked to it.
+// Names linked to it within the area are left with the original.
+func unshare(r *os.Root, name string, info os.FileInfo) error {
+	in, err := r.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if fi, err := in.Stat(); err != nil || !os.SameFile(fi, info) {
+		return fmt.Errorf("%v changed while copying it", name)
+	}
+	out, tmp, err := createTemp(r, name)
+	if err != nil {
+		return err
+	}
+	defer r.Remove(tmp)
+	sw := bitfog.NewSparseWriter(out)
+	if _, err := io.Copy(sw, in); err != nil {
+		sw.Close()
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	if uid, gid, ok := owner(info); ok && privileged {
+		if err := r.Lchown(tmp, uid, gid); err != nil {
+			return err
+		}
+	}
+	// As in applyMeta, these can only be had by name, and neither
+	// name is a symlink.
+	xattrs, err := getXattrs(in.Name())
+	if err != nil {
+		return err
+	}
+	for k, val := range xattrs {
+		if err := setXattr(filepath.Join(r.Name(), tmp), k, val); err != nil {
+			return err
+		}
+	}
+	if err := r.Chmod(tmp, info.Mode().Perm()); err != nil {
+		return err
+	}
+	mtime := info.ModTime()
+	if err := r.Chtimes(tmp, mtime, mtime); err != nil {
+		return err
+	}
+	return r.Rename(tmp, name)
+}
+
+// doSetMeta gives an existing file the mode, mtime, ownership and
+// extended attributes described by the body, leaving its content
+// alone.  Symlinks only get their ownership.
+func doSetMeta(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	var fd bitfog.FileData
+	if err := json.NewDecoder(req.Body).Decode(&fd); err != nil {
+		http.Error(w, "Error reading metadata: "+err.Error(), 400)
+		return
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "Error opening area: "+err.Error(), 500)
+		return
+	}
+	defer r.Close()
+	info, err := r.Lstat(rel)
+	if err != nil {
+		http.Error(w, "No such file", 404)
+		return
+	}
+	if _, _, nlink := linkInfo(info); conf.Snapshots != nil && nlink > 1 && info.Mode().IsRegular() {
+		if err := unshare(r, rel, info); err != nil {
+			log.Printf("Problem copying %s: %v", abs, err)
+			http.Error(w, "Error copying file: "+err.Error(), 500)
+			return
+		}
+	}
+
+	mode := os.FileMode(fd.Mode)
+	err = applyMeta(conf, r, rel, fd.Meta)
+	if err == nil && !isa(info.Mode(), os.ModeSymlink) && fd.Mode != 0 {
+		if info.IsDir() {
+			err = setDirMeta(r, rel, mode, time.Unix(fd.Mtime, 0))
+		} else if err = r.Chmod(rel, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err == nil {
+			mtime := time.Unix(fd.Mtime, 0)
+			err = r.Chtimes(rel, mtime, mtime)
+		}
+	}
+	if err != nil {
+		log.Printf("Problem setting metadata of %s: %v", abs, err)
+		http.Error(w, "Error setting metadata: "+err.Error(), 500)
+		return
+	}
+	log.Printf("Updated metadata of %s", abs)
+	w.WriteHeader(204)
 }
 
-func doPut(abs string, w http.ResponseWriter, req *http.Request) {
+func doPut(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
 	log.Printf("Writing %v", abs)
+	meta, ferr := readMeta(req)
+	if ferr != nil {
+		w.WriteHeader(ferr.status)
+		fmt.Fprintf(w, "%s\n", ferr.msg)
+		return
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "Error opening area: "+err.Error(), 500)
+		return
+	}
+	defer r.Close()
 	ctype := req.Header.Get("Content-Type")
 	switch ctype {
 	default:
 		http.Error(w, "invalid content type: "+ctype, 400)
 		return
+	case "application/directory":
+		doMkdir(conf, abs, w, req)
+		return
 	case "application/octet-stream":
-		os.RemoveAll(abs)
-		f, err := os.Create(abs)
+		if err := discard(conf, abs); err != nil {
+			log.Printf("Problem replacing %s: %v", abs, err)
+			http.Error(w, "error replacing file: "+err.Error(), 500)
+			return
+		}
+		f, err := r.Create(rel)
 		if err != nil {
-			os.MkdirAll(filepath.Dir(abs), 0777)
-			f, err = os.Create(abs)
+			r.MkdirAll(filepath.Dir(rel), 0777)
+			f, err = r.Create(rel)
 			if err != nil {
 				log.Printf("Problem opening %s: %v", abs, err)
 				http.Error(w, "error deleting file: "+err.Error(), 500)
@@ -59,15 +297,22 @@ func doPut(abs string, w http.ResponseWriter, req *http.Request) {
 			}
 		}
 		defer log.Printf("Created file %s", abs)
-		if _, err := io.Copy(f, req.Body); err != nil {
+		// Runs of zeros become holes, so sparse files stay sparse.
+		sw := bitfog.NewSparseWriter(f)
+		if _, err := io.Copy(sw, req.Body); err != nil {
 			f.Close()
 			http.Error(w, "error writing data: "+err.Error(), 500)
 			return
 		}
-		if err := f.Close(); err != nil {
+		if err := sw.Close(); err != nil {
 			http.Error(w, "error closing: "+err.Error(), 500)
 			return
 		}
+		if err := applyMeta(conf, r, rel, meta); err != nil {
+			log.Printf("Problem setting metadata of %s: %v", abs, err)
+			http.Error(w, "error setting metadata: "+err.Error(), 500)
+			return
+		}
 	case "application/symlink":
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -76,24 +321,96 @@ func doPut(abs string, w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		dest := string(body)
-		err = os.Symlink(dest, abs)
+		if ferr := checkSymlink(conf, conf.Path, abs, dest); ferr != nil {
+			log.Printf("Refusing symlink %v -> %v: %v", abs, dest, ferr.msg)
+			w.WriteHeader(ferr.status)
+			fmt.Fprintf(w, "%s\n", ferr.msg)
+			return
+		}
+		if err := discard(conf, abs); err != nil {
+			log.Printf("Problem replacing %s: %v", abs, err)
+			http.Error(w, "error replacing file: "+err.Error(), 500)
+			return
+		}
+		err = r.Symlink(dest, rel)
 		if err != nil {
-			os.MkdirAll(filepath.Dir(abs), 0777)
-			os.RemoveAll(abs)
-			err = os.Symlink(dest, abs)
+			r.MkdirAll(filepath.Dir(rel), 0777)
+			err = r.Symlink(dest, rel)
 			if err != nil {
 				log.Printf("Problem symlinking %s: %v", abs, err)
 				http.Error(w, "Error creating symlink: "+err.Error(), 500)
 				return
 			}
 		}
+		if err := applyMeta(conf, r, rel, meta); err != nil {
+			log.Printf("Problem setting metadata of %s: %v", abs, err)
+			http.Error(w, "error setting metadata: "+err.Error(), 500)
+			return
+		}
 		log.Printf("Created symlink: %v -> %v", abs, dest)
+	case "application/hardlink":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "Error reading hardlink body: "+err.Error(), 400)
+			return
+		}
+		target, ferr := resolve(conf.Path, string(body))
+		if ferr != nil {
+			w.WriteHeader(ferr.status)
+			fmt.Fprintf(w, "%s\n", ferr.msg)
+			return
+		}
+		trel, err := filepath.Rel(r.Name(), target)
+		var tfi os.FileInfo
+		if err == nil {
+			tfi, err = r.Lstat(trel)
+		}
+		if err != nil || !tfi.Mode().IsRegular() {
+			http.Error(w, "Can't link to "+string(body), 400)
+			return
+		}
+		if fi, err := r.Lstat(rel); err == nil && os.SameFile(fi, tfi) {
+			w.WriteHeader(204)
+			return
+		}
+		if err := discard(conf, abs); err != nil {
+			log.Printf("Problem replacing %s: %v", abs, err)
+			http.Error(w, "error replacing file: "+err.Error(), 500)
+			return
+		}
+		err = r.Link(trel, rel)
+		if err != nil {
+			r.MkdirAll(filepath.Dir(rel), 0777)
+			err = r.Link(trel, rel)
+			if err != nil {
+				log.Printf("Problem linking %s: %v", abs, err)
+				http.Error(w, "Error creating hardlink: "+err.Error(), 500)
+				return
+			}
+		}
+		log.Printf("Created hardlink: %v -> %v", abs, target)
 	}
 	w.WriteHeader(204)
 }
 
-func doDelete(abs string, w http.ResponseWriter, req *http.Request) {
-	err := os.Remove(abs)
+func doDelete(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "Error opening area: "+err.Error(), 500)
+		return
+	}
+	defer r.Close()
+	fi, err := r.Lstat(rel)
+	if err != nil {
+		log.Printf("Error deleting:  %v", err)
+		http.Error(w, "Error deleting file: "+err.Error(), 500)
+		return
+	}
+	if fi.IsDir() {
+		doRmdir(conf, abs, w)
+		return
+	}
+	err = discard(conf, abs)
 	if err != nil {
 		log.Printf("Error deleting:  %v", err)
 		http.Error(w, "Error deleting file: "+err.Error(), 500)
@@ -104,6 +421,12 @@ func doDelete(abs string, w http.ResponseWriter, req *http.Request) {
 }
 
 func handlePatch(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "Error opening area: "+err.Error(), 500)
+		return
+	}
+	defer r.Close()
 	mode := req.FormValue("rdiff")
 	switch mode {
 	default:
@@ -129,7 +452,18 @@ func handlePatch(conf itemConf, abs string, w http.ResponseWriter, req *http.Req
 			fmt.Fprintf(w, "Error writing to tmp file")
 			return
 		}
-		cmd := exec.CommandContext(req.Context(), "rdiff", mode, f.Name(), abs)
+		in, err := r.Open(rel)
+		if err != nil {
+			log.Printf("Error opening file: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error opening file.\n")
+			return
+		}
+		defer in.Close()
+		// rdiff gets the file itself rather than its name, which could
+		// lead anywhere by the time it's opened.
+		cmd := exec.CommandContext(req.Context(), "rdiff", mode, f.Name(), "-")
+		cmd.Stdin = in
 		cmd.Stdout = w
 		cmd.Stderr = os.Stderr
 		err = cmd.Start()
@@ -170,7 +504,17 @@ func handlePatch(conf itemConf, abs string, w http.ResponseWriter, req *http.Req
 			return
 		}
 
-		fout, err := ioutil.TempFile(os.TempDir(), "bitfog-result.")
+		basis, err := r.Open(rel)
+		if err != nil {
+			log.Printf("Error opening file: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error opening file.\n")
+			return
+		}
+		defer basis.Close()
+
+		// Next to the file, so it can be renamed over it.
+		fout, tmp, err := createTemp(r, rel)
 		if err != nil {
 			log.Printf("Error creating tmp file %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -178,9 +522,10 @@ func handlePatch(conf itemConf, abs string, w http.ResponseWriter, req *http.Req
 			return
 		}
 		defer fout.Close()
-		defer os.Remove(fout.Name())
+		defer r.Remove(tmp)
 
-		cmd := exec.CommandContext(req.Context(), "rdiff", mode, abs, f.Name())
+		cmd := exec.CommandContext(req.Context(), "rdiff", mode, "-", f.Name(), "-")
+		cmd.Stdin = basis
 		cmd.Stdout = fout
 		cmd.Stderr = os.Stderr
 		err = cmd.Start()
@@ -198,19 +543,39 @@ func handlePatch(conf itemConf, abs string, w http.ResponseWriter, req *http.Req
 			return
 		}
 
-		err = os.Rename(fout.Name(), abs)
+		// Without a trash, the patched file just replaces the old one
+		// in a single step.
+		if conf.Trash != nil {
+			err = discard(conf, abs)
+			if err != nil {
+				log.Printf("Error moving %s out of the way: %v", abs, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "Error replacing file")
+				return
+			}
+		}
+
+		err = r.Rename(tmp, rel)
 		if err != nil {
 			log.Printf("Error completing rdiff: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "Error moving file into place")
+			return
 		}
 
 		w.WriteHeader(204)
 	}
 }
 
-func handleGet(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
-	fi, err := os.Lstat(abs)
+func handleGet(conf itemConf, dir, abs string, w http.ResponseWriter, req *http.Request) {
+	r, rel, err := rooted(dir, abs)
+	if err != nil {
+		log.Printf("Error opening %v: %v", dir, err)
+		http.Error(w, "Error opening area.", 500)
+		return
+	}
+	defer r.Close()
+	fi, err := r.Lstat(rel)
 	if err != nil {
 		log.Printf("Error getting file info file: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -232,22 +597,36 @@ func handleGet(conf itemConf, abs string, w http.ResponseWriter, req *http.Reque
 	case "":
 		log.Printf("Getting %s", abs)
 
-		f, err := os.Open(abs)
+		f, err := r.Open(rel)
 		if err != nil {
 			log.Printf("Error opening file: %v", err)
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, "Error fetching file.\n")
+			return
 		}
 		defer f.Close()
-		_, err = io.Copy(w, f)
+		if req.FormValue("sparse") != "" {
+			err = sendSparse(w, f, fi.Size())
+		} else {
+			_, err = io.Copy(w, f)
+		}
 		if err != nil {
 			log.Printf("Error streaming file: %v", err)
 		}
 	case "sig":
 		// Generating an rdiff signature
-		cmd := exec.CommandContext(req.Context(), "rdiff", "signature", abs)
+		f, err := r.Open(rel)
+		if err != nil {
+			log.Printf("Error opening file: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Error fetching file.\n")
+			return
+		}
+		defer f.Close()
+		cmd := exec.CommandContext(req.Context(), "rdiff", "signature", "-", "-")
+		cmd.Stdin = f
 		cmd.Stdout = w
-		err := cmd.Start()
+		err = cmd.Start()
 		if err != nil {
 			log.Printf("Error running rdiff on %s: %v", abs, err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -262,37 +641,125 @@ func handleGet(conf itemConf, abs string, w http.ResponseWriter, req *http.Reque
 	}
 }
 
+// sparseHeader marks a response to ?sparse=1 that's in the sparse
+// format: a line with a bitfog.SparseMap, followed by the data it
+// describes.  Servers that don't know about it send the whole file.
+const sparseHeader = "X-Bitfog-Sparse"
+
+func sendSparse(w http.ResponseWriter, f *os.File, size int64) error {
+	extents, err := bitfog.DataExtents(f, size)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(sparseHeader, "1")
+	if err := json.NewEncoder(w).Encode(bitfog.SparseMap{Size: size, Extents: extents}); err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if _, err := io.Copy(w, io.NewSectionReader(f, e.Off, e.Len)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func handlePath(conf itemConf, subpath string, w http.ResponseWriter, req *http.Request) {
-	if subpath == "" {
+	if conf.Dedup != nil {
+		handleDedupPath(conf, subpath, w, req)
+		return
+	}
+
+	switch {
+	case subpath == "" && req.FormValue("trash") != "":
+		log.Printf("Listing trash for %s", conf.Path)
+		listTrash(conf, w, req)
+	case subpath == "" && req.FormValue("snapshots") != "":
+		log.Printf("Listing snapshots of %s", conf.Path)
+		listSnapshots(conf, w, req)
+	case subpath == "" && req.FormValue("snapshot") != "" && req.Method == "POST":
+		if conf.Writable {
+			doSnapshot(conf, w, req)
+		} else {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "Can't %s here.\n", req.Method)
+		}
+	case subpath == "" && req.FormValue("snapshot") != "":
+		log.Printf("Listing snapshot %s of %s", req.FormValue("snapshot"), conf.Path)
+		listSnapshot(conf, w, req)
+	case subpath == "" && req.FormValue("hash") != "" && req.Method == "POST":
+		log.Printf("Hashing files in %s", conf.Path)
+		hashFiles(conf, w, req, func(name string) (bitfog.FileData, bool) {
+			return hashPath(conf, name)
+		})
+	case subpath == "":
 		log.Printf("Listing %s", conf.Path)
 		w.Header().Set("Content-Type", "application/json")
 		listPath(conf, w, req)
-	} else {
-		abs, err := absolutize(conf.Path, subpath)
+	default:
+		abs, err := resolve(conf.Path, subpath)
 		if err != nil {
 			w.WriteHeader(err.status)
 			fmt.Fprintf(w, "%s\n", err.msg)
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
+		// Directories can only be created, removed and have their
+		// metadata updated.
+		if isDir(conf.Path, abs) && req.Method != "DELETE" &&
+			!(req.Method == "PUT" && req.Header.Get("Content-Type") == "application/directory") &&
+			!(req.Method == "POST" && req.FormValue("meta") != "") {
+			w.WriteHeader(errNotFile.status)
+			fmt.Fprintf(w, "%s\n", errNotFile.msg)
+			return
+		}
 		switch req.Method {
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			fmt.Fprintf(w, "Can't %s here.\n", req.Method)
 		case "GET":
-			handleGet(conf, abs, w, req)
+			dir := conf.Path
+			if id := req.FormValue("snapshot"); id != "" {
+				root, err := snapshotRoot(conf, id)
+				if err == nil {
+					dir = root
+					abs, err = resolve(root, subpath)
+				}
+				if err != nil {
+					w.WriteHeader(err.status)
+					fmt.Fprintf(w, "%s\n", err.msg)
+					return
+				}
+			}
+			if isDir(dir, abs) {
+				w.WriteHeader(errNotFile.status)
+				fmt.Fprintf(w, "%s\n", errNotFile.msg)
+				return
+			}
+			handleGet(conf, dir, abs, w, req)
 		case "PATCH":
 			handlePatch(conf, abs, w, req)
 		case "PUT":
 			if conf.Writable {
-				doPut(abs, w, req)
+				doPut(conf, abs, w, req)
 			} else {
 				w.WriteHeader(http.StatusMethodNotAllowed)
 				fmt.Fprintf(w, "Can't %s here.\n", req.Method)
 			}
+		case "POST":
+			switch {
+			case conf.Writable && req.FormValue("undelete") != "":
+				doUndelete(conf, abs, w, req)
+			case conf.Writable && req.FormValue("restore") != "":
+				doRestore(conf, abs, w, req)
+			case conf.Writable && req.FormValue("meta") != "":
+				doSetMeta(conf, abs, w, req)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				fmt.Fprintf(w, "Can't %s here.\n", req.Method)
+			}
 		case "DELETE":
 			if conf.Writable {
-				doDelete(abs, w, req)
+				doDelete(conf, abs, w, req)
 			} else {
 				w.WriteHeader(http.StatusMethodNotAllowed)
 				fmt.Fprintf(w, "Can't %s here.\n", req.Method)
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+func TestPutHardlink(t *testing.T) {
+	area, outside := testArea(t)
+	if err := os.WriteFile(outside+"/f", []byte("outside\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	conf := itemConf{Path: area, Writable: true}
+	put := func(name, body, ctype string) *httptest.ResponseRecorder {
+		return serve(conf, "PUT", name, body, "Content-Type", ctype)
+	}
+	sameFile := func(a, b string) bool {
+		ai, aerr := os.Lstat(area + a)
+		bi, berr := os.Lstat(area + b)
+		return aerr == nil && berr == nil && os.SameFile(ai, bi)
+	}
+
+	expectStatus(t, "PUT a", put("a", "shared\n", "application/octet-stream"), 204)
+	expectStatus(t, "PUT c", put("c", "other\n", "application/octet-stream"), 204)
+
+	expectStatus(t, "linking sub/b", put("sub/b", "a", "application/hardlink"), 204)
+	if !sameFile("a", "sub/b") {
+		t.Errorf("Expected sub/b to be linked to a")
+	}
+	expectContent(t, area+"sub/b", "shared\n")
+	// Linking again is a no-op.
+	expectStatus(t, "linking sub/b again", put("sub/b", "a", "application/hardlink"), 204)
+
+	expectStatus(t, "replacing c", put("c", "sub/b", "application/hardlink"), 204)
+	if !sameFile("a", "c") {
+		t.Errorf("Expected c to be replaced by a link to a")
+	}
+
+	w := serve(conf, "GET", "", "")
+	listed := false
+	d := json.NewDecoder(w.Body)
+	for d.More() {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding listing: %v", err)
+		}
+		if fd.Name == "a" {
+			listed = true
+			if fd.Nlink != 3 || fd.Ino == 0 {
+				t.Errorf("Expected a to be listed with three links, got %+v", fd)
+			}
+		}
+	}
+	if !listed {
+		t.Errorf("Expected a in the listing")
+	}
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"missing", http.StatusBadRequest},
+		{"in", http.StatusBadRequest},
+		{"inlink", http.StatusBadRequest},
+		{"out/f", http.StatusForbidden},
+		{"../outside/f", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		expectStatus(t, "linking to "+test.target,
+			put("d", test.target, "application/hardlink"), test.status)
+	}
+	if _, err := os.Lstat(area + "d"); !os.IsNotExist(err) {
+		t.Errorf("Expected no d after failed links, got %v", err)
+	}
+}
+
+// dataLen is how much of the file at p isn't holes.
+func dataLen(t *testing.T, p string) int64 {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := bitfog.DataExtents(f, info.Size())
+	if err != nil {
+		t.Fatalf("Error finding data in %v: %v", p, err)
+	}
+	var n int64
+	for _, e := range extents {
+		n += e.Len
+	}
+	return n
+}
+
+func TestSparse(t *testing.T) {
+	area := t.TempDir() + "/"
+	want := make([]byte, 64*bitfog.SparseBlock)
+	copy(want[100:], "data at the start")
+	copy(want[40*bitfog.SparseBlock:], bytes.Repeat([]byte{'x'}, 3*bitfog.SparseBlock))
+	f, err := os.Create(area + "holey")
+	if err == nil {
+		sw := bitfog.NewSparseWriter(f)
+		if _, err = sw.Write(want); err == nil {
+			err = sw.Close()
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := itemConf{Path: area, Writable: true}
+	size := int64(len(want))
+	holes := dataLen(t, area+"holey") < size
+
+	w := serve(conf, "GET", "holey", "")
+	expectStatus(t, "plain GET", w, http.StatusOK)
+	if w.Header().Get(sparseHeader) != "" || !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("Expected a plain GET to send the whole file, got %v bytes (%q)",
+			w.Body.Len(), w.Header().Get(sparseHeader))
+	}
+
+	w = serve(conf, "GET", "holey?sparse=1", "")
+	expectStatus(t, "sparse GET", w, http.StatusOK)
+	if w.Header().Get(sparseHeader) != "1" {
+		t.Fatalf("Expected a sparse response, got headers %v", w.Header())
+	}
+	total := int64(w.Body.Len())
+	br := bufio.NewReader(w.Body)
+	line, err := br.ReadBytes('\n')
+	var m bitfog.SparseMap
+	if err == nil {
+		err = json.Unmarshal(line, &m)
+	}
+	if err != nil {
+		t.Fatalf("Error reading sparse map: %v", err)
+	}
+	var sent int64
+	for _, e := range m.Extents {
+		sent += e.Len
+	}
+	if m.Size != size || sent != total-int64(len(line)) {
+		t.Errorf("Expected a map of %v bytes with %v bytes of data, got %+v",
+			size, total-int64(len(line)), m)
+	}
+	if holes && sent >= size {
+		t.Errorf("Expected the holes not to be sent, got %+v", m)
+	}
+	got, err := io.ReadAll(bitfog.NewHoleReader(br, m))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Expected to get the file back, got %v bytes, %v", len(got), err)
+	}
+
+	// Zeros that are uploaded become holes again.
+	expectStatus(t, "PUT", serve(conf, "PUT", "copy", string(want),
+		"Content-Type", "application/octet-stream"), 204)
+	expectContent(t, area+"copy", string(want))
+	if n := dataLen(t, area+"copy"); holes && n >= size {
+		t.Errorf("Expected the copy to be sparse, but %v of %v bytes are data", n, size)
+	}
+}
@@ -1,35 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
-	"hash/crc64"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/dustin/bitfog"
 )
 
-var crcTable = crc64.MakeTable(crc64.ISO)
-
 // ErrSkipFile should be returned whenever a file should be skipped.
 var ErrSkipFile = errors.New("skip this file")
 
 var flushInterval = (time.Duration(10) * time.Second)
 
-func computeHash(path string) uint64 {
-	f, err := os.Open(path)
+func computeHash(r *os.Root, name string) uint64 {
+	f, err := r.Open(name)
 	if err != nil {
 		log.Printf("Error in crc: %v", err)
 		return 0
 	}
 	defer f.Close()
-	h := crc64.New(crcTable)
+	h := bitfog.NewHash()
 	io.Copy(h, f)
 	return h.Sum64()
 }
@@ -38,7 +39,8 @@ func isa(mode os.FileMode, seeking os.FileMode) bool {
 	return mode&seeking == seeking
 }
 
-func describe(p, fileName string, info os.FileInfo, checksum bool) (fd bitfog.FileData, err error) {
+// describe gives the listing entry for the file called name in r.
+func describe(r *os.Root, name, fileName string, info os.FileInfo, checksum, meta bool) (fd bitfog.FileData, err error) {
 	fd.Name = fileName
 	fd.Size = info.Size()
 	fd.Mode = int32(info.Mode())
@@ -47,27 +49,192 @@ func describe(p, fileName string, info os.FileInfo, checksum bool) (fd bitfog.Fi
 	switch {
 	default:
 		if checksum {
-			fd.Hash = computeHash(p)
+			fd.Hash = computeHash(r, name)
+		}
+		var dev, ino uint64
+		dev, ino, fd.Nlink = linkInfo(info)
+		if fd.Nlink > 1 {
+			fd.Dev, fd.Ino = dev, ino
 		}
+	case info.IsDir():
+		// A directory's size means nothing anywhere else.
+		fd.Size = 0
 	case isa(info.Mode(), os.ModeSymlink):
-		fd.Dest, err = os.Readlink(p)
+		fd.Dest, err = r.Readlink(name)
 		if err != nil {
 			return
 		}
 	case isa(info.Mode(), os.ModeNamedPipe):
-		log.Printf("Ignoring named pipe:  %v", p)
+		log.Printf("Ignoring named pipe:  %v", fileName)
 		return fd, ErrSkipFile
 	case isa(info.Mode(), os.ModeSocket):
-		log.Printf("Ignoring socket:  %v", p)
+		log.Printf("Ignoring socket:  %v", fileName)
 		return fd, ErrSkipFile
 	}
+	if meta {
+		// Extended attributes can only be read by name.
+		fd.Meta, err = describeMeta(filepath.Join(r.Name(), name), info)
+	}
 	return
 }
 
+// listOrder is advertised in the listingOrderHeader of every listing.
+// Names are sorted byte-wise, so clients can compare listings as they
+// stream in, and resume one with after=<name>.
+const (
+	listingOrderHeader = "X-Bitfog-Order"
+	listOrder          = "bytewise"
+)
+
+// walkSorted calls fn for every file and directory in r, in byte-wise
+// order of their names, skipping everything up to
+// and including after.  filepath.Walk sorts each directory by name,
+// which puts "a/b" before "a.txt"; here directories are named with a
+// trailing slash, so the names come out in order.
+//
+// Anything matching rules, or the rules in a .bitfogignore file along
+// the way, is skipped.
+func walkSorted(r *os.Root, rel, after string, rules *bitfog.Rules, fn func(name string, info os.FileInfo)) {
+	dir := path.Join(".", rel)
+	entries, err := fs.ReadDir(r.FS(), dir)
+	if err != nil {
+		log.Printf("Traversal error: %v", err)
+		return
+	}
+	if f, err := r.Open(filepath.Join(filepath.FromSlash(dir), bitfog.IgnoreFile)); err == nil {
+		rules = rules.Clone()
+		err = rules.Read(rel, f)
+		f.Close()
+		if err != nil {
+			log.Printf("Error reading %v: %v", f.Name(), err)
+		}
+	}
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Name()
+		if e.IsDir() {
+			keys[i] += "/"
+		}
+	}
+	sort.Sort(byKey{keys, entries})
+
+	for i, e := range entries {
+		name := rel + keys[i]
+		if ignored, _ := rules.Match(strings.TrimSuffix(name, "/"), e.IsDir()); ignored {
+			continue
+		}
+		if e.IsDir() && name < after && !strings.HasPrefix(after, name) {
+			// Everything in here sorts before after.
+			continue
+		}
+		if name > after {
+			info, err := e.Info()
+			if err != nil {
+				log.Printf("Traversal error: %v", err)
+				continue
+			}
+			fn(name, info)
+		}
+		if e.IsDir() {
+			walkSorted(r, name, after, rules, fn)
+		}
+	}
+}
+
+// hashedHeader marks a response from hashFiles with the hash used, so
+// clients can tell it from whatever an older server does with the
+// request.
+const hashedHeader = "X-Bitfog-Hashed"
+
+// hashFiles answers a POST of names (one per line) with the listing
+// entry of each, hashed whether or not the area keeps checksums.
+// Names that aren't regular files are left out.  This lets a client
+// check just the files it can't otherwise tell apart.
+func hashFiles(conf itemConf, w http.ResponseWriter, req *http.Request,
+	hashOne func(name string) (bitfog.FileData, bool)) {
+	if algo := req.FormValue("hash"); algo != bitfog.HashAlgorithm {
+		http.Error(w, "Unsupported hash: "+algo+" (try "+bitfog.HashAlgorithm+")", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(hashedHeader, bitfog.HashAlgorithm)
+	e := json.NewEncoder(w)
+	s := bufio.NewScanner(req.Body)
+	for s.Scan() {
+		name := s.Text()
+		if name == "" || conf.exclude.Matches(name) {
+			continue
+		}
+		if fd, ok := hashOne(name); ok {
+			e.Encode(fd)
+		}
+	}
+	if err := s.Err(); err != nil {
+		log.Printf("Error reading names to hash: %v", err)
+	}
+}
+
+// hashPath hashes a file in a plain area.
+func hashPath(conf itemConf, name string) (bitfog.FileData, bool) {
+	abs, ferr := resolve(conf.Path, name)
+	if ferr != nil {
+		return bitfog.FileData{}, false
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		return bitfog.FileData{}, false
+	}
+	defer r.Close()
+	info, err := r.Lstat(rel)
+	if err != nil || !info.Mode().IsRegular() {
+		return bitfog.FileData{}, false
+	}
+	f, err := r.Open(rel)
+	if err != nil {
+		return bitfog.FileData{}, false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !os.SameFile(fi, info) {
+		return bitfog.FileData{}, false
+	}
+	fd, err := describe(r, rel, name, info, false, conf.Metadata)
+	if err != nil {
+		log.Printf("Error describing file: %v", err)
+		return fd, false
+	}
+	h := bitfog.NewHash()
+	if _, err := io.Copy(h, f); err != nil {
+		log.Printf("Error hashing file: %v", err)
+		return fd, false
+	}
+	fd.Hash = h.Sum64()
+	return fd, true
+}
+
+type byKey struct {
+	keys    []string
+	entries []os.DirEntry
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+}
+
 func listPath(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	r, err := os.OpenRoot(conf.Path)
+	if err != nil {
+		log.Printf("Error opening %v: %v", conf.Path, err)
+		http.Error(w, "error opening area: "+err.Error(), 500)
+		return
+	}
+	defer r.Close()
+
+	w.Header().Set(listingOrderHeader, listOrder)
 	e := json.NewEncoder(w)
 
-	walking := conf.Path
 	flusher, isFlusher := w.(http.Flusher)
 	var flushCh <-chan time.Time
 	if isFlusher {
@@ -76,33 +243,25 @@ func listPath(conf itemConf, w http.ResponseWriter, req *http.Request) {
 		defer timer.Stop()
 	}
 
-	f := func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("Traversal error: %v", err)
+	// Older clients don't know what to do with directories.
+	dirs := req.FormValue("dirs") != ""
+	walkSorted(r, "", req.FormValue("after"), conf.exclude, func(fileName string, info os.FileInfo) {
+		if info.IsDir() && !dirs {
+			return
 		}
-		if !info.IsDir() {
-			if !strings.HasPrefix(p, walking) {
-				log.Fatalf("Dir doesn't have prefix: %s %s", p, walking)
-			}
-			fileName := p[len(walking):]
-
-			fd, err := describe(p, fileName, info, conf.Checksum)
-			switch err {
+		fd, err := describe(r, filepath.FromSlash(fileName), fileName, info, conf.Checksum, conf.Metadata)
+		switch err {
+		default:
+			log.Printf("Error describing file: %v", err)
+		case nil:
+			e.Encode(fd)
+			select {
+			case <-flushCh:
+				flusher.Flush()
 			default:
-				log.Printf("Error describing file: %v", err)
-			case nil:
-				e.Encode(fd)
-				select {
-				case <-flushCh:
-					flusher.Flush()
-				default:
-				}
-			case ErrSkipFile:
-				// Just skipping htis
 			}
+		case ErrSkipFile:
+			// Just skipping htis
 		}
-		return nil
-	}
-
-	filepath.Walk(walking, f)
+	})
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dustin/bitfog"
+)
+
+// listNames lists conf's area with the given query and returns the
+// names in the order they came.
+func listNames(t *testing.T, conf itemConf, query string) []string {
+	t.Helper()
+	w := serve(conf, "GET", query, "")
+	expectStatus(t, "listing "+query, w, http.StatusOK)
+	if got := w.Header().Get(listingOrderHeader); got != listOrder {
+		t.Errorf("Expected %v order, got %q", listOrder, got)
+	}
+	var names []string
+	d := json.NewDecoder(w.Body)
+	for d.More() {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding listing: %v", err)
+		}
+		names = append(names, fd.Name)
+	}
+	return names
+}
+
+func TestListOrder(t *testing.T) {
+	area := t.TempDir() + "/"
+	// filepath.Walk would put a/b before a-b and a.txt.
+	for _, name := range []string{"a/b", "a/c/d", "a-b", "a.txt", "b", "e/"} {
+		dir, file := filepath.Split(area + name)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if file != "" {
+			if err := os.WriteFile(dir+file, []byte(name), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	conf := itemConf{Path: area}
+
+	tests := []struct {
+		query string
+		exp   []string
+	}{
+		{"", []string{"a-b", "a.txt", "a/b", "a/c/d", "b"}},
+		{"?after=a.txt", []string{"a/b", "a/c/d", "b"}},
+		{"?after=a/", []string{"a/b", "a/c/d", "b"}},
+		{"?after=a/b", []string{"a/c/d", "b"}},
+		{"?after=a/c/d", []string{"b"}},
+		{"?after=a0", []string{"b"}},
+		{"?after=b", nil},
+		{"?dirs=1", []string{"a-b", "a.txt", "a/", "a/b", "a/c/", "a/c/d", "b", "e/"}},
+		{"?dirs=1&after=a/", []string{"a/b", "a/c/", "a/c/d", "b", "e/"}},
+		{"?dirs=1&after=a/c/", []string{"a/c/d", "b", "e/"}},
+	}
+	for _, test := range tests {
+		if got := listNames(t, conf, test.query); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Listing %q: expected %q, got %q", test.query, test.exp, got)
+		}
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	area, outside := testArea(t)
+	for _, p := range []string{area + "a", area + "in/b", area + "secret", outside + "/f"} {
+		if err := os.WriteFile(p, []byte(p), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := itemConf{Path: area, exclude: &bitfog.Rules{}}
+	if err := conf.exclude.Add("", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// What's hashed on demand is what a checksummed listing has.
+	checksummed := conf
+	checksummed.Checksum = true
+	exp := map[string]bitfog.FileData{}
+	w := serve(checksummed, "GET", "", "")
+	for d := json.NewDecoder(w.Body); d.More(); {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding listing: %v", err)
+		}
+		exp[fd.Name] = fd
+	}
+	if exp["a"].Hash == 0 || exp["in/b"].Hash == 0 {
+		t.Fatalf("Expected checksums in the listing, got %+v", exp)
+	}
+
+	names := []string{"a", "", "in/b", "missing", "in", "inlink", "out/f",
+		"../outside/f", "secret"}
+	w = serve(conf, "POST", "?hash="+bitfog.HashAlgorithm, strings.Join(names, "\n"))
+	expectStatus(t, "hashing", w, http.StatusOK)
+	if h := w.Header().Get(hashedHeader); h != bitfog.HashAlgorithm {
+		t.Errorf("Expected %v: %v, got %q", hashedHeader, bitfog.HashAlgorithm, h)
+	}
+	var got []bitfog.FileData
+	for d := json.NewDecoder(w.Body); d.More(); {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding hashes: %v", err)
+		}
+		got = append(got, fd)
+	}
+	if want := []bitfog.FileData{exp["a"], exp["in/b"]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+
+	expectStatus(t, "hashing with another algorithm",
+		serve(conf, "POST", "?hash=md5", "a"), http.StatusBadRequest)
+}
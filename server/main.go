@@ -7,13 +7,48 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/dustin/bitfog"
 )
 
 type itemConf struct {
-	Path     string `json:"path"`
-	Writable bool   `json:"writable"`
-	Checksum bool   `json:"checksum"`
+	Path     string     `json:"path"`
+	Writable bool       `json:"writable"`
+	Checksum bool       `json:"checksum"`
+	Trash    *trashConf `json:"trash,omitempty"`
+
+	Snapshots *snapshotConf `json:"snapshots,omitempty"`
+	Dedup     *dedupConf    `json:"dedup,omitempty"`
+
+	// Metadata lists ownership and extended attributes, and applies
+	// them to whatever's written here.
+	Metadata bool `json:"metadata,omitempty"`
+
+	// Symlinks is what symlinks may be made to here: allow (the
+	// default), relative, confined or deny.
+	Symlinks string `json:"symlinks,omitempty"`
+
+	// Exclude lists gitignore-style patterns for things that should
+	// never be listed.
+	Exclude []string `json:"exclude,omitempty"`
+	exclude *bitfog.Rules
+}
+
+// duration is a time.Duration that reads from JSON as a string
+// like "168h".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
 }
 
 var paths = make(map[string]itemConf)
@@ -36,6 +71,16 @@ func notFoundPath(p string, w http.ResponseWriter, req *http.Request) {
 
 func handler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
+	if err := decodeBody(req); err != nil {
+		w.WriteHeader(err.status)
+		fmt.Fprintf(w, "%s\n", err.msg)
+		return
+	}
+	if enc := pickEncoding(req); enc != "" {
+		ew := &encodedWriter{ResponseWriter: w, encoding: enc}
+		defer ew.Close()
+		w = ew
+	}
 	parts := strings.SplitN(req.URL.Path[1:], "/", 2)
 	subpath := ""
 	if len(parts) > 1 {
@@ -63,6 +108,46 @@ func loadConf(c string) {
 	if err != nil {
 		log.Fatalf("Error reading conf file:  %v", err)
 	}
+	for k, v := range paths {
+		v.exclude = &bitfog.Rules{}
+		for _, pat := range v.Exclude {
+			if err := v.exclude.Add("", pat); err != nil {
+				log.Fatalf("Invalid exclude pattern for %v: %q: %v", k, pat, err)
+			}
+		}
+		paths[k] = v
+		if !symlinkPolicies[v.Symlinks] {
+			log.Fatalf("Invalid symlink policy for %v: %q", k, v.Symlinks)
+		}
+		if v.Metadata && v.Writable && !privileged {
+			log.Printf("Not running as root, so ownership won't be applied to %v", k)
+		}
+		if v.Trash != nil && within(v.Trash.Path, v.Path) {
+			log.Fatalf("Trash for %v must be outside of %v", k, v.Path)
+		}
+		if v.Snapshots != nil && within(v.Snapshots.Path, v.Path) {
+			log.Fatalf("Snapshots for %v must be outside of %v", k, v.Path)
+		}
+		if v.Snapshots != nil {
+			if err := checkSnapshotDir(v); err != nil {
+				log.Fatalf("Can't keep snapshots of %v: %v", k, err)
+			}
+		}
+		if v.Dedup != nil {
+			if v.Trash != nil || v.Snapshots != nil {
+				log.Fatalf("%v can't have trash or snapshots with dedup storage", k)
+			}
+			v.Dedup.store, err = openDedup(v.Dedup.Path)
+			if err != nil {
+				log.Fatalf("Error opening dedup storage for %v: %v", k, err)
+			}
+		}
+	}
+}
+
+// within reports whether p is dir or something inside of it.
+func within(p, dir string) bool {
+	return strings.HasPrefix(filepath.Clean(p)+"/", filepath.Clean(dir)+"/")
 }
 
 func main() {
@@ -72,6 +157,12 @@ func main() {
 
 	loadConf(*confFile)
 
+	for _, v := range paths {
+		if v.Trash != nil {
+			go trashReaper(v)
+		}
+	}
+
 	s := &http.Server{
 		Addr:    *addr,
 		Handler: http.HandlerFunc(handler),
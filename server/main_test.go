@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serve sends a request for target (a name in the area, with any
+// query) straight to handlePath, with headers given as name, value
+// pairs.
+func serve(conf itemConf, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/area/"+target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handlePath(conf, strings.TrimPrefix(req.URL.Path, "/area/"), w, req)
+	return w
+}
+
+// expectStatus fails unless w has the given status.
+func expectStatus(t *testing.T, what string, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("%v: got %v, expected %v: %s", what, w.Code, status, w.Body.String())
+	}
+}
+
+// fakeRdiff puts a stand-in for rdiff on the PATH if there isn't a
+// real one.  Its deltas are just the whole new file.
+func fakeRdiff(t *testing.T) {
+	if _, err := exec.LookPath("rdiff"); err == nil {
+		return
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+input() { if [ -z "$1" ] || [ "$1" = - ]; then cat; else cat "$1"; fi; }
+op=$1; shift
+case $op in
+signature) input "$1" | wc -c ;;
+delta|patch) input "$2" ;;
+*) exit 1 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "rdiff"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
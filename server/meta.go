@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/bitfog"
+)
+
+// metaHeader carries the ownership and extended attributes a PUT
+// should give the file it creates.
+const metaHeader = "X-Bitfog-Meta"
+
+// Only root can give files away.
+var privileged = os.Geteuid() == 0
+
+// describeMeta captures the ownership and extended attributes of the
+// file at p.  Symlinks only have an owner.
+func describeMeta(p string, info os.FileInfo) (*bitfog.Meta, error) {
+	uid, gid, ok := owner(info)
+	if !ok {
+		return nil, nil
+	}
+	m := &bitfog.Meta{Uid: uid, Gid: gid}
+	if !isa(info.Mode(), os.ModeSymlink) {
+		var err error
+		if m.Xattrs, err = getXattrs(p); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// readMeta returns the metadata given with a request, if any.
+func readMeta(req *http.Request) (*bitfog.Meta, *fileError) {
+	h := req.Header.Get(metaHeader)
+	if h == "" {
+		return nil, nil
+	}
+	m := &bitfog.Meta{}
+	if err := json.Unmarshal([]byte(h), m); err != nil {
+		return nil, &fileError{http.StatusBadRequest, "Invalid " + metaHeader + ": " + err.Error()}
+	}
+	return m, nil
+}
+
+// applyMeta gives the file called name in r the ownership and
+// extended attributes in m, where the area wants that.  Ownership is
+// only changed when running as root, and extended attributes that
+// can't be set (e.g. for lack of privileges) are logged and skipped,
+// as the content is already in place.
+func applyMeta(conf itemConf, r *os.Root, name string, m *bitfog.Meta) error {
+	if m == nil || !conf.Metadata {
+		return nil
+	}
+	if privileged {
+		if err := r.Lchown(name, m.Uid, m.Gid); err != nil {
+			return err
+		}
+	}
+	if fi, err := r.Lstat(name); err != nil || isa(fi.Mode(), os.ModeSymlink) {
+		return err
+	}
+	// There's no way to set these through r, but it's just been
+	// checked that there's no symlink in the way.
+	abs := filepath.Join(r.Name(), name)
+	for k, val := range m.Xattrs {
+		if err := setXattr(abs, k, val); err != nil {
+			log.Printf("Can't set %v on %v: %v", k, abs, err)
+		}
+	}
+	return nil
+}
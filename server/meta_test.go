@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+// testMetaArea makes a writable area that keeps metadata, skipping
+// the test if its filesystem can't hold user extended attributes.
+func testMetaArea(t *testing.T) itemConf {
+	area := t.TempDir() + "/"
+	probe := area + ".probe"
+	if err := os.WriteFile(probe, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(probe, "user.bitfog", []byte("x")); err != nil {
+		t.Skipf("Can't set extended attributes here: %v", err)
+	}
+	os.Remove(probe)
+	return itemConf{Path: area, Writable: true, Metadata: true}
+}
+
+// metaJSON is m as it's sent in a metaHeader.
+func metaJSON(t *testing.T, m *bitfog.Meta) string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// userXattrs is just the user attributes in xattrs, as the system
+// may add others of its own (e.g. for SELinux).
+func userXattrs(xattrs map[string][]byte) map[string][]byte {
+	rv := map[string][]byte{}
+	for k, v := range xattrs {
+		if strings.HasPrefix(k, "user.") {
+			rv[k] = v
+		}
+	}
+	return rv
+}
+
+// expectXattrs fails unless the file at p has exactly the user
+// attributes in exp.
+func expectXattrs(t *testing.T, p string, exp map[string][]byte) {
+	t.Helper()
+	got, err := getXattrs(p)
+	if err != nil {
+		t.Fatalf("Error reading attributes of %v: %v", p, err)
+	}
+	if got := userXattrs(got); len(got) != 0 || len(exp) != 0 {
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("Expected %v to have attributes %q, got %q", p, exp, got)
+		}
+	}
+}
+
+func TestPutMeta(t *testing.T) {
+	conf := testMetaArea(t)
+	m := &bitfog.Meta{Uid: os.Getuid(), Gid: os.Getgid(),
+		Xattrs: map[string][]byte{"user.bitfog": []byte("hello")}}
+	put := func(conf itemConf, name, body, ctype, meta string) *httptest.ResponseRecorder {
+		return serve(conf, "PUT", name, body, "Content-Type", ctype, metaHeader, meta)
+	}
+
+	expectStatus(t, "PUT f", put(conf, "f", "content", "application/octet-stream", metaJSON(t, m)), 204)
+	expectContent(t, conf.Path+"f", "content")
+	expectXattrs(t, conf.Path+"f", m.Xattrs)
+
+	expectStatus(t, "PUT with a broken header",
+		put(conf, "g", "content", "application/octet-stream", "{nope"), 400)
+	if _, err := os.Lstat(conf.Path + "g"); !os.IsNotExist(err) {
+		t.Errorf("Expected no g after a bad header, got %v", err)
+	}
+
+	// Symlinks only get an owner.
+	expectStatus(t, "PUT l", put(conf, "l", "f", "application/symlink", metaJSON(t, m)), 204)
+	if got, err := os.Readlink(conf.Path + "l"); err != nil || got != "f" {
+		t.Errorf("Expected l -> f, got %q, %v", got, err)
+	}
+
+	// Areas that don't keep metadata ignore it.
+	plain := conf
+	plain.Metadata = false
+	expectStatus(t, "PUT h", put(plain, "h", "content", "application/octet-stream", metaJSON(t, m)), 204)
+	expectXattrs(t, conf.Path+"h", nil)
+
+	w := serve(conf, "GET", "", "")
+	expectStatus(t, "listing", w, http.StatusOK)
+	listed := map[string]*bitfog.Meta{}
+	for d := json.NewDecoder(w.Body); d.More(); {
+		var fd bitfog.FileData
+		if err := d.Decode(&fd); err != nil {
+			t.Fatalf("Error decoding listing: %v", err)
+		}
+		listed[fd.Name] = fd.Meta
+	}
+	if lm := listed["f"]; lm == nil || lm.Uid != m.Uid || lm.Gid != m.Gid ||
+		!reflect.DeepEqual(userXattrs(lm.Xattrs), m.Xattrs) {
+		t.Errorf("Expected f to be listed with %+v, got %+v", m, listed["f"])
+	}
+	if lm := listed["l"]; lm == nil || lm.Uid != m.Uid || lm.Xattrs != nil {
+		t.Errorf("Expected l to be listed with just an owner, got %+v", lm)
+	}
+}
+
+func TestSetMeta(t *testing.T) {
+	conf := testMetaArea(t)
+	if err := os.WriteFile(conf.Path+"f", []byte("content"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	m := &bitfog.Meta{Uid: os.Getuid(), Gid: os.Getgid(),
+		Xattrs: map[string][]byte{"user.a": []byte("1"), "user.b": nil}}
+	fd := bitfog.FileData{Mode: 0640, Mtime: 1000, Meta: m}
+	body, err := json.Marshal(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, "updating f", serve(conf, "POST", "f?meta=1", string(body)), 204)
+	info, err := os.Lstat(conf.Path + "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0640 || !info.ModTime().Equal(time.Unix(1000, 0)) {
+		t.Errorf("Expected f to be 0640 from 1000, got %v from %v", info.Mode(), info.ModTime().Unix())
+	}
+	expectXattrs(t, conf.Path+"f", map[string][]byte{"user.a": []byte("1"), "user.b": {}})
+	expectContent(t, conf.Path+"f", "content")
+
+	expectStatus(t, "updating a missing file", serve(conf, "POST", "nope?meta=1", string(body)), 404)
+	expectStatus(t, "updating with a broken body", serve(conf, "POST", "f?meta=1", "{nope"), 400)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errEscapes = &fileError{http.StatusForbidden, "That's outside of the area."}
+
+// rooted opens dir as an os.Root and finds abs within it, so nothing
+// done with the name can leave dir, even through symlinks planted
+// along the way after it was checked.
+func rooted(dir, abs string) (*os.Root, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, "", fmt.Errorf("%v is outside of %v", abs, dir)
+	}
+	r, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	return r, rel, nil
+}
+
+// inside reports whether p really is inside root, even if there are
+// symlinks along the way.  Only as much of p as exists is followed.
+func inside(root, p string) bool {
+	r, rel, err := rooted(root, p)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	for {
+		_, err := r.Stat(rel)
+		switch {
+		case err == nil:
+			return true
+		case !os.IsNotExist(err):
+			return false
+		case rel == ".":
+			return false
+		}
+		rel = filepath.Dir(rel)
+	}
+}
+
+// confine makes sure the directory holding abs is inside root.  abs
+// itself isn't followed, as it's only ever read if it isn't a symlink,
+// and replaced if it is.
+func confine(root, abs string) *fileError {
+	if !inside(root, filepath.Dir(abs)) {
+		log.Printf("Refusing %v, which is outside of %v", abs, root)
+		return errEscapes
+	}
+	return nil
+}
+
+// resolve finds subpath within root, refusing anything that leads
+// elsewhere.
+func resolve(root, subpath string) (string, *fileError) {
+	abs, ferr := absolutize(root, subpath)
+	if ferr == nil {
+		ferr = confine(root, abs)
+	}
+	return abs, ferr
+}
+
+// moveAcross renames fromName in from to toName in to, making the
+// directory it goes in if need be.  The roots can't share a name, but
+// the directories holding each end are opened through them, so
+// nothing along either path can lead elsewhere.
+func moveAcross(from *os.Root, fromName string, to *os.Root, toName string) error {
+	return across(from, fromName, to, toName, renameAt)
+}
+
+// linkAcross is moveAcross for making a hard link.
+func linkAcross(from *os.Root, fromName string, to *os.Root, toName string) error {
+	return across(from, fromName, to, toName, linkAt)
+}
+
+func across(from *os.Root, fromName string, to *os.Root, toName string,
+	op func(fromDir *os.File, from string, toDir *os.File, to string) error) error {
+	if err := to.MkdirAll(filepath.Dir(toName), 0777); err != nil {
+		return err
+	}
+	fd, err := from.Open(filepath.Dir(fromName))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	td, err := to.Open(filepath.Dir(toName))
+	if err != nil {
+		return err
+	}
+	defer td.Close()
+	return op(fd, filepath.Base(fromName), td, filepath.Base(toName))
+}
+
+// isTemp tells whether name looks like one createTemp made.
+func isTemp(name string) bool {
+	base := filepath.Base(name)
+	i := strings.LastIndexByte(base, '.')
+	if i < 2 || base[0] != '.' || i == len(base)-1 {
+		return false
+	}
+	_, err := strconv.ParseUint(base[i+1:], 10, 32)
+	return err == nil
+}
+
+// createTemp makes a new file next to name in r, to be renamed over
+// it once it's complete.
+func createTemp(r *os.Root, name string) (*os.File, string, error) {
+	prefix := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".")
+	for i := 0; ; i++ {
+		tmp := prefix + strconv.FormatUint(uint64(rand.Uint32()), 10)
+		f, err := r.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, tmp, err
+	}
+}
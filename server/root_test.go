@@ -0,0 +1,257 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAbsolutizeSiblings(t *testing.T) {
+	base := t.TempDir()
+	for _, area := range []string{base + "/vm", base + "/vm/"} {
+		for _, subpath := range []string{"../vm2/x", "../vm2", "..", "", "."} {
+			if abs, ferr := absolutize(area, subpath); ferr == nil {
+				t.Errorf("absolutize(%q, %q) = %q, expected an error", area, subpath, abs)
+			}
+		}
+		abs, ferr := absolutize(area, "a/../b")
+		if exp := filepath.Join(base, "vm", "b"); ferr != nil || abs != exp {
+			t.Errorf("absolutize(%q, a/../b) = %q, %v; expected %q", area, abs, ferr, exp)
+		}
+	}
+}
+
+// realDir follows the symlinks in as much of p as exists.
+func realDir(p string) string {
+	var rest string
+	for {
+		r, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(r, rest)
+		}
+		if !os.IsNotExist(err) || filepath.Dir(p) == p {
+			return ""
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = filepath.Dir(p)
+	}
+}
+
+func FuzzResolve(f *testing.F) {
+	for _, seed := range []string{
+		"f", "in/f", "inlink/f", "new/dir/f", "out/f", "up/f",
+		"root/etc/passwd", "../outside/f", "in/../../outside/f",
+		"/etc/passwd", "in//..//../x", "./././f", "in/./../inlink/../out/x",
+		"..", "...", "a/..../b", "in\x00/f", "%2e%2e/f",
+	} {
+		f.Add(seed)
+	}
+	area, _ := testArea(f)
+	realArea, err := filepath.EvalSymlinks(area)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, subpath string) {
+		abs, ferr := resolve(area, subpath)
+		if ferr != nil {
+			return
+		}
+		if !within(abs, area) || abs == filepath.Clean(area) {
+			t.Fatalf("resolve(%q) = %q, which isn't in %q", subpath, abs, area)
+		}
+		if dir := realDir(filepath.Dir(abs)); dir != "" && !within(dir, realArea) {
+			t.Fatalf("resolve(%q) = %q, which is really in %q", subpath, abs, dir)
+		}
+		r, rel, err := rooted(area, abs)
+		if err != nil {
+			t.Fatalf("rooted(%q) failed for %q: %v", area, abs, err)
+		}
+		r.Close()
+		if !filepath.IsLocal(rel) {
+			t.Fatalf("rooted(%q) gave %q for %q", area, rel, abs)
+		}
+	})
+}
+
+// escapeArea makes an area with d/f and an empty d/e, with trash and
+// snapshots, next to a directory outside of it with f and e/x.
+func escapeArea(t *testing.T) (conf itemConf, outside string) {
+	base := t.TempDir()
+	conf = itemConf{Path: filepath.Join(base, "area") + "/", Writable: true,
+		Trash:     &trashConf{Path: filepath.Join(base, "trash")},
+		Snapshots: &snapshotConf{Path: filepath.Join(base, "snaps")}}
+	outside = filepath.Join(base, "outside")
+	for _, d := range []string{conf.Path + "d/e", outside + "/e"} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p, content := range map[string]string{
+		conf.Path + "d/f": "inside", outside + "/f": "outside", outside + "/e/x": "outside",
+	} {
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conf, outside
+}
+
+// swapOut replaces the directory at p with a symlink to outside.
+func swapOut(t *testing.T, p, outside string) {
+	if err := os.Rename(p, p+".orig"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectUntouched fails if anything outside has changed.
+func expectUntouched(t *testing.T, outside string) {
+	t.Helper()
+	got := map[string]string{}
+	filepath.Walk(outside, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			b, _ := os.ReadFile(p)
+			got[strings.TrimPrefix(p, outside+"/")] = string(b)
+		}
+		return nil
+	})
+	if exp := map[string]string{"f": "outside", "e/x": "outside"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected outside to still be %v, got %v", exp, got)
+	}
+}
+
+// A directory can be swapped for a symlink after a name's been
+// resolved, so whatever's done with it mustn't leave the area (or its
+// trash or snapshots).
+func TestSwappedForSymlink(t *testing.T) {
+	fakeRdiff(t)
+	handled := func(h func(itemConf, string, http.ResponseWriter, *http.Request), method, query, body string) func(*testing.T, itemConf, string) bool {
+		return func(t *testing.T, conf itemConf, abs string) bool {
+			w := httptest.NewRecorder()
+			h(conf, abs, w, httptest.NewRequest(method, "/area/x"+query, strings.NewReader(body)))
+			return w.Code < 300 && !strings.Contains(w.Body.String(), "outside")
+		}
+	}
+	tests := []struct {
+		name   string
+		target string
+		// prep runs before the swap, and returns what to swap.
+		prep func(t *testing.T, conf itemConf) string
+		op   func(t *testing.T, conf itemConf, abs string) bool
+	}{
+		{"discard", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			conf.Trash = nil
+			return discard(conf, abs) == nil
+		}},
+		{"discard to trash", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			return discard(conf, abs) == nil
+		}},
+		{"delete", "d/f", nil, handled(doDelete, "DELETE", "", "")},
+		{"rmdir", "d/e", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			w := httptest.NewRecorder()
+			doRmdir(conf, abs, w)
+			return w.Code < 300
+		}},
+		{"undelete", "d/f", func(t *testing.T, conf itemConf) string {
+			discard(conf, conf.Path+"d/f")
+			return ""
+		}, handled(doUndelete, "POST", "?undelete=1", "")},
+		{"undelete from a swapped trash", "d/f", func(t *testing.T, conf itemConf) string {
+			if err := os.MkdirAll(conf.Trash.Path+"/1/d", 0777); err != nil {
+				t.Fatal(err)
+			}
+			return conf.Trash.Path + "/1/d"
+		}, handled(doUndelete, "POST", "?undelete=1", "")},
+		{"restore", "d/f", func(t *testing.T, conf itemConf) string {
+			takeTestSnapshot(t, conf)
+			return ""
+		}, func(t *testing.T, conf itemConf, abs string) bool {
+			ids, _ := snapshotIDs(conf)
+			return handled(doRestore, "POST", "?restore="+ids[0], "")(t, conf, abs)
+		}},
+		{"restore from a swapped snapshot", "d/f", func(t *testing.T, conf itemConf) string {
+			id := takeTestSnapshot(t, conf)
+			os.Remove(conf.Path + "d/f")
+			return filepath.Join(conf.Snapshots.Path, id, "d")
+		}, func(t *testing.T, conf itemConf, abs string) bool {
+			ids, _ := snapshotIDs(conf)
+			return handled(doRestore, "POST", "?restore="+ids[0], "")(t, conf, abs)
+		}},
+		{"unshare", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			r, rel, err := rooted(conf.Path, abs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			info, err := os.Lstat(conf.Path + "d.orig/f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return unshare(r, rel, info) == nil
+		}},
+		{"patch", "d/f", nil, handled(handlePatch, "PATCH", "?rdiff=patch", "patched")},
+		{"delta", "d/f", nil, handled(handlePatch, "PATCH", "?rdiff=delta", "sig")},
+		{"signature", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			w := httptest.NewRecorder()
+			handleGet(conf, conf.Path, abs, w, httptest.NewRequest("GET", "/area/d/f?rdiff=sig", nil))
+			return w.Code < 300
+		}},
+		{"hash", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			fd, ok := hashPath(conf, "d/f")
+			return ok && fd.Hash != 0
+		}},
+		{"listing", "d/f", nil, func(t *testing.T, conf itemConf, abs string) bool {
+			// Descending into d, having seen it as a directory.
+			r, err := os.OpenRoot(conf.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			var names []string
+			walkSorted(r, "d/", "", nil, func(name string, info os.FileInfo) {
+				if _, err := describe(r, filepath.FromSlash(name), name, info, true, false); err == nil {
+					names = append(names, name)
+				}
+			})
+			return len(names) > 0
+		}},
+		{"snapshot", "d/f", func(t *testing.T, conf itemConf) string {
+			if err := os.WriteFile(conf.Path+"d/a", []byte("inside"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(conf.Snapshots.Path, ".1", "d")
+			if err := os.MkdirAll(dest, 0777); err != nil {
+				t.Fatal(err)
+			}
+			return dest
+		}, func(t *testing.T, conf itemConf, abs string) bool {
+			return copyLinks(conf.Path, filepath.Join(conf.Snapshots.Path, ".1")) == nil
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf, outside := escapeArea(t)
+			abs, ferr := resolve(conf.Path, test.target)
+			if ferr != nil {
+				t.Fatalf("Error resolving %v: %v", test.target, ferr)
+			}
+			swap := conf.Path + "d"
+			if test.prep != nil {
+				if p := test.prep(t, conf); p != "" {
+					swap = p
+				}
+			}
+			swapOut(t, swap, outside)
+			if test.op(t, conf, abs) {
+				t.Errorf("Expected %v through a symlink to fail", test.name)
+			}
+			expectUntouched(t, outside)
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// snapshotConf describes where an area keeps point-in-time copies of
+// itself, and how many of them.
+type snapshotConf struct {
+	Path string `json:"path"`
+	Keep int    `json:"keep"`
+}
+
+type snapshotInfo struct {
+	ID   string `json:"id"`
+	Time int64  `json:"time"`
+}
+
+// snapshotIDs returns the IDs of all the snapshots of an area, oldest
+// first.
+func snapshotIDs(conf itemConf) ([]string, error) {
+	dirs, err := os.ReadDir(conf.Snapshots.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	var ids []int64
+	for _, d := range dirs {
+		if n, err := strconv.ParseInt(d.Name(), 10, 64); err == nil && d.IsDir() {
+			ids = append(ids, n)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rv := make([]string, 0, len(ids))
+	for _, n := range ids {
+		rv = append(rv, strconv.FormatInt(n, 10))
+	}
+	return rv, nil
+}
+
+// snapshotRoot returns the directory holding the given snapshot,
+// with a trailing slash as an area path would have.
+func snapshotRoot(conf itemConf, id string) (string, *fileError) {
+	if conf.Snapshots == nil {
+		return "", &fileError{http.StatusNotFound, "No snapshots here."}
+	}
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", &fileError{http.StatusBadRequest, "Invalid snapshot: " + id}
+	}
+	root := filepath.Join(conf.Snapshots.Path, id)
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return "", &fileError{http.StatusNotFound, "No such snapshot: " + id}
+	}
+	return root + "/", nil
+}
+
+// checkSnapshotDir makes sure the area's files can be hardlinked into
+// its snapshot directory, creating that if need be.
+func checkSnapshotDir(conf itemConf) error {
+	if err := os.MkdirAll(conf.Snapshots.Path, 0777); err != nil {
+		return err
+	}
+	area, err := os.Stat(conf.Path)
+	if err != nil {
+		return err
+	}
+	snaps, err := os.Stat(conf.Snapshots.Path)
+	if err != nil {
+		return err
+	}
+	adev, _, _ := linkInfo(area)
+	sdev, _, _ := linkInfo(snaps)
+	if adev != sdev {
+		return fmt.Errorf("%v isn't on the same filesystem as %v",
+			conf.Snapshots.Path, conf.Path)
+	}
+	return nil
+}
+
+// takeSnapshot hardlinks the current contents of the area into a new
+// snapshot.  Files are never modified in place (they're always
+// replaced), so the links continue to reflect the state at the time
+// the snapshot was taken.  Files still being uploaded are left out.
+func takeSnapshot(conf itemConf) (string, error) {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	root := filepath.Join(conf.Snapshots.Path, id)
+	tmp := filepath.Join(conf.Snapshots.Path, "."+id)
+
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return "", err
+	}
+	err := copyLinks(conf.Path, tmp)
+	if err == nil {
+		err = os.Rename(tmp, root)
+	}
+	if err != nil {
+		removeTree(tmp)
+		return "", err
+	}
+	log.Printf("Took snapshot %s of %s", id, conf.Path)
+
+	pruneSnapshots(conf)
+	return id, nil
+}
+
+// copyLinks fills the directory snap with hardlinks to everything in
+// the area at path.  Both are walked and written through roots, so
+// nothing swapped for a symlink along the way can take either
+// elsewhere.
+func copyLinks(path, snap string) error {
+	area, err := os.OpenRoot(path)
+	if err != nil {
+		return err
+	}
+	defer area.Close()
+	r, err := os.OpenRoot(snap)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Directories get their metadata once everything's in them, deepest
+	// first, as adding to them changes their mtimes.
+	var dirs []string
+	var dirInfo []os.FileInfo
+	err = fs.WalkDir(area.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(p)
+		switch {
+		case info.IsDir():
+			dirs, dirInfo = append(dirs, name), append(dirInfo, info)
+			return r.MkdirAll(name, 0777)
+		case isa(info.Mode(), os.ModeSymlink):
+			target, err := area.Readlink(name)
+			if err != nil {
+				return err
+			}
+			return r.Symlink(target, name)
+		case info.Mode().IsRegular():
+			if isTemp(name) {
+				// Still being written, and about to be renamed.
+				return nil
+			}
+			return linkAcross(area, name, r, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setDirMeta(r, dirs[i], dirInfo[i].Mode(), dirInfo[i].ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneSnapshots(conf itemConf) {
+	if conf.Snapshots.Keep <= 0 {
+		return
+	}
+	ids, err := snapshotIDs(conf)
+	if err != nil {
+		log.Printf("Error listing snapshots: %v", err)
+		return
+	}
+	for len(ids) > conf.Snapshots.Keep {
+		log.Printf("Removing old snapshot %s of %s", ids[0], conf.Path)
+		if err := removeTree(filepath.Join(conf.Snapshots.Path, ids[0])); err != nil {
+			log.Printf("Error removing snapshot: %v", err)
+		}
+		ids = ids[1:]
+	}
+}
+
+func doSnapshot(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	if conf.Snapshots == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No snapshots here.\n")
+		return
+	}
+	id, err := takeSnapshot(conf)
+	if err != nil {
+		log.Printf("Error taking snapshot of %s: %v", conf.Path, err)
+		http.Error(w, "error taking snapshot: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshotInfo{id, time.Now().Unix()})
+}
+
+func listSnapshots(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	if conf.Snapshots == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No snapshots here.\n")
+		return
+	}
+	ids, err := snapshotIDs(conf)
+	if err != nil {
+		log.Printf("Error listing snapshots: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error listing snapshots.\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	for _, id := range ids {
+		n, _ := strconv.ParseInt(id, 10, 64)
+		e.Encode(snapshotInfo{id, time.Unix(0, n).Unix()})
+	}
+}
+
+func listSnapshot(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	root, ferr := snapshotRoot(conf, req.FormValue("snapshot"))
+	if ferr != nil {
+		w.WriteHeader(ferr.status)
+		fmt.Fprintf(w, "%s\n", ferr.msg)
+		return
+	}
+	snapconf := conf
+	snapconf.Path = root
+	w.Header().Set("Content-Type", "application/json")
+	listPath(snapconf, w, req)
+}
+
+func doRestore(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	root, ferr := snapshotRoot(conf, req.FormValue("restore"))
+	if ferr != nil {
+		w.WriteHeader(ferr.status)
+		fmt.Fprintf(w, "%s\n", ferr.msg)
+		return
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "invalid path: "+err.Error(), 400)
+		return
+	}
+	defer r.Close()
+	if _, ferr := resolve(root, rel); ferr != nil {
+		w.WriteHeader(ferr.status)
+		fmt.Fprintf(w, "%s\n", ferr.msg)
+		return
+	}
+	snap, err := os.OpenRoot(root)
+	if err != nil {
+		log.Printf("Error opening snapshot %v: %v", root, err)
+		http.Error(w, "error opening snapshot: "+err.Error(), 500)
+		return
+	}
+	defer snap.Close()
+	fi, err := snap.Lstat(rel)
+	if err != nil {
+		http.Error(w, "not in snapshot: "+rel, 404)
+		return
+	}
+	if fi.IsDir() {
+		w.WriteHeader(errNotFile.status)
+		fmt.Fprintf(w, "%s\n", errNotFile.msg)
+		return
+	}
+
+	if err := discard(conf, abs); err != nil {
+		log.Printf("Error moving %s out of the way: %v", abs, err)
+		http.Error(w, "error replacing file: "+err.Error(), 500)
+		return
+	}
+	if isa(fi.Mode(), os.ModeSymlink) {
+		var target string
+		target, err = snap.Readlink(rel)
+		if err == nil {
+			r.MkdirAll(filepath.Dir(rel), 0777)
+			err = r.Symlink(target, rel)
+		}
+	} else {
+		err = linkAcross(snap, rel, r, rel)
+	}
+	if err != nil {
+		log.Printf("Error restoring %s: %v", abs, err)
+		http.Error(w, "error restoring file: "+err.Error(), 500)
+		return
+	}
+	log.Printf("Restored %s from snapshot %s", abs, req.FormValue("restore"))
+	w.WriteHeader(204)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSnapshotArea(t *testing.T) itemConf {
+	base := t.TempDir()
+	conf := itemConf{Path: filepath.Join(base, "area") + "/", Writable: true,
+		Snapshots: &snapshotConf{Path: filepath.Join(base, "snaps"), Keep: 2}}
+	if err := os.MkdirAll(conf.Path+"d", 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSnapshotDir(conf); err != nil {
+		t.Fatalf("Error checking snapshot dir: %v", err)
+	}
+	for name, content := range map[string]string{"f": "one", "d/g": "g"} {
+		if err := os.WriteFile(conf.Path+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conf
+}
+
+func takeTestSnapshot(t *testing.T, conf itemConf) string {
+	w := serve(conf, "POST", "?snapshot=create", "")
+	expectStatus(t, "taking snapshot", w, 200)
+	var info snapshotInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.ID == "" {
+		t.Fatalf("Expected a snapshot id, got %q: %v", w.Body.String(), err)
+	}
+	return info.ID
+}
+
+func TestSnapshots(t *testing.T) {
+	conf := testSnapshotArea(t)
+	id := takeTestSnapshot(t, conf)
+
+	w := serve(conf, "PUT", "f", "two", "Content-Type", "application/octet-stream")
+	expectStatus(t, "overwriting f", w, 204)
+
+	w = serve(conf, "GET", "f?snapshot="+id, "")
+	expectStatus(t, "getting f from snapshot", w, 200)
+	if w.Body.String() != "one" {
+		t.Errorf("Expected the snapshot to keep f as it was, got %q", w.Body.String())
+	}
+
+	w = serve(conf, "GET", "?snapshots=list", "")
+	expectStatus(t, "listing snapshots", w, 200)
+	if got := strings.Count(w.Body.String(), `"id":"`+id+`"`); got != 1 {
+		t.Errorf("Expected snapshot %v to be listed, got %s", id, w.Body.String())
+	}
+
+	w = serve(conf, "GET", "?snapshot="+id, "")
+	expectStatus(t, "listing snapshot", w, 200)
+	for _, name := range []string{`"name":"f"`, `"name":"d/g"`} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("Expected %v in snapshot listing, got %s", name, w.Body.String())
+		}
+	}
+
+	w = serve(conf, "POST", "f?restore="+id, "")
+	expectStatus(t, "restoring f", w, 204)
+	if b, err := os.ReadFile(conf.Path + "f"); err != nil || string(b) != "one" {
+		t.Errorf("Expected f to be restored, got %q, %v", b, err)
+	}
+	expectStatus(t, "restoring from a missing snapshot", serve(conf, "POST", "f?restore=1", ""), 404)
+
+	// Only the newest two are kept.
+	for i := 0; i < 2; i++ {
+		time.Sleep(time.Millisecond)
+		takeTestSnapshot(t, conf)
+	}
+	ids, err := snapshotIDs(conf)
+	if err != nil || len(ids) != 2 || ids[0] == id {
+		t.Errorf("Expected the oldest snapshot to be pruned, got %v, %v", ids, err)
+	}
+	expectStatus(t, "getting from a pruned snapshot", serve(conf, "GET", "f?snapshot="+id, ""), 404)
+}
+
+func TestSnapshotUnshare(t *testing.T) {
+	conf := testSnapshotArea(t)
+	id := takeTestSnapshot(t, conf)
+
+	w := serve(conf, "POST", "f?meta=1", `{"mode": 384, "mtime": 1000000000}`)
+	expectStatus(t, "updating metadata", w, 204)
+
+	fi, err := os.Stat(conf.Path + "f")
+	if err != nil || fi.Mode().Perm() != 0600 || fi.ModTime().Unix() != 1000000000 {
+		t.Errorf("Expected f to be updated, got %v, %v", fi, err)
+	}
+	sfi, err := os.Stat(filepath.Join(conf.Snapshots.Path, id, "f"))
+	if err != nil || sfi.Mode().Perm() != 0644 || os.SameFile(fi, sfi) {
+		t.Errorf("Expected the snapshot's f to be left alone, got %v, %v", sfi, err)
+	}
+	if b, err := os.ReadFile(conf.Path + "f"); err != nil || string(b) != "one" {
+		t.Errorf("Expected f's content to be kept, got %q, %v", b, err)
+	}
+}
+
+func TestSnapshotSkipsTemp(t *testing.T) {
+	conf := testSnapshotArea(t)
+	r, err := os.OpenRoot(conf.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, tmp, err := createTemp(r, "d/g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Not ours, despite the leading dot.
+	for _, name := range []string{".h", ".h.x", "..1x"} {
+		if err := os.WriteFile(conf.Path+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := takeTestSnapshot(t, conf)
+	snap := filepath.Join(conf.Snapshots.Path, id)
+	if _, err := os.Lstat(filepath.Join(snap, tmp)); !os.IsNotExist(err) {
+		t.Errorf("Expected %v to be left out of the snapshot, got %v", tmp, err)
+	}
+	for _, name := range []string{"f", "d/g", ".h", ".h.x", "..1x"} {
+		if _, err := os.Lstat(filepath.Join(snap, name)); err != nil {
+			t.Errorf("Expected %v in the snapshot: %v", name, err)
+		}
+	}
+}
+
+func TestSnapshotDirFilesystem(t *testing.T) {
+	area := t.TempDir()
+	other := "/dev/shm"
+	afi, err := os.Stat(area)
+	ofi, oerr := os.Stat(other)
+	if err != nil || oerr != nil {
+		t.Skipf("Can't compare %v and %v: %v, %v", area, other, err, oerr)
+	}
+	adev, _, _ := linkInfo(afi)
+	odev, _, _ := linkInfo(ofi)
+	if adev == odev {
+		t.Skipf("%v and %v are on the same filesystem", area, other)
+	}
+	conf := itemConf{Path: area, Snapshots: &snapshotConf{Path: other}}
+	if err := checkSnapshotDir(conf); err == nil {
+		t.Errorf("Expected snapshots on another filesystem to be refused")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// linkInfo knows nothing about hard links here.
+func linkInfo(info os.FileInfo) (dev, ino, nlink uint64) {
+	return 0, 0, 0
+}
+
+// owner knows nothing about ownership here.
+func owner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// What a writable area will let a client make a symlink to.
+const (
+	// Anything at all (the default).
+	symlinksAllow = "allow"
+	// Only relative targets.
+	symlinksRelative = "relative"
+	// Only targets inside the area.
+	symlinksConfined = "confined"
+	// No symlinks at all.
+	symlinksDeny = "deny"
+)
+
+var symlinkPolicies = map[string]bool{
+	"":               true,
+	symlinksAllow:    true,
+	symlinksRelative: true,
+	symlinksConfined: true,
+	symlinksDeny:     true,
+}
+
+// checkSymlink decides whether the area's symlink policy allows a
+// symlink at abs (within root) pointing to target.
+func checkSymlink(conf itemConf, root, abs, target string) *fileError {
+	switch conf.Symlinks {
+	case symlinksDeny:
+		return &fileError{http.StatusForbidden, "Symlinks aren't allowed here."}
+	case symlinksRelative:
+		if filepath.IsAbs(target) {
+			return &fileError{http.StatusForbidden, "Only relative symlinks are allowed here."}
+		}
+	case symlinksConfined:
+		dest := target
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(filepath.Dir(abs), dest)
+		}
+		// Dedup areas have nothing on disk for the target to lead
+		// through.
+		if !within(dest, root) || (conf.Dedup == nil && !inside(root, dest)) {
+			return &fileError{http.StatusForbidden, "Symlinks must stay within the area."}
+		}
+	}
+	return nil
+}
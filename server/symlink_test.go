@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testArea makes an area with a directory in it, and symlinks leading
+// both in and out of it.
+func testArea(t testing.TB) (area, outside string) {
+	base := t.TempDir()
+	area, outside = filepath.Join(base, "area")+"/", filepath.Join(base, "outside")
+	for _, d := range []string{area + "in", outside} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"out":    outside,
+		"up":     "../outside",
+		"inlink": "in",
+		"root":   "/",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, area+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return area, outside
+}
+
+func TestResolve(t *testing.T) {
+	area, _ := testArea(t)
+	tests := []struct {
+		subpath string
+		ok      bool
+	}{
+		{"f", true},
+		{"in/f", true},
+		{"inlink/f", true},
+		{"new/dir/f", true},
+		{"out", true},
+		{"out/f", false},
+		{"out/new/dir/f", false},
+		{"up/f", false},
+		{"root/etc/passwd", false},
+		{"in/../out/f", false},
+		{"../outside/f", false},
+		{"in/../../outside/f", false},
+	}
+	for _, test := range tests {
+		_, ferr := resolve(area, test.subpath)
+		if (ferr == nil) != test.ok {
+			t.Errorf("resolve(%q) = %v, expected ok=%v", test.subpath, ferr, test.ok)
+		}
+	}
+}
+
+func TestCheckSymlink(t *testing.T) {
+	area, outside := testArea(t)
+	targets := []string{"f", "in/f", "../f", "../../f", "../out/f", "/etc/passwd", area + "in/f", outside}
+	tests := map[string][]bool{
+		symlinksAllow:    {true, true, true, true, true, true, true, true},
+		symlinksRelative: {true, true, true, true, true, false, false, false},
+		symlinksConfined: {true, true, true, false, false, false, true, false},
+		symlinksDeny:     {false, false, false, false, false, false, false, false},
+	}
+	for policy, exp := range tests {
+		conf := itemConf{Path: area, Symlinks: policy}
+		for i, target := range targets {
+			ferr := checkSymlink(conf, area, area+"in/link", target)
+			if (ferr == nil) != exp[i] {
+				t.Errorf("%v: symlink to %q = %v, expected ok=%v", policy, target, ferr, exp[i])
+			}
+		}
+	}
+
+	// Dedup areas have nothing on disk, so only the names matter.
+	conf := itemConf{Symlinks: symlinksConfined, Dedup: &dedupConf{}}
+	if ferr := checkSymlink(conf, "/dedup", "/dedup/a/link", "../b"); ferr != nil {
+		t.Errorf("Expected a link within a dedup area to be fine, got %v", ferr)
+	}
+	if ferr := checkSymlink(conf, "/dedup", "/dedup/a/link", "../../b"); ferr == nil {
+		t.Errorf("Expected a link out of a dedup area to be refused")
+	}
+}
+
+func TestPutEscapes(t *testing.T) {
+	area, outside := testArea(t)
+	conf := itemConf{Path: area, Writable: true, Symlinks: symlinksConfined}
+
+	put := func(subpath, ctype, body string) int {
+		req := httptest.NewRequest("PUT", "/area/"+subpath, strings.NewReader(body))
+		req.Header.Set("Content-Type", ctype)
+		w := httptest.NewRecorder()
+		handlePath(conf, subpath, w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		subpath, ctype, body string
+		exp                  int
+	}{
+		{"out/evil", "application/octet-stream", "evil", http.StatusForbidden},
+		{"up/new/evil", "application/octet-stream", "evil", http.StatusForbidden},
+		{"in/link", "application/symlink", "../../outside", http.StatusForbidden},
+		{"in/link", "application/symlink", "/etc", http.StatusForbidden},
+		{"in/link", "application/symlink", "../out", http.StatusForbidden},
+		{"in/hard", "application/hardlink", "out/f", http.StatusForbidden},
+		{"in/f", "application/octet-stream", "fine", 204},
+		{"in/link", "application/symlink", "f", 204},
+		{"inlink/g", "application/octet-stream", "fine", 204},
+	}
+	for _, test := range tests {
+		if got := put(test.subpath, test.ctype, test.body); got != test.exp {
+			t.Errorf("PUT %v (%v) = %v, expected %v", test.subpath, test.ctype, got, test.exp)
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil || len(entries) > 0 {
+		t.Errorf("Expected nothing written outside, got %v, %v", entries, err)
+	}
+
+	// Reading through a symlink leading out is refused too.
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handlePath(conf, "out/secret", w, httptest.NewRequest("GET", "/area/out/secret", nil))
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("Expected to be refused reading out/secret, got %v: %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/bitfog"
+)
+
+var reapInterval = time.Hour
+
+// trashConf describes where an area keeps the things it replaced
+// or deleted, and for how long.
+type trashConf struct {
+	Path      string   `json:"path"`
+	Retention duration `json:"retention"`
+}
+
+// trashEntry is a single item found in the trash.
+type trashEntry struct {
+	bitfog.FileData
+	ID      string `json:"id"`
+	Deleted int64  `json:"deleted"`
+}
+
+// openTrash opens the area's trash, creating it if need be.
+func openTrash(conf itemConf) (*os.Root, error) {
+	if err := os.MkdirAll(conf.Trash.Path, 0777); err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(conf.Trash.Path)
+}
+
+// discard gets the current occupant of abs out of the way, moving it
+// to the trash if the area has one.  A missing file is not an error.
+func discard(conf itemConf, abs string) error {
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := r.Lstat(rel); os.IsNotExist(err) {
+		return nil
+	}
+	if conf.Trash == nil {
+		return removeTreeIn(r, rel)
+	}
+
+	t, err := openTrash(conf)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	id, err := newTrashID(t, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := moveAcross(r, rel, t, filepath.Join(id, rel)); err != nil {
+		return err
+	}
+	log.Printf("Moved %s to trash as %s", abs, id)
+	return nil
+}
+
+// newTrashID makes a new directory in the trash t to discard things
+// into at time now.  Two discards can happen in the same nanosecond as
+// far as the clock can tell, so the directory is created exclusively,
+// moving on to the next nanosecond if it's already there.
+func newTrashID(t *os.Root, now time.Time) (string, error) {
+	for n := now.UnixNano(); ; n++ {
+		id := strconv.FormatInt(n, 10)
+		err := t.Mkdir(id, 0777)
+		if os.IsExist(err) {
+			continue
+		}
+		return id, err
+	}
+}
+
+func listTrash(conf itemConf, w http.ResponseWriter, req *http.Request) {
+	if conf.Trash == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No trash here.\n")
+		return
+	}
+
+	t, err := openTrash(conf)
+	if err != nil {
+		log.Printf("Error opening trash: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error reading trash.\n")
+		return
+	}
+	defer t.Close()
+	ids, err := fs.ReadDir(t.FS(), ".")
+	if err != nil {
+		log.Printf("Error reading trash: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error reading trash.\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	for _, id := range ids {
+		nanos, err := strconv.ParseInt(id.Name(), 10, 64)
+		if err != nil || !id.IsDir() {
+			continue
+		}
+		fs.WalkDir(t.FS(), id.Name(), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("Traversal error: %v", err)
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			fd, err := describe(t, filepath.FromSlash(p), strings.TrimPrefix(p, id.Name()+"/"), info, false, false)
+			if err != nil {
+				return nil
+			}
+			e.Encode(trashEntry{fd, id.Name(), time.Unix(0, nanos).Unix()})
+			return nil
+		})
+	}
+}
+
+func doUndelete(conf itemConf, abs string, w http.ResponseWriter, req *http.Request) {
+	if conf.Trash == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No trash here.\n")
+		return
+	}
+
+	id := req.FormValue("undelete")
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		http.Error(w, "invalid trash id: "+id, 400)
+		return
+	}
+	r, rel, err := rooted(conf.Path, abs)
+	if err != nil {
+		http.Error(w, "invalid path: "+err.Error(), 400)
+		return
+	}
+	defer r.Close()
+	t, err := openTrash(conf)
+	if err != nil {
+		log.Printf("Error opening trash: %v", err)
+		http.Error(w, "error opening trash: "+err.Error(), 500)
+		return
+	}
+	defer t.Close()
+	src := filepath.Join(id, rel)
+	if _, err := t.Lstat(src); err != nil {
+		http.Error(w, "not in trash: "+rel, 404)
+		return
+	}
+
+	if err := discard(conf, abs); err != nil {
+		log.Printf("Error moving %s out of the way: %v", abs, err)
+		http.Error(w, "error replacing file: "+err.Error(), 500)
+		return
+	}
+	if err := moveAcross(t, src, r, rel); err != nil {
+		log.Printf("Error undeleting %s: %v", abs, err)
+		http.Error(w, "error undeleting file: "+err.Error(), 500)
+		return
+	}
+	log.Printf("Undeleted %s from %s", abs, id)
+	w.WriteHeader(204)
+}
+
+// reapTrash removes everything in the trash older than the retention
+// period.  A zero retention keeps everything forever.
+func reapTrash(conf itemConf) {
+	if conf.Trash == nil || conf.Trash.Retention == 0 {
+		return
+	}
+	ids, err := os.ReadDir(conf.Trash.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading trash: %v", err)
+		}
+		return
+	}
+	horizon := time.Now().Add(-time.Duration(conf.Trash.Retention))
+	for _, id := range ids {
+		nanos, err := strconv.ParseInt(id.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if time.Unix(0, nanos).Before(horizon) {
+			log.Printf("Expiring trash %s", id.Name())
+			if err := removeTree(filepath.Join(conf.Trash.Path, id.Name())); err != nil {
+				log.Printf("Error expiring trash: %v", err)
+			}
+		}
+	}
+}
+
+func trashReaper(conf itemConf) {
+	for {
+		reapTrash(conf)
+		time.Sleep(reapInterval)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTrashArea(t *testing.T) itemConf {
+	base := t.TempDir()
+	conf := itemConf{Path: filepath.Join(base, "area") + "/", Writable: true,
+		Trash: &trashConf{Path: filepath.Join(base, "trash")}}
+	if err := os.MkdirAll(conf.Path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"f": "one", "g": "g"} {
+		if err := os.WriteFile(conf.Path+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conf
+}
+
+func listTestTrash(t *testing.T, conf itemConf) []trashEntry {
+	w := serve(conf, "GET", "?trash=list", "")
+	expectStatus(t, "listing trash", w, 200)
+	var rv []trashEntry
+	d := json.NewDecoder(w.Body)
+	for d.More() {
+		var e trashEntry
+		if err := d.Decode(&e); err != nil {
+			t.Fatalf("Error decoding trash listing: %v", err)
+		}
+		rv = append(rv, e)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+	return rv
+}
+
+func expectContent(t *testing.T, p, exp string) {
+	t.Helper()
+	if b, err := os.ReadFile(p); err != nil || string(b) != exp {
+		t.Errorf("Expected %v to hold %q, got %q, %v", p, exp, b, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	fakeRdiff(t)
+	conf := testTrashArea(t)
+
+	expectStatus(t, "deleting g", serve(conf, "DELETE", "g", ""), 204)
+	expectStatus(t, "overwriting f", serve(conf, "PUT", "f", "two",
+		"Content-Type", "application/octet-stream"), 204)
+	expectStatus(t, "patching f", serve(conf, "PATCH", "f?rdiff=patch", "three"), 204)
+	expectContent(t, conf.Path+"f", "three")
+	if _, err := os.Lstat(conf.Path + "g"); !os.IsNotExist(err) {
+		t.Errorf("Expected g to be gone, got %v", err)
+	}
+
+	entries := listTestTrash(t, conf)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, " ") != "g f f" {
+		t.Fatalf("Expected g, then f twice in the trash, got %v", names)
+	}
+	expectContent(t, filepath.Join(conf.Trash.Path, entries[1].ID, "f"), "one")
+	expectContent(t, filepath.Join(conf.Trash.Path, entries[2].ID, "f"), "two")
+
+	expectStatus(t, "undeleting g", serve(conf, "POST", "g?undelete="+entries[0].ID, ""), 204)
+	expectContent(t, conf.Path+"g", "g")
+	expectStatus(t, "undeleting f", serve(conf, "POST", "f?undelete="+entries[1].ID, ""), 204)
+	expectContent(t, conf.Path+"f", "one")
+	expectStatus(t, "undeleting g again", serve(conf, "POST", "g?undelete="+entries[0].ID, ""), 404)
+	expectStatus(t, "undeleting garbage", serve(conf, "POST", "g?undelete=x", ""), 400)
+
+	// What was undeleted over went to the trash too.
+	if got := len(listTestTrash(t, conf)); got != 2 {
+		t.Errorf("Expected f's last version and the one before in the trash, got %v", got)
+	}
+}
+
+func TestPatchWithoutTrash(t *testing.T) {
+	fakeRdiff(t)
+	conf := testTrashArea(t)
+	conf.Trash = nil
+	expectStatus(t, "patching f", serve(conf, "PATCH", "f?rdiff=patch", "two"), 204)
+	expectContent(t, conf.Path+"f", "two")
+	entries, err := os.ReadDir(conf.Path)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("Expected just f and g to be left, got %v, %v", entries, err)
+	}
+}
+
+func TestReapTrash(t *testing.T) {
+	conf := testTrashArea(t)
+	conf.Trash.Retention = duration(time.Hour)
+	old := strconv.FormatInt(time.Now().Add(-2*time.Hour).UnixNano(), 10)
+	recent := strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10)
+	for _, id := range []string{old, recent} {
+		if err := os.MkdirAll(filepath.Join(conf.Trash.Path, id, "d"), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forever := conf
+	forever.Trash = &trashConf{Path: conf.Trash.Path}
+	reapTrash(forever)
+	if got := len(listDirs(t, conf.Trash.Path)); got != 2 {
+		t.Errorf("Expected nothing reaped without a retention, got %v left", got)
+	}
+
+	reapTrash(conf)
+	if got := listDirs(t, conf.Trash.Path); strings.Join(got, " ") != recent {
+		t.Errorf("Expected only %v to be left, got %v", recent, got)
+	}
+}
+
+func listDirs(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", dir, err)
+	}
+	var rv []string
+	for _, e := range entries {
+		rv = append(rv, e.Name())
+	}
+	return rv
+}
+
+func TestTrashIDs(t *testing.T) {
+	conf := testTrashArea(t)
+	tr, err := openTrash(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	now := time.Unix(0, 5)
+	for _, exp := range []string{"5", "6", "7"} {
+		if id, err := newTrashID(tr, now); err != nil || id != exp {
+			t.Errorf("Expected trash id %v, got %v, %v", exp, id, err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// getXattrs returns every extended attribute of the file at p.
+func getXattrs(p string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(p, buf); err != nil {
+		return nil, err
+	}
+	rv := map[string][]byte{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := syscall.Getxattr(p, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(p, string(name), val); err != nil {
+			return nil, err
+		}
+		rv[string(name)] = val[:vsize]
+	}
+	return rv, nil
+}
+
+func setXattr(p, name string, val []byte) error {
+	return syscall.Setxattr(p, name, val, 0)
+}
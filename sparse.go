@@ -0,0 +1,132 @@
+package bitfog
+
+import (
+	"bytes"
+	"io"
+)
+
+// SparseBlock is the size of the runs of zeros SparseWriter turns into
+// holes.
+const SparseBlock = 4096
+
+// An Extent is a run of data in a file that may have holes.
+type Extent struct {
+	Off int64 `json:"off"`
+	Len int64 `json:"len"`
+}
+
+// SparseMap describes where the data is in a file.  Everything else
+// is a hole.
+type SparseMap struct {
+	Size    int64    `json:"size"`
+	Extents []Extent `json:"extents"`
+}
+
+// SparseWriter writes to a new, empty file, seeking over blocks of
+// zeros rather than writing them so they become holes.
+type SparseWriter struct {
+	w   io.WriteSeeker
+	off int64 // where the next byte goes
+	pos int64 // where w is
+}
+
+// NewSparseWriter returns a SparseWriter writing to w.
+func NewSparseWriter(w io.WriteSeeker) *SparseWriter {
+	return &SparseWriter{w: w}
+}
+
+var zeroBlock [SparseBlock]byte
+
+func (s *SparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Look at one (aligned) block at a time.
+		n := SparseBlock - int(s.off%SparseBlock)
+		if n > len(p) {
+			n = len(p)
+		}
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			if s.pos != s.off {
+				if _, err := s.w.Seek(s.off, io.SeekStart); err != nil {
+					return written, err
+				}
+				s.pos = s.off
+			}
+			m, err := s.w.Write(p[:n])
+			s.pos += int64(m)
+			if err != nil {
+				return written + m, err
+			}
+		}
+		s.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close makes sure a file ending in a hole is the right size, and
+// closes the underlying writer if it can be.
+func (s *SparseWriter) Close() error {
+	var err error
+	if s.pos != s.off {
+		if t, ok := s.w.(interface{ Truncate(int64) error }); ok {
+			err = t.Truncate(s.off)
+		} else if _, err = s.w.Seek(s.off-1, io.SeekStart); err == nil {
+			_, err = s.w.Write([]byte{0})
+		}
+	}
+	if c, ok := s.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// holeReader fills in the holes between extents with zeros.
+type holeReader struct {
+	r       io.Reader
+	extents []Extent
+	size    int64
+	off     int64
+}
+
+// NewHoleReader returns the full content of a file of the given size
+// whose data extents are read, one after another, from r.
+func NewHoleReader(r io.Reader, m SparseMap) io.Reader {
+	return &holeReader{r: r, extents: m.Extents, size: m.Size}
+}
+
+func (h *holeReader) Read(p []byte) (int, error) {
+	if h.off >= h.size {
+		return 0, io.EOF
+	}
+	for len(h.extents) > 0 && h.extents[0].Off+h.extents[0].Len <= h.off {
+		h.extents = h.extents[1:]
+	}
+	if len(p) > int(h.size-h.off) {
+		p = p[:h.size-h.off]
+	}
+	if len(h.extents) == 0 || h.off < h.extents[0].Off {
+		// In a hole.
+		if len(h.extents) > 0 && int64(len(p)) > h.extents[0].Off-h.off {
+			p = p[:h.extents[0].Off-h.off]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		h.off += int64(len(p))
+		return len(p), nil
+	}
+	e := h.extents[0]
+	if int64(len(p)) > e.Off+e.Len-h.off {
+		p = p[:e.Off+e.Len-h.off]
+	}
+	n, err := h.r.Read(p)
+	h.off += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
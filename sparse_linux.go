@@ -0,0 +1,42 @@
+package bitfog
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// DataExtents returns where the data is in f, which is size bytes
+// long.  If the filesystem can't say, it's all data.
+func DataExtents(f *os.File, size int64) ([]Extent, error) {
+	defer f.Seek(0, io.SeekStart)
+	var rv []Extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return []Extent{{0, size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		rv = append(rv, Extent{data, hole - data})
+		off = hole
+	}
+	return rv, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package bitfog
+
+import "os"
+
+// DataExtents returns where the data is in f, which is size bytes
+// long.  Holes can't be found here, so it's all data.
+func DataExtents(f *os.File, size int64) ([]Extent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return []Extent{{0, size}}, nil
+}
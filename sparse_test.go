@@ -0,0 +1,79 @@
+package bitfog
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparseRoundTrip(t *testing.T) {
+	want := make([]byte, 64*SparseBlock)
+	copy(want[100:], "data at the start")
+	copy(want[20*SparseBlock-5:], "data across a block boundary")
+	copy(want[40*SparseBlock:], bytes.Repeat([]byte{'x'}, 3*SparseBlock))
+	// ...and a hole at the end.
+
+	for _, chunk := range []int{1, 1000, SparseBlock, 3*SparseBlock + 7, len(want)} {
+		p := filepath.Join(t.TempDir(), "sparse")
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewSparseWriter(f)
+		for b := want; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := w.Write(b[:n]); err != nil {
+				t.Fatalf("Error writing: %v", err)
+			}
+			b = b[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("chunk=%v: content mangled (%v bytes)", chunk, len(got))
+		}
+
+		f, err = os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extents, err := DataExtents(f, int64(len(want)))
+		if err != nil {
+			t.Fatalf("Error finding extents: %v", err)
+		}
+		var buf bytes.Buffer
+		for _, e := range extents {
+			if _, err := io.Copy(&buf, io.NewSectionReader(f, e.Off, e.Len)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+		got, err = ioutil.ReadAll(NewHoleReader(&buf, SparseMap{int64(len(want)), extents}))
+		if err != nil {
+			t.Fatalf("Error reading with holes: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("chunk=%v: holes filled wrong", chunk)
+		}
+	}
+}
+
+func TestHoleReaderShort(t *testing.T) {
+	m := SparseMap{100, []Extent{{10, 20}}}
+	_, err := ioutil.ReadAll(NewHoleReader(bytes.NewReader(make([]byte, 5)), m))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}